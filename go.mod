@@ -1,6 +1,6 @@
 module github.com/mutablelogic/go-mosquitto
 
-go 1.13
+go 1.17
 
 require (
 	github.com/djthorpe/go-errors v1.0.2
@@ -8,3 +8,9 @@ require (
 	github.com/mutablelogic/go-server v1.0.36
 	github.com/mutablelogic/go-sqlite v1.0.50
 )
+
+require (
+	github.com/djthorpe/go-marshaler v0.0.15 // indirect
+	github.com/hashicorp/errwrap v1.1.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+)
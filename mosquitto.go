@@ -2,6 +2,9 @@ package mosquitto
 
 import (
 	"strings"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -9,6 +12,7 @@ import (
 
 type (
 	Flags uint
+	Level uint
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -28,6 +32,67 @@ const (
 	MOSQ_FLAG_EVENT_MAX        = MOSQ_FLAG_EVENT_LOG
 )
 
+// Log levels, which are the same as the levels of libmosquitto
+const (
+	MOSQ_LOG_INFO Level = 1 << iota
+	MOSQ_LOG_NOTICE
+	MOSQ_LOG_WARNING
+	MOSQ_LOG_ERR
+	MOSQ_LOG_DEBUG
+	MOSQ_LOG_NONE Level = 0
+	MOSQ_LOG_MIN        = MOSQ_LOG_INFO
+	MOSQ_LOG_MAX        = MOSQ_LOG_DEBUG
+)
+
+const (
+	flagPrefix = "MOSQ_FLAG_EVENT_"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// ParseFlags returns flags from names separated by "|" or ",", such as
+// "CONNECT|MESSAGE". Names are case-insensitive, and may include the
+// MOSQ_FLAG_EVENT_ prefix. "ALL" and "NONE" are also accepted
+func ParseFlags(v string) (Flags, error) {
+	result := MOSQ_FLAG_EVENT_NONE
+	for _, name := range strings.FieldsFunc(v, func(r rune) bool {
+		return r == '|' || r == ','
+	}) {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, flagPrefix) {
+			name = flagPrefix + name
+		}
+		if flag, exists := parseFlag(name); !exists {
+			return MOSQ_FLAG_EVENT_NONE, ErrBadParameter.Withf("ParseFlags: %q", strings.TrimPrefix(name, flagPrefix))
+		} else {
+			result |= flag
+		}
+	}
+	return result, nil
+}
+
+// MarshalText returns the flags as names separated by "|"
+func (f Flags) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// Set sets the flags from names, as ParseFlags, so that flags can be used
+// as a command line flag
+func (f *Flags) Set(v string) error {
+	return f.UnmarshalText([]byte(v))
+}
+
+// UnmarshalText sets the flags from names, as ParseFlags
+func (f *Flags) UnmarshalText(data []byte) error {
+	if v, err := ParseFlags(string(data)); err != nil {
+		return err
+	} else {
+		*f = v
+		return nil
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // STRINGIFY
 
@@ -66,3 +131,42 @@ func (f Flags) StringFlag() string {
 		return "[?? Invalid Flags value]"
 	}
 }
+
+func (l Level) String() string {
+	switch l {
+	case MOSQ_LOG_NONE:
+		return "MOSQ_LOG_NONE"
+	case MOSQ_LOG_INFO:
+		return "MOSQ_LOG_INFO"
+	case MOSQ_LOG_NOTICE:
+		return "MOSQ_LOG_NOTICE"
+	case MOSQ_LOG_WARNING:
+		return "MOSQ_LOG_WARNING"
+	case MOSQ_LOG_ERR:
+		return "MOSQ_LOG_ERR"
+	case MOSQ_LOG_DEBUG:
+		return "MOSQ_LOG_DEBUG"
+	default:
+		return "[?? Invalid Level value]"
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return a flag for a name, including MOSQ_FLAG_EVENT_ALL and
+// MOSQ_FLAG_EVENT_NONE
+func parseFlag(name string) (Flags, bool) {
+	switch name {
+	case "MOSQ_FLAG_EVENT_ALL":
+		return MOSQ_FLAG_EVENT_ALL, true
+	case MOSQ_FLAG_EVENT_NONE.StringFlag():
+		return MOSQ_FLAG_EVENT_NONE, true
+	}
+	for v := MOSQ_FLAG_EVENT_MIN; v <= MOSQ_FLAG_EVENT_MAX; v <<= 1 {
+		if v.StringFlag() == name {
+			return v, true
+		}
+	}
+	return MOSQ_FLAG_EVENT_NONE, false
+}
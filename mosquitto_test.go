@@ -0,0 +1,52 @@
+package mosquitto_test
+
+import (
+	"testing"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto"
+)
+
+func Test_Flags_001(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Flags
+	}{
+		{"", MOSQ_FLAG_EVENT_NONE},
+		{"NONE", MOSQ_FLAG_EVENT_NONE},
+		{"connect", MOSQ_FLAG_EVENT_CONNECT},
+		{"CONNECT|MESSAGE", MOSQ_FLAG_EVENT_CONNECT | MOSQ_FLAG_EVENT_MESSAGE},
+		{"subscribe, unsubscribe", MOSQ_FLAG_EVENT_SUBSCRIBE | MOSQ_FLAG_EVENT_UNSUBSCRIBE},
+		{"MOSQ_FLAG_EVENT_LOG", MOSQ_FLAG_EVENT_LOG},
+		{"ALL|LOG", MOSQ_FLAG_EVENT_ALL | MOSQ_FLAG_EVENT_LOG},
+	}
+	for _, test := range tests {
+		if flags, err := ParseFlags(test.in); err != nil {
+			t.Error(test.in, err)
+		} else if flags != test.out {
+			t.Errorf("ParseFlags(%q) = %v, expected %v", test.in, flags, test.out)
+		}
+	}
+	if _, err := ParseFlags("CONNECT|OTHER"); err == nil {
+		t.Error("Expected error for unknown flag")
+	}
+}
+
+func Test_Flags_002(t *testing.T) {
+	for _, flags := range []Flags{MOSQ_FLAG_EVENT_NONE, MOSQ_FLAG_EVENT_CONNECT, MOSQ_FLAG_EVENT_ALL | MOSQ_FLAG_EVENT_LOG} {
+		var other Flags
+		if data, err := flags.MarshalText(); err != nil {
+			t.Error(err)
+		} else if err := other.UnmarshalText(data); err != nil {
+			t.Error(err)
+		} else if other != flags {
+			t.Errorf("Unexpected flags %v, expected %v", other, flags)
+		}
+	}
+	var flags Flags
+	if err := flags.Set("publish"); err != nil {
+		t.Error(err)
+	} else if flags != MOSQ_FLAG_EVENT_PUBLISH {
+		t.Error("Unexpected flags", flags)
+	}
+}
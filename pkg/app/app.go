@@ -6,30 +6,50 @@ import (
 
 	// Packages
 	"github.com/mutablelogic/go-mosquitto/pkg/mosquitto"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
 // TYPES
 
 type App struct {
-	*mosquitto.Client
-	qos int
+	mosquitto.Conn
 }
 
 ////////////////////////////////////////////////////////////////////////////////
 // LIFECYCLE
 
-func NewApp(ctx context.Context, host string, qos int) (*App, error) {
+// NewApp connects to a broker, which is a URL or host:port. A QoS greater
+// than zero overrides the QoS in the URL. Events are printed as they are
+// received
+func NewApp(ctx context.Context, url string, qos int, events Flags) (*App, error) {
+	return NewAppWithConnect(ctx, url, qos, events, mosquitto.Connect)
+}
+
+// NewAppWithConnect connects to a broker with a connect function, such as
+// the Connect method of a fake connection for tests
+func NewAppWithConnect(ctx context.Context, url string, qos int, events Flags, connect mosquitto.ConnectFunc) (*App, error) {
 	app := new(App)
-	app.qos = qos
 
-	// Connect to broker
-	if client, err := mosquitto.New(ctx, host, func(evt *mosquitto.Event) {
+	// Create configuration
+	cfg, err := mosquitto.NewConfigFromURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if qos > 0 {
+		cfg = cfg.WithQoS(qos)
+	}
+	cfg = cfg.WithEvents(events).WithCallback(func(evt *mosquitto.Event) {
 		app.ProcessEvent(evt)
-	}); err != nil {
+	})
+
+	// Connect to broker
+	if conn, err := connect(ctx, cfg); err != nil {
 		return nil, err
 	} else {
-		app.Client = client
+		app.Conn = conn
 	}
 
 	// Return success
@@ -39,7 +59,7 @@ func NewApp(ctx context.Context, host string, qos int) (*App, error) {
 // Subscribe to topics, wait until cancel then close app
 func (app *App) Run(ctx context.Context, topics ...string) error {
 	for _, topic := range topics {
-		if _, err := app.Subscribe(topic, mosquitto.OptQoS(app.qos)); err != nil {
+		if _, err := app.Subscribe(topic); err != nil {
 			return err
 		}
 	}
@@ -50,7 +70,7 @@ func (app *App) Run(ctx context.Context, topics ...string) error {
 
 // Publish data to topic
 func (app *App) Publish(topic, data string) error {
-	if _, err := app.Client.Publish(topic, []byte(data), mosquitto.OptQoS(app.qos)); err != nil {
+	if _, err := app.Conn.Publish(topic, []byte(data)); err != nil {
 		return err
 	} else {
 		return nil
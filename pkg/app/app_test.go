@@ -0,0 +1,40 @@
+package app_test
+
+import (
+	"context"
+	"testing"
+
+	// Packages
+	mosquitto "github.com/mutablelogic/go-mosquitto/pkg/mosquitto"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto"
+	. "github.com/mutablelogic/go-mosquitto/pkg/app"
+)
+
+func Test_App_001(t *testing.T) {
+	fake := mosquitto.NewFake()
+	app, err := NewAppWithConnect(context.Background(), "mqtt://broker/?qos=1", 0, MOSQ_FLAG_EVENT_ALL, fake.Connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Publish("a/b", "data"); err != nil {
+		t.Fatal(err)
+	}
+	if published := fake.Published(); len(published) != 1 {
+		t.Error("Unexpected published", published)
+	} else if msg := published[0]; msg.Topic != "a/b" || string(msg.Data) != "data" || msg.QoS != 1 {
+		t.Error("Unexpected message", msg)
+	}
+	if err := app.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_App_002(t *testing.T) {
+	fake := mosquitto.NewFake()
+	fake.SetError(context.DeadlineExceeded)
+	if _, err := NewAppWithConnect(context.Background(), "broker", 0, MOSQ_FLAG_EVENT_ALL, fake.Connect); err != context.DeadlineExceeded {
+		t.Error("Unexpected error", err)
+	}
+}
@@ -4,9 +4,6 @@ import (
 	"fmt"
 	"io"
 	"runtime"
-
-	// Packages
-	mosq "github.com/mutablelogic/go-mosquitto/sys/mosquitto"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -31,10 +28,7 @@ func PrintVersion(w io.Writer) {
 		fmt.Fprintf(w, "  Build Time: %v\n", GoBuildTime)
 	}
 	fmt.Fprintf(w, "  Go: %v (%v/%v)\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
-	fmt.Fprintf(w, "  libmosquitto: %v\n", LibVersion())
-}
-
-func LibVersion() string {
-	major, minor, revision := mosq.Version()
-	return fmt.Sprintf("%d.%d.%d", major, minor, revision)
+	if v := LibVersion(); v != "" {
+		fmt.Fprintf(w, "  libmosquitto: %v\n", v)
+	}
 }
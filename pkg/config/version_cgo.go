@@ -0,0 +1,16 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package config
+
+import (
+	"fmt"
+
+	// Packages
+	mosq "github.com/mutablelogic/go-mosquitto/sys/mosquitto"
+)
+
+func LibVersion() string {
+	major, minor, revision := mosq.Version()
+	return fmt.Sprintf("%d.%d.%d", major, minor, revision)
+}
@@ -0,0 +1,10 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package config
+
+// LibVersion returns an empty string, as libmosquitto is not used
+// without cgo
+func LibVersion() string {
+	return ""
+}
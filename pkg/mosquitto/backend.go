@@ -0,0 +1,130 @@
+package mosquitto
+
+import (
+	"context"
+	"time"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Backend is the implementation of the MQTT protocol used by a client
+type Backend uint
+
+// backend is an implementation of the MQTT protocol. Events are passed to
+// the client by calling its on methods, from the loop
+type backend interface {
+	// Connect to a broker without waiting for the acknowledgement. The
+	// context cancels the attempt to connect
+	connect(ctx context.Context, b broker, keepalive time.Duration) error
+
+	// Disconnect from the broker
+	disconnect() error
+
+	// Release resources, once the loop has stopped
+	destroy() error
+
+	// Requests, which return the message id
+	subscribe(topics []string, qos, options int, props Properties) (int, error)
+	unsubscribe(topics []string, props Properties) (int, error)
+	publish(topic string, data []byte, qos int, retain bool, props Properties) (int, error)
+
+	// Run the loop once, waiting up to the timeout for packets. Returns an
+	// error when the client is not connected
+	loop(timeout time.Duration) error
+
+	// Return the error for a reason code, and for a lost connection
+	reasonError(rc int) error
+	lostError() error
+
+	// Return the version of the implementation
+	version() string
+}
+
+// threadedBackend runs the loop in a thread started by the implementation
+type threadedBackend interface {
+	loopStart() error
+	loopStop() error
+}
+
+// socketBackend runs the loop when the socket is ready, so that the
+// sockets of many clients can be polled at once
+type socketBackend interface {
+	socket() int
+	wantWrite() bool
+	loopRead() error
+	loopWrite() error
+	loopMisc() error
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	BackendDefault   Backend = iota // libmosquitto when built with cgo, otherwise Go
+	BackendMosquitto                // libmosquitto, which requires cgo
+	BackendGo                       // Implemented in Go, by pkg/mqtt
+)
+
+const (
+	// Default ports for plain and TLS connections
+	defaultPort       = 1883
+	defaultSecurePort = 8883
+
+	// Connection acknowledgement flag when the broker has resumed a session
+	sessionPresent = 0x01
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Backends returns the backends which are available in this build, with
+// the default first. libmosquitto is not available when built without cgo
+// or with the purego build tag
+func Backends() []Backend {
+	if hasMosquitto {
+		return []Backend{BackendMosquitto, BackendGo}
+	} else {
+		return []Backend{BackendGo}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (b Backend) String() string {
+	switch b {
+	case BackendDefault:
+		return "BackendDefault"
+	case BackendMosquitto:
+		return "BackendMosquitto"
+	case BackendGo:
+		return "BackendGo"
+	default:
+		return "[?? Invalid Backend value]"
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return a backend for a client
+func newBackend(c *Client, cfg Config) (backend, error) {
+	switch cfg.backend {
+	case BackendDefault:
+		if hasMosquitto {
+			return newMosquittoBackend(c, cfg)
+		} else {
+			return newGoBackend(c, cfg)
+		}
+	case BackendMosquitto:
+		return newMosquittoBackend(c, cfg)
+	case BackendGo:
+		return newGoBackend(c, cfg)
+	default:
+		return nil, ErrBadParameter.With("Backend: ", cfg.backend)
+	}
+}
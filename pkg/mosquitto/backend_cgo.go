@@ -0,0 +1,645 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package mosquitto
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	// Packages
+	multierror "github.com/hashicorp/go-multierror"
+	mosq "github.com/mutablelogic/go-mosquitto/sys/mosquitto"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+	. "github.com/mutablelogic/go-mosquitto"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// mosquittoBackend implements the protocol with libmosquitto
+type mosquittoBackend struct {
+	sync.Mutex
+	client  *mosq.ClientEx
+	v5      bool
+	pending chan struct{} // Closed when an abandoned connect has returned
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	hasMosquitto = true
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// GLOBALS
+
+var (
+	once = new(sync.Once)
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newMosquittoBackend(c *Client, cfg Config) (backend, error) {
+	// Initialize once
+	var result error
+	once.Do(func() {
+		if err := mosq.Init(); err != nil {
+			result = multierror.Append(result, err)
+		}
+		runtime.SetFinalizer(&once, func() {
+			mosq.Cleanup()
+		})
+	})
+	if result != nil {
+		return nil, result
+	}
+
+	// Create a client, and configure it
+	client, err := mosq.NewEx(cfg.clientId, !cfg.persistent)
+	if err != nil {
+		return nil, err
+	}
+	b := &mosquittoBackend{client: client, v5: cfg.protocol == MQTT_PROTOCOL_V5}
+	if err := b.configure(c, cfg); err != nil {
+		client.Destroy()
+		return nil, err
+	}
+
+	// Return success
+	return b, nil
+}
+
+// Destroy the client, once any abandoned connect has returned
+func (b *mosquittoBackend) destroy() error {
+	if pending := b.abandoned(); pending != nil {
+		<-pending
+	}
+	return b.client.Destroy()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+func (b *mosquittoBackend) version() string {
+	major, minor, revision := mosq.Version()
+	return fmt.Sprintf("%d.%d.%d", major, minor, revision)
+}
+
+// Connect to a broker without waiting for the connection to complete,
+// which is completed by the loop. The protocol version has already been
+// set, so the asynchronous connect is also used for MQTT v5. The library
+// resolves the host name before returning and does not accept a context,
+// so the connect is abandoned when the context is done, and the connection
+// is closed when the library returns
+func (b *mosquittoBackend) connect(ctx context.Context, broker broker, keepalive time.Duration) error {
+	// Wait for an abandoned connect to return
+	if pending := b.abandoned(); pending != nil {
+		select {
+		case <-pending:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Connect in the background, and wait for it to return or for the
+	// context to be done
+	done := make(chan error, 1)
+	go func() {
+		done <- b.client.Connect(broker.host, int(broker.port), int(keepalive.Seconds()), true)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		pending := make(chan struct{})
+		b.Lock()
+		b.pending = pending
+		b.Unlock()
+		go func() {
+			defer close(pending)
+			if err := <-done; err == nil {
+				b.client.Disconnect()
+			}
+		}()
+		return ctx.Err()
+	}
+}
+
+func (b *mosquittoBackend) disconnect() error {
+	if b.v5 {
+		return b.client.DisconnectV5(mosq.MQTT_RC_NORMAL_DISCONNECTION, nil)
+	} else {
+		return b.client.Disconnect()
+	}
+}
+
+func (b *mosquittoBackend) subscribe(topics []string, qos, options int, p Properties) (int, error) {
+	props, err := b.properties(p)
+	if err != nil {
+		return 0, err
+	}
+	defer props.Free()
+	if len(topics) > 1 {
+		if !b.v5 {
+			options = 0
+		}
+		return b.client.SubscribeMultiple(topics, qos, options, props)
+	} else if b.v5 {
+		return b.client.SubscribeV5(topics[0], qos, options, props)
+	} else {
+		return b.client.Subscribe(topics[0], qos)
+	}
+}
+
+func (b *mosquittoBackend) unsubscribe(topics []string, p Properties) (int, error) {
+	props, err := b.properties(p)
+	if err != nil {
+		return 0, err
+	}
+	defer props.Free()
+	if len(topics) > 1 {
+		return b.client.UnsubscribeMultiple(topics, props)
+	} else if b.v5 {
+		return b.client.UnsubscribeV5(topics[0], props)
+	} else {
+		return b.client.Unsubscribe(topics[0])
+	}
+}
+
+func (b *mosquittoBackend) publish(topic string, data []byte, qos int, retain bool, p Properties) (int, error) {
+	props, err := b.properties(p)
+	if err != nil {
+		return 0, err
+	}
+	defer props.Free()
+	if b.v5 {
+		return b.client.PublishV5(topic, data, qos, retain, props)
+	} else {
+		return b.client.Publish(topic, data, qos, retain)
+	}
+}
+
+func (b *mosquittoBackend) loop(timeout time.Duration) error {
+	return b.client.Loop(int(timeout.Milliseconds()))
+}
+
+func (b *mosquittoBackend) loopStart() error {
+	// The library only starts a thread for a client which is not threaded
+	if err := b.client.SetThreaded(false); err != nil {
+		return err
+	}
+	return b.client.LoopStart()
+}
+
+func (b *mosquittoBackend) loopStop() error {
+	return b.client.LoopStop(false)
+}
+
+func (b *mosquittoBackend) socket() int {
+	return b.client.Socket()
+}
+
+func (b *mosquittoBackend) wantWrite() bool {
+	return b.client.WantWrite()
+}
+
+func (b *mosquittoBackend) loopRead() error {
+	return b.client.LoopRead(1)
+}
+
+func (b *mosquittoBackend) loopWrite() error {
+	return b.client.LoopWrite(1)
+}
+
+func (b *mosquittoBackend) loopMisc() error {
+	return b.client.LoopMisc()
+}
+
+func (b *mosquittoBackend) reasonError(rc int) error {
+	return mosq.ReasonCode(rc)
+}
+
+func (b *mosquittoBackend) lostError() error {
+	return mosq.Error(mosq.MOSQ_ERR_CONN_LOST)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Apply the configuration to the client
+func (b *mosquittoBackend) configure(c *Client, cfg Config) error {
+	// Set credentials
+	if cfg.user != "" {
+		if err := b.client.SetCredentials(cfg.user, cfg.password); err != nil {
+			return err
+		}
+	}
+
+	// Set TLS
+	if err := b.setTLS(cfg); err != nil {
+		return err
+	}
+
+	// Set the reconnect delay, which is used by the library loop, in seconds
+	if err := b.client.SetReconnectDelay(seconds(cfg.reconnect.initial), seconds(cfg.reconnect.max), cfg.reconnect.exponential); err != nil {
+		return err
+	}
+
+	// Set protocol version
+	if cfg.protocol != 0 {
+		if err := b.client.SetProtocol(cfg.protocol); err != nil {
+			return err
+		}
+	}
+
+	// Set network options
+	if err := b.setOptions(cfg); err != nil {
+		return err
+	}
+
+	// Set will message
+	if cfg.will != nil {
+		if err := b.setWill(cfg.will); err != nil {
+			return err
+		}
+	}
+
+	// Set callbacks for the events requested, and the events the client needs
+	if b.v5 {
+		b.setCallbacksV5(c, cfg.callbacks())
+	} else {
+		b.setCallbacks(c, cfg.callbacks())
+	}
+
+	// Set log callback, for log events, trace and the logger
+	if cfg.trace != nil || cfg.logger != nil || cfg.events&MOSQ_FLAG_EVENT_LOG != 0 {
+		b.client.SetLogCallback(func(level mosq.Level, message string) {
+			if cfg.trace != nil {
+				cfg.trace(message)
+			}
+			c.onLog(Level(level), message)
+		})
+	}
+
+	// Requests are written to the socket by the loop, rather than the caller
+	return b.client.SetThreaded(true)
+}
+
+// Return a channel which is closed when an abandoned connect has returned,
+// or nil if there is no abandoned connect
+func (b *mosquittoBackend) abandoned() chan struct{} {
+	b.Lock()
+	defer b.Unlock()
+	if b.pending != nil {
+		select {
+		case <-b.pending:
+			b.pending = nil
+		default:
+		}
+	}
+	return b.pending
+}
+
+// Encode properties for a request, which returns an error if properties
+// are set and the protocol is not MQTT v5
+func (b *mosquittoBackend) properties(p Properties) (*mosq.Properties, error) {
+	if b.v5 {
+		return encodeProperties(p)
+	} else if !p.empty() {
+		return nil, ErrBadParameter.With("Properties require MQTT v5")
+	} else {
+		return nil, nil
+	}
+}
+
+// Set TLS options, using either certificates or a pre-shared key
+func (b *mosquittoBackend) setTLS(cfg Config) error {
+	if cfg.capath == "" && cfg.psk == "" && !cfg.oscerts {
+		if cfg.tlsversion != "" || cfg.ciphers != "" || cfg.insecure {
+			return ErrBadParameter.With("TLS options require certificates or a pre-shared key")
+		}
+		return nil
+	} else if cfg.capath != "" && cfg.psk != "" {
+		return ErrBadParameter.With("Cannot use both certificates and pre-shared key")
+	}
+
+	// Key format needs to be set before the certificates
+	if cfg.engine != "" {
+		if err := b.client.SetTLSEngine(cfg.engine); err != nil {
+			return err
+		}
+	}
+	if cfg.keyform != "" {
+		if err := b.client.SetTLSKeyform(cfg.keyform); err != nil {
+			return err
+		}
+	}
+
+	// Use operating system certificates
+	if cfg.oscerts {
+		if err := b.client.IntOption(mosq.MOSQ_OPT_TLS_USE_OS_CERTS, 1); err != nil {
+			return err
+		}
+	}
+
+	// Set certificates or pre-shared key
+	if cfg.psk != "" {
+		if err := b.client.SetTLSPSK(cfg.psk, cfg.pskidentity, cfg.ciphers); err != nil {
+			return err
+		}
+	} else if cfg.capath != "" {
+		if cfg.keypass != nil {
+			if err := b.client.SetTLSWithPassword(cfg.capath, cfg.certpath, cfg.keypath, cfg.keypass); err != nil {
+				return err
+			}
+		} else if err := b.client.SetTLS(cfg.capath, cfg.certpath, cfg.keypath); err != nil {
+			return err
+		}
+	}
+
+	// Set host name verification, version and ciphers, which apply to
+	// certificates and pre-shared keys
+	if err := b.client.SetTLSInsecure(cfg.insecure); err != nil {
+		return err
+	}
+	if cfg.tlsversion != "" || cfg.ciphers != "" {
+		if err := b.client.SetTLSOpts(mosq.MOSQ_TLS_VERIFY_PEER, cfg.tlsversion, cfg.ciphers); err != nil {
+			return err
+		}
+	}
+
+	// Set ALPN and OCSP
+	if cfg.alpn != "" {
+		if err := b.client.SetTLSALPN(cfg.alpn); err != nil {
+			return err
+		}
+	}
+	if cfg.ocsp {
+		if err := b.client.SetTLSOCSPRequired(true); err != nil {
+			return err
+		}
+	}
+
+	// Return success
+	return nil
+}
+
+// Set network and flow control options
+func (b *mosquittoBackend) setOptions(cfg Config) error {
+	if cfg.bindaddress != "" {
+		if err := b.client.StringOption(mosq.MOSQ_OPT_BIND_ADDRESS, cfg.bindaddress); err != nil {
+			return err
+		}
+	}
+	if cfg.nodelay {
+		if err := b.client.IntOption(mosq.MOSQ_OPT_TCP_NODELAY, 1); err != nil {
+			return err
+		}
+	}
+	if cfg.recvmax > 0 {
+		if err := b.client.IntOption(mosq.MOSQ_OPT_RECEIVE_MAXIMUM, cfg.recvmax); err != nil {
+			return err
+		}
+	}
+	if cfg.sendmax > 0 {
+		if err := b.client.IntOption(mosq.MOSQ_OPT_SEND_MAXIMUM, cfg.sendmax); err != nil {
+			return err
+		}
+	}
+
+	// Return success
+	return nil
+}
+
+// Set the will message, using will properties for MQTT v5
+func (b *mosquittoBackend) setWill(w *will) error {
+	if !w.v5 {
+		return b.client.SetWill(w.topic, w.payload, w.qos, w.retain)
+	} else if !b.v5 {
+		return ErrBadParameter.With("Will properties require MQTT v5")
+	}
+	props, err := encodeProperties(w.props)
+	if err != nil {
+		return err
+	}
+	defer props.Free()
+	return b.client.SetWillV5(w.topic, w.payload, w.qos, w.retain, props)
+}
+
+// Set the MQTT v3 callbacks. The library does not report whether a message
+// is a duplicate, so Duplicate is always false
+func (b *mosquittoBackend) setCallbacks(c *Client, events Flags) {
+	if events&MOSQ_FLAG_EVENT_CONNECT != 0 {
+		b.client.SetConnectWithFlagsCallback(func(err mosq.Error, flags int) {
+			c.onConnect(toError(err), 0, flags, Properties{})
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_DISCONNECT != 0 {
+		b.client.SetDisconnectCallback(func(err mosq.Error) {
+			c.onDisconnect(toError(err), 0, Properties{})
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_SUBSCRIBE != 0 {
+		b.client.SetSubscribeCallback(func(id int, qos []int) {
+			c.onSubscribe(id, qos, Properties{})
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_UNSUBSCRIBE != 0 {
+		b.client.SetUnsubscribeCallback(func(id int) {
+			c.onUnsubscribe(id, Properties{})
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_PUBLISH != 0 {
+		b.client.SetPublishCallback(func(id int) {
+			c.onPublish(id, nil, 0, Properties{})
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_MESSAGE != 0 {
+		b.client.SetMessageCallback(func(message *mosq.Message) {
+			c.onMessage(message.Id(), message.Topic(), copyData(message.Data()), message.Qos(), message.Retain(), false, Properties{})
+		})
+	}
+}
+
+// Set the MQTT v5 callbacks, which carry reason codes and properties
+func (b *mosquittoBackend) setCallbacksV5(c *Client, events Flags) {
+	if events&MOSQ_FLAG_EVENT_CONNECT != 0 {
+		b.client.SetConnectV5Callback(func(rc mosq.ReasonCode, flags int, props *mosq.Properties) {
+			c.onConnect(toReasonError(rc), int(rc), flags, decodeProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_DISCONNECT != 0 {
+		b.client.SetDisconnectV5Callback(func(rc mosq.ReasonCode, props *mosq.Properties) {
+			c.onDisconnect(b.disconnectError(rc), int(rc), decodeProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_SUBSCRIBE != 0 {
+		b.client.SetSubscribeV5Callback(func(id int, qos []int, props *mosq.Properties) {
+			c.onSubscribe(id, qos, decodeProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_UNSUBSCRIBE != 0 {
+		b.client.SetUnsubscribeV5Callback(func(id int, props *mosq.Properties) {
+			c.onUnsubscribe(id, decodeProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_PUBLISH != 0 {
+		b.client.SetPublishV5Callback(func(id int, rc mosq.ReasonCode, props *mosq.Properties) {
+			c.onPublish(id, toReasonError(rc), int(rc), decodeProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_MESSAGE != 0 {
+		b.client.SetMessageV5Callback(func(message *mosq.Message, props *mosq.Properties) {
+			c.onMessage(message.Id(), message.Topic(), copyData(message.Data()), message.Qos(), message.Retain(), false, decodeProperties(props))
+		})
+	}
+}
+
+// Make a copy of message data, as this is invalidated after the callback ends
+func copyData(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
+
+func toError(err mosq.Error) error {
+	if err == mosq.MOSQ_ERR_SUCCESS {
+		return nil
+	} else {
+		return err
+	}
+}
+
+// Return an error for a reason code. Reason codes below 0x80 indicate
+// success, such as the granted QoS or no matching subscribers
+func toReasonError(rc mosq.ReasonCode) error {
+	if rc < mosq.MQTT_RC_UNSPECIFIED {
+		return nil
+	} else {
+		return rc
+	}
+}
+
+// Return an error for the reason of a disconnect, which is a reason code
+// from the broker or, when the connection was lost, a library error which
+// is not a reason code
+func (b *mosquittoBackend) disconnectError(rc mosq.ReasonCode) error {
+	if rc == mosq.MQTT_RC_NORMAL_DISCONNECTION {
+		return nil
+	} else if err := toReasonError(rc); err != nil {
+		return err
+	} else {
+		return b.lostError()
+	}
+}
+
+// Decode a property list received from the library
+func decodeProperties(props *mosq.Properties) Properties {
+	var p Properties
+	if props == nil {
+		return p
+	}
+	if v, ok := props.GetString(mosq.MQTT_PROP_CONTENT_TYPE); ok {
+		p.ContentType = v
+	}
+	if v, ok := props.GetString(mosq.MQTT_PROP_RESPONSE_TOPIC); ok {
+		p.ResponseTopic = v
+	}
+	if v, ok := props.GetBinary(mosq.MQTT_PROP_CORRELATION_DATA); ok {
+		p.CorrelationData = v
+	}
+	if v, ok := props.GetInt32(mosq.MQTT_PROP_MESSAGE_EXPIRY_INTERVAL); ok {
+		p.MessageExpiry = time.Duration(v) * time.Second
+	}
+	if v, ok := props.GetByte(mosq.MQTT_PROP_PAYLOAD_FORMAT_INDICATOR); ok {
+		p.PayloadFormat = int(v)
+	}
+	for _, v := range props.GetVarints(mosq.MQTT_PROP_SUBSCRIPTION_IDENTIFIER) {
+		p.SubscriptionIds = append(p.SubscriptionIds, int(v))
+	}
+	if v, ok := props.GetString(mosq.MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER); ok {
+		p.AssignedClientId = v
+	}
+	if v, ok := props.GetInt32(mosq.MQTT_PROP_SESSION_EXPIRY_INTERVAL); ok {
+		p.SessionExpiry = time.Duration(v) * time.Second
+	}
+	if v, ok := props.GetInt16(mosq.MQTT_PROP_SERVER_KEEP_ALIVE); ok {
+		p.ServerKeepAlive = time.Duration(v) * time.Second
+	}
+	if v, ok := props.GetString(mosq.MQTT_PROP_REASON_STRING); ok {
+		p.ReasonString = v
+	}
+	if v, ok := props.GetString(mosq.MQTT_PROP_SERVER_REFERENCE); ok {
+		p.ServerReference = v
+	}
+	for _, pair := range props.GetStringPairs(mosq.MQTT_PROP_USER_PROPERTY) {
+		p.UserProperties = append(p.UserProperties, UserProperty{pair[0], pair[1]})
+	}
+	return p
+}
+
+// Encode message properties into a property list for the library, or return
+// nil if there are no properties to send
+func encodeProperties(p Properties) (*mosq.Properties, error) {
+	if p.empty() {
+		return nil, nil
+	}
+	props := mosq.NewProperties()
+	if p.PayloadFormat != 0 {
+		if err := props.AddByte(mosq.MQTT_PROP_PAYLOAD_FORMAT_INDICATOR, uint8(p.PayloadFormat)); err != nil {
+			return nil, err
+		}
+	}
+	if p.MessageExpiry > 0 {
+		if err := props.AddInt32(mosq.MQTT_PROP_MESSAGE_EXPIRY_INTERVAL, uint32(p.MessageExpiry.Seconds())); err != nil {
+			return nil, err
+		}
+	}
+	if p.ContentType != "" {
+		if err := props.AddString(mosq.MQTT_PROP_CONTENT_TYPE, p.ContentType); err != nil {
+			return nil, err
+		}
+	}
+	if p.ResponseTopic != "" {
+		if err := props.AddString(mosq.MQTT_PROP_RESPONSE_TOPIC, p.ResponseTopic); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.CorrelationData) > 0 {
+		if err := props.AddBinary(mosq.MQTT_PROP_CORRELATION_DATA, p.CorrelationData); err != nil {
+			return nil, err
+		}
+	}
+	if p.SessionExpiry > 0 {
+		if err := props.AddInt32(mosq.MQTT_PROP_SESSION_EXPIRY_INTERVAL, uint32(p.SessionExpiry.Seconds())); err != nil {
+			return nil, err
+		}
+	}
+	if p.WillDelay > 0 {
+		if err := props.AddInt32(mosq.MQTT_PROP_WILL_DELAY_INTERVAL, uint32(p.WillDelay.Seconds())); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range p.SubscriptionIds {
+		if err := props.AddVarint(mosq.MQTT_PROP_SUBSCRIPTION_IDENTIFIER, uint32(id)); err != nil {
+			return nil, err
+		}
+	}
+	for _, prop := range p.UserProperties {
+		if err := props.AddStringPair(mosq.MQTT_PROP_USER_PROPERTY, prop.Name, prop.Value); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
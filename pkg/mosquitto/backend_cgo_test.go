@@ -0,0 +1,49 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package mosquitto
+
+import (
+	"testing"
+
+	// Packages
+	mosq "github.com/mutablelogic/go-mosquitto/sys/mosquitto"
+)
+
+func Test_Reason_001(t *testing.T) {
+	tests := []struct {
+		rc  mosq.ReasonCode
+		err bool
+	}{
+		{mosq.MQTT_RC_SUCCESS, false},
+		{mosq.MQTT_RC_GRANTED_QOS1, false},
+		{mosq.MQTT_RC_GRANTED_QOS2, false},
+		{mosq.MQTT_RC_NO_MATCHING_SUBSCRIBERS, false},
+		{mosq.MQTT_RC_UNSPECIFIED, true},
+		{mosq.MQTT_RC_NOT_AUTHORIZED, true},
+		{mosq.MQTT_RC_QUOTA_EXCEEDED, true},
+		{mosq.MQTT_RC_WILDCARD_SUBS_NOT_SUPPORTED, true},
+	}
+	for _, test := range tests {
+		err := toReasonError(test.rc)
+		if (err != nil) != test.err {
+			t.Errorf("toReasonError(0x%02X): unexpected error %v", int(test.rc), err)
+		} else if err != nil {
+			if _, ok := err.(mosq.ReasonCode); !ok {
+				t.Errorf("toReasonError(0x%02X): unexpected error type %T", int(test.rc), err)
+			}
+		}
+	}
+
+	// A disconnect without a reason code is a lost connection
+	b := new(mosquittoBackend)
+	if err := b.disconnectError(mosq.MQTT_RC_NORMAL_DISCONNECTION); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	if err := b.disconnectError(mosq.ReasonCode(mosq.MOSQ_ERR_CONN_LOST)); err != b.lostError() {
+		t.Error("Unexpected error", err)
+	}
+	if err := b.disconnectError(mosq.MQTT_RC_SESSION_TAKEN_OVER); err != mosq.MQTT_RC_SESSION_TAKEN_OVER {
+		t.Error("Unexpected error", err)
+	}
+}
@@ -0,0 +1,498 @@
+package mosquitto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	// Packages
+	mqtt "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+	. "github.com/mutablelogic/go-mosquitto"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// goBackend implements the protocol in Go, with pkg/mqtt
+type goBackend struct {
+	client *mqtt.Client
+	v5     bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Timeout for connecting to a broker, when the context has no deadline
+	dialTimeout = 10 * time.Second
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newGoBackend(c *Client, cfg Config) (backend, error) {
+	// Check for options which are not supported
+	if cfg.psk != "" {
+		return nil, ErrNotImplemented.With("Pre-shared keys require libmosquitto")
+	} else if cfg.keyform != "" || cfg.engine != "" {
+		return nil, ErrNotImplemented.With("Key form and engine require libmosquitto")
+	} else if cfg.ocsp {
+		return nil, ErrNotImplemented.With("OCSP requires libmosquitto")
+	} else if cfg.ciphers != "" {
+		return nil, ErrNotImplemented.With("Cipher lists require libmosquitto")
+	} else if cfg.sendmax > 0 {
+		return nil, ErrNotImplemented.With("Send maximum requires libmosquitto")
+	}
+
+	// Create a client, and configure it
+	client, err := mqtt.New(cfg.clientId, !cfg.persistent)
+	if err != nil {
+		return nil, err
+	}
+	b := &goBackend{client, cfg.protocol == MQTT_PROTOCOL_V5}
+	if err := b.configure(c, cfg); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// Return success
+	return b, nil
+}
+
+func (b *goBackend) destroy() error {
+	return b.client.Close()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+func (b *goBackend) version() string {
+	return runtime.Version()
+}
+
+// Connect to a broker and send the connect request, which is acknowledged
+// in the loop
+func (b *goBackend) connect(ctx context.Context, broker broker, keepalive time.Duration) error {
+	if broker.unix() {
+		return b.client.Connect(ctx, "unix", broker.host, keepalive)
+	} else {
+		return b.client.Connect(ctx, "tcp", net.JoinHostPort(broker.host, strconv.FormatUint(uint64(broker.port), 10)), keepalive)
+	}
+}
+
+func (b *goBackend) disconnect() error {
+	return b.client.Disconnect(mqtt.MQTT_RC_NORMAL_DISCONNECTION, nil)
+}
+
+func (b *goBackend) subscribe(topics []string, qos, options int, p Properties) (int, error) {
+	if !b.v5 {
+		options = 0
+	}
+	if props, err := b.properties(p); err != nil {
+		return 0, err
+	} else {
+		return b.client.Subscribe(topics, qos, options, props)
+	}
+}
+
+func (b *goBackend) unsubscribe(topics []string, p Properties) (int, error) {
+	if props, err := b.properties(p); err != nil {
+		return 0, err
+	} else {
+		return b.client.Unsubscribe(topics, props)
+	}
+}
+
+func (b *goBackend) publish(topic string, data []byte, qos int, retain bool, p Properties) (int, error) {
+	if props, err := b.properties(p); err != nil {
+		return 0, err
+	} else {
+		return b.client.Publish(topic, data, qos, retain, props)
+	}
+}
+
+func (b *goBackend) loop(timeout time.Duration) error {
+	return b.client.Loop(timeout)
+}
+
+func (b *goBackend) reasonError(rc int) error {
+	return mqtt.ReasonCode(rc)
+}
+
+func (b *goBackend) lostError() error {
+	return ErrOutOfOrder.With("Connection lost")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Apply the configuration to the client
+func (b *goBackend) configure(c *Client, cfg Config) error {
+	// Set credentials
+	if cfg.user != "" {
+		b.client.SetCredentials(cfg.user, cfg.password)
+	}
+
+	// Set TLS
+	if config, err := newTLSConfig(cfg); err != nil {
+		return err
+	} else if config != nil {
+		b.client.SetTLS(config)
+	}
+
+	// Set protocol version
+	if cfg.protocol != 0 {
+		if err := b.client.SetProtocol(cfg.protocol); err != nil {
+			return err
+		}
+	}
+
+	// Set network options. Nagle's algorithm is disabled by default in Go
+	dialer := net.Dialer{Timeout: dialTimeout}
+	if cfg.bindaddress != "" {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(cfg.bindaddress, "0"))
+		if err != nil {
+			return err
+		}
+		dialer.LocalAddr = addr
+	}
+	b.client.SetDialer(dialer)
+	if cfg.recvmax > 0 {
+		if !b.v5 {
+			return ErrBadParameter.With("Receive maximum requires MQTT v5")
+		}
+		var props mqtt.Properties
+		if err := props.AddInt16(mqtt.MQTT_PROP_RECEIVE_MAXIMUM, uint16(cfg.recvmax)); err != nil {
+			return err
+		}
+		b.client.SetConnectProperties(props)
+	}
+
+	// Set will message
+	if w := cfg.will; w != nil {
+		if w.v5 && !b.v5 {
+			return ErrBadParameter.With("Will properties require MQTT v5")
+		} else if props, err := encodePacketProperties(w.props); err != nil {
+			return err
+		} else if err := b.client.SetWill(w.topic, w.payload, w.qos, w.retain, props); err != nil {
+			return err
+		}
+	}
+
+	// Set callbacks for the events requested, and the events the client needs
+	b.setCallbacks(c, cfg.callbacks())
+
+	// Set log callback, for log events, trace and the logger
+	if cfg.trace != nil || cfg.logger != nil || cfg.events&MOSQ_FLAG_EVENT_LOG != 0 {
+		b.client.SetLogCallback(func(level mqtt.Level, message string) {
+			if cfg.trace != nil {
+				cfg.trace(message)
+			}
+			c.onLog(Level(level), message)
+		})
+	}
+
+	// Return success
+	return nil
+}
+
+// Encode properties for a request, which returns an error if properties
+// are set and the protocol is not MQTT v5
+func (b *goBackend) properties(p Properties) (mqtt.Properties, error) {
+	if b.v5 {
+		return encodePacketProperties(p)
+	} else if !p.empty() {
+		return nil, ErrBadParameter.With("Properties require MQTT v5")
+	} else {
+		return nil, nil
+	}
+}
+
+// Set the callbacks, which are called from the loop
+func (b *goBackend) setCallbacks(c *Client, events Flags) {
+	if events&MOSQ_FLAG_EVENT_CONNECT != 0 {
+		b.client.SetConnectCallback(func(rc mqtt.ReasonCode, flags int, props mqtt.Properties) {
+			var err error
+			if rc.Failed() {
+				err = rc
+			}
+			c.onConnect(err, int(rc), flags, decodePacketProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_DISCONNECT != 0 {
+		b.client.SetDisconnectCallback(func(err error, props mqtt.Properties) {
+			rc := 0
+			if reason, ok := err.(mqtt.ReasonCode); ok {
+				rc = int(reason)
+			}
+			c.onDisconnect(err, rc, decodePacketProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_SUBSCRIBE != 0 {
+		b.client.SetSubscribeCallback(func(id int, qos []int, props mqtt.Properties) {
+			c.onSubscribe(id, qos, decodePacketProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_UNSUBSCRIBE != 0 {
+		b.client.SetUnsubscribeCallback(func(id int, props mqtt.Properties) {
+			c.onUnsubscribe(id, decodePacketProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_PUBLISH != 0 {
+		b.client.SetPublishCallback(func(id int, rc mqtt.ReasonCode, props mqtt.Properties) {
+			var err error
+			if rc.Failed() {
+				err = rc
+			}
+			c.onPublish(id, err, int(rc), decodePacketProperties(props))
+		})
+	}
+	if events&MOSQ_FLAG_EVENT_MESSAGE != 0 {
+		b.client.SetMessageCallback(func(message *mqtt.Packet) {
+			c.onMessage(int(message.Id), message.Topic, message.Payload, message.QoS, message.Retain, message.Dup, decodePacketProperties(message.Properties))
+		})
+	}
+}
+
+// Return a TLS configuration, or nil if TLS is not used. When verify is
+// false, the certificate chain is verified but not the broker host name,
+// which is the same as libmosquitto
+func newTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.capath == "" && !cfg.oscerts {
+		if cfg.tlsversion != "" || cfg.insecure {
+			return nil, ErrBadParameter.With("TLS options require certificates")
+		}
+		return nil, nil
+	}
+	config := new(tls.Config)
+
+	// Set certificate authorities, in addition to those of the operating
+	// system when oscerts is set
+	if cfg.capath != "" {
+		pool := x509.NewCertPool()
+		if cfg.oscerts {
+			if system, err := x509.SystemCertPool(); err == nil {
+				pool = system
+			}
+		}
+		if err := appendCerts(pool, cfg.capath); err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	// Set client certificate
+	if cfg.certpath != "" {
+		if cert, err := loadKeyPair(cfg.certpath, cfg.keypath); err != nil {
+			return nil, err
+		} else {
+			config.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	// Verify the certificate chain without the host name
+	if cfg.insecure {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyChain(config.RootCAs)
+	}
+
+	// Set the minimum TLS version, and ALPN
+	switch cfg.tlsversion {
+	case "":
+		break
+	case "tlsv1.3":
+		config.MinVersion = tls.VersionTLS13
+	case "tlsv1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "tlsv1.1":
+		config.MinVersion = tls.VersionTLS11
+	default:
+		return nil, ErrBadParameter.Withf("Unsupported TLS version %q", cfg.tlsversion)
+	}
+	if cfg.alpn != "" {
+		config.NextProtos = []string{cfg.alpn}
+	}
+
+	// Return success
+	return config, nil
+}
+
+// Append PEM certificates from a file, or from all files in a directory
+func appendCerts(pool *x509.CertPool, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*")); err != nil {
+			return err
+		}
+	}
+	n := 0
+	for _, file := range files {
+		if data, err := ioutil.ReadFile(file); err != nil {
+			return err
+		} else if pool.AppendCertsFromPEM(data) {
+			n++
+		}
+	}
+	if n == 0 {
+		return ErrBadParameter.Withf("No certificates in %q", path)
+	}
+
+	// Return success
+	return nil
+}
+
+// Load a client certificate and key. Encrypted keys are refused, as legacy
+// PEM encryption is insecure and PKCS#8 encryption is not supported
+func loadKeyPair(certpath, keypath string) (tls.Certificate, error) {
+	cert, err := ioutil.ReadFile(certpath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if block, _ := pem.Decode(key); block == nil {
+		return tls.Certificate{}, ErrBadParameter.Withf("No key in %q", keypath)
+	} else if block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		return tls.Certificate{}, ErrNotImplemented.Withf("Encrypted key %q requires the libmosquitto backend", keypath)
+	}
+	return tls.X509KeyPair(cert, key)
+}
+
+// Return a function which verifies a certificate chain against the
+// certificate authorities, without checking the host name
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return ErrUnexpectedResponse.With("No broker certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i := range raw {
+			if cert, err := x509.ParseCertificate(raw[i]); err != nil {
+				return err
+			} else {
+				certs[i] = cert
+			}
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// Decode properties received from the broker
+func decodePacketProperties(props mqtt.Properties) Properties {
+	var p Properties
+	if v, ok := props.GetString(mqtt.MQTT_PROP_CONTENT_TYPE); ok {
+		p.ContentType = v
+	}
+	if v, ok := props.GetString(mqtt.MQTT_PROP_RESPONSE_TOPIC); ok {
+		p.ResponseTopic = v
+	}
+	if v, ok := props.GetBinary(mqtt.MQTT_PROP_CORRELATION_DATA); ok {
+		p.CorrelationData = v
+	}
+	if v, ok := props.GetInt32(mqtt.MQTT_PROP_MESSAGE_EXPIRY_INTERVAL); ok {
+		p.MessageExpiry = time.Duration(v) * time.Second
+	}
+	if v, ok := props.GetByte(mqtt.MQTT_PROP_PAYLOAD_FORMAT_INDICATOR); ok {
+		p.PayloadFormat = int(v)
+	}
+	for _, v := range props.GetVarints(mqtt.MQTT_PROP_SUBSCRIPTION_IDENTIFIER) {
+		p.SubscriptionIds = append(p.SubscriptionIds, int(v))
+	}
+	if v, ok := props.GetString(mqtt.MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER); ok {
+		p.AssignedClientId = v
+	}
+	if v, ok := props.GetInt32(mqtt.MQTT_PROP_SESSION_EXPIRY_INTERVAL); ok {
+		p.SessionExpiry = time.Duration(v) * time.Second
+	}
+	if v, ok := props.GetInt16(mqtt.MQTT_PROP_SERVER_KEEP_ALIVE); ok {
+		p.ServerKeepAlive = time.Duration(v) * time.Second
+	}
+	if v, ok := props.GetString(mqtt.MQTT_PROP_REASON_STRING); ok {
+		p.ReasonString = v
+	}
+	if v, ok := props.GetString(mqtt.MQTT_PROP_SERVER_REFERENCE); ok {
+		p.ServerReference = v
+	}
+	for _, pair := range props.GetStringPairs(mqtt.MQTT_PROP_USER_PROPERTY) {
+		p.UserProperties = append(p.UserProperties, UserProperty{pair[0], pair[1]})
+	}
+	return p
+}
+
+// Encode properties to send to the broker, or return nil if there are
+// no properties to send
+func encodePacketProperties(p Properties) (mqtt.Properties, error) {
+	var props mqtt.Properties
+	if p.empty() {
+		return nil, nil
+	}
+	if p.PayloadFormat != 0 {
+		if err := props.AddByte(mqtt.MQTT_PROP_PAYLOAD_FORMAT_INDICATOR, uint8(p.PayloadFormat)); err != nil {
+			return nil, err
+		}
+	}
+	if p.MessageExpiry > 0 {
+		if err := props.AddInt32(mqtt.MQTT_PROP_MESSAGE_EXPIRY_INTERVAL, uint32(p.MessageExpiry.Seconds())); err != nil {
+			return nil, err
+		}
+	}
+	if p.ContentType != "" {
+		if err := props.AddString(mqtt.MQTT_PROP_CONTENT_TYPE, p.ContentType); err != nil {
+			return nil, err
+		}
+	}
+	if p.ResponseTopic != "" {
+		if err := props.AddString(mqtt.MQTT_PROP_RESPONSE_TOPIC, p.ResponseTopic); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.CorrelationData) > 0 {
+		if err := props.AddBinary(mqtt.MQTT_PROP_CORRELATION_DATA, p.CorrelationData); err != nil {
+			return nil, err
+		}
+	}
+	if p.SessionExpiry > 0 {
+		if err := props.AddInt32(mqtt.MQTT_PROP_SESSION_EXPIRY_INTERVAL, uint32(p.SessionExpiry.Seconds())); err != nil {
+			return nil, err
+		}
+	}
+	if p.WillDelay > 0 {
+		if err := props.AddInt32(mqtt.MQTT_PROP_WILL_DELAY_INTERVAL, uint32(p.WillDelay.Seconds())); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range p.SubscriptionIds {
+		if err := props.AddVarint(mqtt.MQTT_PROP_SUBSCRIPTION_IDENTIFIER, uint32(id)); err != nil {
+			return nil, err
+		}
+	}
+	for _, prop := range p.UserProperties {
+		if err := props.AddStringPair(mqtt.MQTT_PROP_USER_PROPERTY, prop.Name, prop.Value); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
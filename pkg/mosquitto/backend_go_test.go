@@ -0,0 +1,37 @@
+package mosquitto
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_KeyPair_001(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mosquitto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Encrypted keys are refused, in PKCS#8 and legacy PEM forms
+	cert := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	blocks := []*pem.Block{
+		{Type: "ENCRYPTED PRIVATE KEY", Bytes: []byte("key")},
+		{Type: "RSA PRIVATE KEY", Headers: map[string]string{"Proc-Type": "4,ENCRYPTED", "DEK-Info": "AES-128-CBC,00000000000000000000000000000000"}, Bytes: []byte("key")},
+	}
+	for _, block := range blocks {
+		key := filepath.Join(dir, "key.pem")
+		if err := ioutil.WriteFile(key, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadKeyPair(cert, key); err == nil || !strings.Contains(err.Error(), "libmosquitto") {
+			t.Error("Expected error for encrypted key", block.Type, err)
+		}
+	}
+}
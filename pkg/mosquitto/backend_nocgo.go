@@ -0,0 +1,23 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package mosquitto
+
+import (
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	hasMosquitto = false
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newMosquittoBackend(c *Client, cfg Config) (backend, error) {
+	return nil, ErrNotImplemented.With("libmosquitto requires cgo")
+}
@@ -4,9 +4,9 @@ import (
 	"net"
 	"strconv"
 	"time"
-	// Packages
+
 	// Namespace imports
-	//. "github.com/djthorpe/go-errors"
+	. "github.com/mutablelogic/go-mosquitto"
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -14,12 +14,32 @@ import (
 
 type Config struct {
 	// Broker
-	clientId string
-	host     string
-	port     uint
+	clientId   string
+	host       string
+	port       uint
+	protocol   int
+	persistent bool
+
+	// Brokers to fail over to, when more than one
+	brokers []broker
 
 	// Timeouts
 	keepalive time.Duration
+	reconnect reconnect
+
+	// Default QoS for publish and subscribe
+	qos int
+
+	// Implementation of the protocol, and the network loop, which is a
+	// goroutine for each client by default
+	backend Backend
+	loop    loop
+
+	// Network options
+	bindaddress string
+	nodelay     bool
+	recvmax     int
+	sendmax     int
 
 	// Credentials
 	user     string
@@ -29,19 +49,76 @@ type Config struct {
 	capath     string
 	certpath   string
 	keypath    string
-	certverify bool
+	insecure   bool
+	tlsversion string
+	ciphers    string
+	alpn       string
+	ocsp       bool
+	keyform    string
+	engine     string
+	keypass    func() (string, error)
+	oscerts    bool
+
+	// TLS pre-shared key
+	psk         string
+	pskidentity string
+
+	// Will message
+	will *will
 
-	// Callbacks
-	fn    EventFunc
-	trace TraceFunc
+	// Callbacks, and the events passed to the callback
+	fn     EventFunc
+	trace  TraceFunc
+	events Flags
+
+	// Logger for structured records, and the minimum level logged
+	logger   Logger
+	minlevel Level
+
+	// Queue of messages, when received from a channel
+	queue *QueueConfig
+}
+
+type will struct {
+	topic   string
+	payload []byte
+	qos     int
+	retain  bool
+	props   Properties
+	v5      bool
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+// MQTT protocol versions
+const (
+	MQTT_PROTOCOL_V31  = 3
+	MQTT_PROTOCOL_V311 = 4
+	MQTT_PROTOCOL_V5   = 5
+)
+
+const (
+	// Events which the client needs from the library, whichever events are
+	// passed to the callback. Connect and disconnect change the state of the
+	// client, subscribe and publish acknowledge requests which wait and
+	// update the counters, and messages are passed to handlers, which can be
+	// added at any time, to the queue and to the counters
+	internalEvents = MOSQ_FLAG_EVENT_CONNECT | MOSQ_FLAG_EVENT_DISCONNECT | MOSQ_FLAG_EVENT_SUBSCRIBE | MOSQ_FLAG_EVENT_PUBLISH | MOSQ_FLAG_EVENT_MESSAGE
+)
+
 ////////////////////////////////////////////////////////////////////////////////
 // GLOBALS
 
 var (
 	defaultConfig = Config{
+		events:    MOSQ_FLAG_EVENT_ALL,
 		keepalive: 60 * time.Second,
+		protocol:  MQTT_PROTOCOL_V311,
+		reconnect: reconnect{
+			initial: time.Second,
+			max:     time.Second,
+		},
 	}
 )
 
@@ -58,6 +135,13 @@ func (c Config) WithClientId(v string) Config {
 	return c
 }
 
+// WithPersistentSession asks the broker to keep subscriptions and queued
+// messages when the client disconnects. A client id is required
+func (c Config) WithPersistentSession() Config {
+	c.persistent = true
+	return c
+}
+
 func (c Config) WithCredentials(user, password string) Config {
 	c.user = user
 	c.password = password
@@ -68,7 +152,85 @@ func (c Config) WithTLS(capath, certpath, keypath string, verify bool) Config {
 	c.capath = capath
 	c.certpath = certpath
 	c.keypath = keypath
-	c.certverify = verify
+	c.insecure = !verify
+	return c
+}
+
+// WithTLSOpts sets the TLS version, which is one of "tlsv1.3", "tlsv1.2" or
+// "tlsv1.1", and the OpenSSL cipher list. Empty values use the defaults
+func (c Config) WithTLSOpts(version, ciphers string) Config {
+	c.tlsversion = version
+	c.ciphers = ciphers
+	return c
+}
+
+// WithPSK uses a hex encoded pre-shared key and identity for TLS
+// instead of certificates
+func (c Config) WithPSK(psk, identity string) Config {
+	c.psk = psk
+	c.pskidentity = identity
+	return c
+}
+
+// WithALPN sets the application layer protocol negotiation value
+func (c Config) WithALPN(v string) Config {
+	c.alpn = v
+	return c
+}
+
+// WithOCSP requires the broker to provide an OCSP stapled certificate status
+func (c Config) WithOCSP(v bool) Config {
+	c.ocsp = v
+	return c
+}
+
+// WithKeyform sets the format of the client key, which is "pem" or "engine"
+// and the OpenSSL engine to use, which can be empty
+func (c Config) WithKeyform(keyform, engine string) Config {
+	c.keyform = keyform
+	c.engine = engine
+	return c
+}
+
+// WithKeyPassword sets a function which returns the password for an
+// encrypted client key. Encrypted keys are only supported by the libmosquitto
+// backend, and the Go backend returns an error for an encrypted key
+func (c Config) WithKeyPassword(fn func() (string, error)) Config {
+	c.keypass = fn
+	return c
+}
+
+// WithOSCerts uses the certificate authorities of the operating system
+// to verify the broker, instead of or in addition to WithTLS
+func (c Config) WithOSCerts(v bool) Config {
+	c.oscerts = v
+	return c
+}
+
+// WithBindAddress sets the local network address to connect from
+func (c Config) WithBindAddress(v string) Config {
+	c.bindaddress = v
+	return c
+}
+
+// WithTCPNoDelay disables Nagle's algorithm on the connection, which
+// reduces latency for small messages
+func (c Config) WithTCPNoDelay(v bool) Config {
+	c.nodelay = v
+	return c
+}
+
+// WithReceiveMaximum sets the number of QoS 1 and 2 messages which can be
+// received from the broker at once (MQTT v5 only). Zero uses the default
+func (c Config) WithReceiveMaximum(v int) Config {
+	c.recvmax = v
+	return c
+}
+
+// WithSendMaximum sets the number of QoS 1 and 2 messages which can be
+// sent to the broker at once. Zero uses the default
+func (c Config) WithSendMaximum(v int) Config {
+	c.sendmax = v
 	return c
 }
 
@@ -90,6 +252,88 @@ func (c Config) WithHost(v string) Config {
 	return c
 }
 
+// WithBrokers sets several brokers as host:port or just host. The client
+// connects to the first broker, and when the connection is lost rotates
+// through the brokers, preferring those which have failed least recently
+func (c Config) WithBrokers(hosts ...string) Config {
+	c.brokers = make([]broker, 0, len(hosts))
+	for _, host := range hosts {
+		h := c.WithHost(host)
+		c.brokers = append(c.brokers, broker{h.host, h.port})
+	}
+	if len(c.brokers) > 0 {
+		c.host, c.port = c.brokers[0].host, c.brokers[0].port
+	}
+	return c
+}
+
+// WithReconnect sets the delay between attempts to reconnect. When max is
+// greater than initial, the delay increases linearly or exponentially on
+// each attempt up to max. A random delay of up to jitter is added to each
+// attempt. The initial delay is at least 100ms. With WithLoopThread the
+// library reconnects in whole seconds, and jitter is not supported
+func (c Config) WithReconnect(initial, max time.Duration, exponential bool, jitter time.Duration) Config {
+	c.reconnect = reconnect{initial, max, exponential, jitter}
+	return c
+}
+
+// WithBackend sets the implementation of the protocol. BackendGo does not
+// require cgo, but does not support pre-shared keys, OpenSSL options,
+// WithLoopThread or WithPoller
+func (c Config) WithBackend(v Backend) Config {
+	c.backend = v
+	return c
+}
+
+// WithLoopThread runs the network loop in a thread started by the library,
+// rather than a goroutine. The library reconnects to the same broker when
+// the connection is lost, in whole seconds without jitter, so more than one
+// broker or a reconnect jitter is refused by NewWithConfig
+func (c Config) WithLoopThread() Config {
+	c.loop = threadLoop{}
+	return c
+}
+
+// WithPoller runs the network loop in a poller, which can be shared by
+// many clients. The poller needs to be closed after the clients
+func (c Config) WithPoller(p *Poller) Config {
+	if p != nil {
+		c.loop = p
+	} else {
+		c.loop = nil
+	}
+	return c
+}
+
+// WithQoS sets the default QoS for publish and subscribe, which can be
+// overridden with OptQoS on each request
+func (c Config) WithQoS(qos int) Config {
+	c.qos = qos
+	return c
+}
+
+// WithProtocol sets the MQTT protocol version, which is one of
+// MQTT_PROTOCOL_V31, MQTT_PROTOCOL_V311 or MQTT_PROTOCOL_V5
+func (c Config) WithProtocol(v int) Config {
+	c.protocol = v
+	return c
+}
+
+// WithWill sets a message which the broker publishes when the client
+// disconnects unexpectedly
+func (c Config) WithWill(topic string, payload []byte, qos int, retain bool) Config {
+	c.will = &will{topic, payload, qos, retain, Properties{}, false}
+	return c
+}
+
+// WithWillV5 sets a message which the broker publishes when the client
+// disconnects unexpectedly, with will properties such as WillDelay. The
+// protocol needs to be set to MQTT_PROTOCOL_V5
+func (c Config) WithWillV5(topic string, payload []byte, qos int, retain bool, props Properties) Config {
+	c.will = &will{topic, payload, qos, retain, props, true}
+	return c
+}
+
 func (c Config) WithKeepalive(d time.Duration) Config {
 	c.keepalive = d
 	return c
@@ -100,7 +344,67 @@ func (c Config) WithCallback(fn EventFunc) Config {
 	return c
 }
 
+// WithEvents sets the events passed to the callback, which are all events
+// except MOSQ_FLAG_EVENT_LOG by default. The connect, disconnect, subscribe,
+// publish and message callbacks of the library are always installed, as the
+// client uses them. The unsubscribe callback is only installed when
+// MOSQ_FLAG_EVENT_UNSUBSCRIBE is set, and the log callback only when
+// MOSQ_FLAG_EVENT_LOG is set, or a trace function or logger is set
+func (c Config) WithEvents(v Flags) Config {
+	c.events = v
+	return c
+}
+
 func (c Config) WithTrace(fn TraceFunc) Config {
 	c.trace = fn
 	return c
 }
+
+// WithLogger sets a logger which receives log lines of the library, and
+// records of connection, subscribe and publish operations, at or above a
+// minimum level. MOSQ_LOG_DEBUG logs everything, and a nil logger turns
+// logging off
+func (c Config) WithLogger(l Logger, min Level) Config {
+	c.logger = l
+	c.minlevel = min
+	return c
+}
+
+// WithQueue puts messages received in a queue, which are then received from
+// the channel returned by Messages. Messages are also passed to handlers
+// and the callback
+func (c Config) WithQueue(q QueueConfig) Config {
+	c.queue = &q
+	return c
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return the events for which callbacks are installed in the library,
+// which are the events passed to the callback and the events the client
+// needs itself
+func (c Config) callbacks() Flags {
+	if c.fn == nil {
+		return internalEvents
+	}
+	return c.events | internalEvents
+}
+
+// Return the brokers to connect to, with the default port when not set
+func (c Config) brokerList() []broker {
+	port := uint(defaultPort)
+	if c.capath != "" || c.psk != "" || c.oscerts {
+		port = defaultSecurePort
+	}
+	list := append([]broker{}, c.brokers...)
+	if len(list) == 0 {
+		list = append(list, broker{c.host, c.port})
+	}
+	for i := range list {
+		if list[i].port == 0 && !list[i].unix() {
+			list[i].port = port
+		}
+	}
+	return list
+}
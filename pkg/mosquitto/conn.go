@@ -0,0 +1,74 @@
+package mosquitto
+
+import (
+	"context"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Conn is a connection to a broker, which is implemented by Client, and by
+// Fake for tests which do not need a broker
+type Conn interface {
+	// Subscribe to a topic, and return the id of the request
+	Subscribe(topics string, opts ...ClientOpt) (int, error)
+
+	// SubscribeMany subscribes to many topics, each with a QoS, and returns
+	// the ids of the requests
+	SubscribeMany(topics map[string]int, opts ...ClientOpt) ([]int, error)
+
+	// Unsubscribe from a topic, and return the id of the request
+	Unsubscribe(topics string, opts ...ClientOpt) (int, error)
+
+	// Publish data to a topic, and return the id of the request
+	Publish(topic string, data []byte, opts ...ClientOpt) (int, error)
+
+	// PublishJSON publishes data encoded as JSON to a topic, and returns the
+	// id of the request
+	PublishJSON(topic string, data interface{}, opts ...ClientOpt) (int, error)
+
+	// State returns the current state of the connection, and Since the time
+	// the state was entered
+	State() State
+	Since() time.Time
+
+	// Messages returns a channel which receives messages, when the
+	// configuration has a queue, or nil otherwise
+	Messages() <-chan *Event
+
+	// Stats returns a snapshot of the counters of the connection
+	Stats() Stats
+
+	// Version returns the version of the client library
+	Version() string
+
+	// Close the connection
+	Close() error
+}
+
+// ConnectFunc connects to a broker with a configuration, and returns when
+// the broker acknowledges the connection. Connect connects with a Client,
+// and Fake.Connect returns a fake connection
+type ConnectFunc func(ctx context.Context, cfg Config) (Conn, error)
+
+////////////////////////////////////////////////////////////////////////////////
+// GLOBALS
+
+var (
+	_ Conn        = (*Client)(nil)
+	_ ConnectFunc = Connect
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// Connect returns a client connection to a broker with a configuration,
+// as NewWithConfig
+func Connect(ctx context.Context, cfg Config) (Conn, error) {
+	if client, err := NewWithConfig(ctx, cfg); err != nil {
+		return nil, err
+	} else {
+		return client, nil
+	}
+}
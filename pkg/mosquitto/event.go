@@ -2,6 +2,7 @@ package mosquitto
 
 import (
 	"fmt"
+	"time"
 
 	// Namespace imports
 	. "github.com/mutablelogic/go-mosquitto"
@@ -11,60 +12,110 @@ import (
 // TYPES
 
 type Event struct {
-	Type  Flags
-	Err   error
-	Id    int
-	Topic string
-	Data  []byte
+	Type       Flags
+	Err        error
+	Id         int
+	Topic      string
+	Data       []byte
+	QoS        int       // QoS of a message
+	Retain     bool      // Message is retained by the broker
+	Duplicate  bool      // Message may have been received before
+	ReceivedAt time.Time // Time the event was received from the library
+	Topics     []string  // Topics of a subscribe or unsubscribe request
+	GrantedQoS []int     // QoS granted for each topic of a subscribe request
+	ReasonCode int       // MQTT v5 reason code
+	Broker     string    // Broker of a connect or disconnect event, as host:port
+	Level      Level     // Level of a log event, with the log message as data
+	Properties           // MQTT v5 properties
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+// The granted QoS when the broker rejects a subscription. With MQTT v5, any
+// reason code of this value or above is a rejection
+const (
+	MQTT_SUBACK_FAILURE = 0x80
+)
+
 ////////////////////////////////////////////////////////////////////////////////
 // NEW MESSAGES
 
 func NewConnect(err error) *Event {
 	return &Event{
-		Type: MOSQ_FLAG_EVENT_CONNECT,
-		Err:  err,
+		Type:       MOSQ_FLAG_EVENT_CONNECT,
+		ReceivedAt: time.Now(),
+		Err:        err,
 	}
 }
 
 func NewDisconnect(err error) *Event {
 	return &Event{
-		Type: MOSQ_FLAG_EVENT_DISCONNECT,
-		Err:  err,
+		Type:       MOSQ_FLAG_EVENT_DISCONNECT,
+		ReceivedAt: time.Now(),
+		Err:        err,
 	}
 }
 
 func NewSubscribe(id int) *Event {
 	return &Event{
-		Type: MOSQ_FLAG_EVENT_SUBSCRIBE,
-		Id:   id,
+		Type:       MOSQ_FLAG_EVENT_SUBSCRIBE,
+		ReceivedAt: time.Now(),
+		Id:         id,
 	}
 }
 
 func NewUnsubscribe(id int) *Event {
 	return &Event{
-		Type: MOSQ_FLAG_EVENT_UNSUBSCRIBE,
-		Id:   id,
+		Type:       MOSQ_FLAG_EVENT_UNSUBSCRIBE,
+		ReceivedAt: time.Now(),
+		Id:         id,
 	}
 }
 
 func NewPublish(id int) *Event {
 	return &Event{
-		Type: MOSQ_FLAG_EVENT_PUBLISH,
-		Id:   id,
+		Type:       MOSQ_FLAG_EVENT_PUBLISH,
+		ReceivedAt: time.Now(),
+		Id:         id,
 	}
 }
 
 func NewMessage(id int, topic string, data []byte) *Event {
 	return &Event{
-		Type:  MOSQ_FLAG_EVENT_MESSAGE,
-		Id:    id,
-		Topic: topic,
-		Data:  data[:],
+		Type:       MOSQ_FLAG_EVENT_MESSAGE,
+		ReceivedAt: time.Now(),
+		Id:         id,
+		Topic:      topic,
+		Data:       data[:],
+	}
+}
+
+func NewLog(level Level, message string) *Event {
+	return &Event{
+		Type:       MOSQ_FLAG_EVENT_LOG,
+		ReceivedAt: time.Now(),
+		Level:      level,
+		Data:       []byte(message),
 	}
 }
 
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Granted returns the QoS granted by the broker for each topic of a subscribe
+// request, which is lower than requested when downgraded, or a reason code
+// of MQTT_SUBACK_FAILURE or above when the subscription was rejected
+func (e *Event) Granted() map[string]int {
+	result := make(map[string]int, len(e.Topics))
+	for i, topic := range e.Topics {
+		if i < len(e.GrantedQoS) {
+			result[topic] = e.GrantedQoS[i]
+		}
+	}
+	return result
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // STRINGIFY
 
@@ -85,5 +136,30 @@ func (e *Event) String() string {
 	if data := e.Data; len(data) > 0 {
 		str += fmt.Sprintf(" data=%q", string(data))
 	}
+	if qos := e.QoS; qos != 0 {
+		str += fmt.Sprint(" qos=", qos)
+	}
+	if e.Retain {
+		str += " retain"
+	}
+	if e.Duplicate {
+		str += " duplicate"
+	}
+	if topics := e.Topics; len(topics) > 0 {
+		str += fmt.Sprintf(" topics=%q", topics)
+	}
+	if qos := e.GrantedQoS; len(qos) > 0 {
+		str += fmt.Sprint(" granted_qos=", qos)
+	}
+	if rc := e.ReasonCode; rc != 0 {
+		str += fmt.Sprint(" reason_code=", rc)
+	}
+	if broker := e.Broker; broker != "" {
+		str += fmt.Sprintf(" broker=%q", broker)
+	}
+	if level := e.Level; level != MOSQ_LOG_NONE {
+		str += fmt.Sprint(" level=", level)
+	}
+	str += e.Properties.String()
 	return str + ">"
 }
@@ -0,0 +1,469 @@
+package mosquitto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+	. "github.com/mutablelogic/go-mosquitto"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Fake is a connection which does not need a broker, for tests. It records
+// published messages and subscriptions, and acknowledges requests either
+// at once or when Ack is called. Tests inject messages and connection
+// events, which are passed to the callback of the configuration
+type Fake struct {
+	sync.Mutex
+	state         *state
+	fn            EventFunc
+	events        Flags
+	broker        string
+	defaults      opts
+	subscriptions *subscriptions
+	metrics       *metrics
+	queue         *Queue
+	published     []FakeMessage
+	pending       map[int]*Event
+	next          int
+	manual        bool
+	err           error
+}
+
+// FakeMessage is a message published to a fake connection
+type FakeMessage struct {
+	Id         int
+	Topic      string
+	Data       []byte
+	QoS        int
+	Retain     bool
+	Properties // MQTT v5 properties
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	fakeVersion = "fake"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// GLOBALS
+
+var (
+	_ Conn        = (*Fake)(nil)
+	_ ConnectFunc = (*Fake)(nil).Connect
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewFake returns a fake connection, which is connected with Connect
+func NewFake() *Fake {
+	return &Fake{
+		state:         newState(),
+		defaults:      defaultOpts,
+		subscriptions: newSubscriptions(),
+		metrics:       newMetrics(),
+		pending:       make(map[int]*Event),
+	}
+}
+
+// Connect is a ConnectFunc which uses the callback and QoS of the
+// configuration, and sends a connect event. It returns the error set with
+// SetError instead, to simulate a failed connection
+func (f *Fake) Connect(ctx context.Context, cfg Config) (Conn, error) {
+	f.Lock()
+	if err := f.err; err != nil {
+		f.Unlock()
+		return nil, err
+	} else if err := ctx.Err(); err != nil {
+		f.Unlock()
+		return nil, err
+	}
+	if cfg.queue != nil && f.queue == nil {
+		if queue, err := NewQueue(*cfg.queue); err != nil {
+			f.Unlock()
+			return nil, err
+		} else {
+			f.queue = queue
+		}
+	}
+	f.fn = cfg.fn
+	f.events = cfg.events
+	f.defaults.qos = cfg.qos
+	f.broker = cfg.brokerList()[0].String()
+	f.Unlock()
+
+	// Send the connect event, and return success
+	f.InjectConnect(nil)
+	return f, nil
+}
+
+// Close the connection. Requests waiting for acknowledgement are not
+// acknowledged
+func (f *Fake) Close() error {
+	if !f.state.set(StateClosed, nil) {
+		return ErrOutOfOrder.With("Client is closed")
+	}
+	f.Lock()
+	defer f.Unlock()
+	f.pending = make(map[int]*Event)
+	f.metrics.reset()
+	if f.queue != nil {
+		return f.queue.Close()
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+// Version returns a fake version
+func (f *Fake) Version() string {
+	return fakeVersion
+}
+
+func (f *Fake) String() string {
+	f.Lock()
+	defer f.Unlock()
+	str := "<fake"
+	str += fmt.Sprint(" state=", f.State())
+	if f.broker != "" {
+		str += fmt.Sprintf(" broker=%q", f.broker)
+	}
+	if n := len(f.published); n > 0 {
+		str += fmt.Sprint(" published=", n)
+	}
+	if n := len(f.pending); n > 0 {
+		str += fmt.Sprint(" pending=", n)
+	}
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS - CONN
+
+func (f *Fake) Subscribe(topics string, opts ...ClientOpt) (int, error) {
+	if err := validateSubscribe(topics); err != nil {
+		return 0, err
+	}
+	return f.subscribe([]string{topics}, f.opts(opts))
+}
+
+// SubscribeMany subscribes to many topics, with one request for each QoS
+func (f *Fake) SubscribeMany(topics map[string]int, opts ...ClientOpt) ([]int, error) {
+	// Group the topics by QoS
+	groups := make(map[int][]string)
+	for topic, qos := range topics {
+		if err := validateSubscribe(topic); err != nil {
+			return nil, err
+		}
+		groups[qos] = append(groups[qos], topic)
+	}
+	if len(groups) == 0 {
+		return nil, ErrBadParameter.With("No topics")
+	}
+
+	// Perform the subscribes in order of QoS
+	v := f.opts(opts)
+	qos := make([]int, 0, len(groups))
+	for k := range groups {
+		qos = append(qos, k)
+	}
+	sort.Ints(qos)
+	result := make([]int, 0, len(qos))
+	for _, k := range qos {
+		sort.Strings(groups[k])
+		v.qos = k
+		if id, err := f.subscribe(groups[k], v); err != nil {
+			return result, err
+		} else {
+			result = append(result, id)
+		}
+	}
+
+	// Return success
+	return result, nil
+}
+
+func (f *Fake) Unsubscribe(topics string, opts ...ClientOpt) (int, error) {
+	if err := validateSubscribe(topics); err != nil {
+		return 0, err
+	}
+	id, err := f.request(withGranted(NewUnsubscribe(0), []string{topics}, nil))
+	if err != nil {
+		return 0, err
+	}
+	f.subscriptions.remove([]string{topics})
+	f.acknowledge(id)
+	return id, nil
+}
+
+// Publish records a message, which is returned by Published
+func (f *Fake) Publish(topic string, data []byte, opts ...ClientOpt) (int, error) {
+	if err := validatePublish(topic); err != nil {
+		return 0, err
+	}
+	v := f.opts(opts)
+	id, err := f.request(NewPublish(0))
+	if err != nil {
+		return 0, err
+	}
+	f.Lock()
+	f.published = append(f.published, FakeMessage{
+		Id:         id,
+		Topic:      topic,
+		Data:       append([]byte{}, data...),
+		QoS:        v.qos,
+		Retain:     v.retain,
+		Properties: v.props,
+	})
+	f.Unlock()
+	f.metrics.sent(id, v.qos, len(data), time.Now())
+	f.acknowledge(id)
+	return id, nil
+}
+
+func (f *Fake) PublishJSON(topic string, data interface{}, opts ...ClientOpt) (int, error) {
+	if json, err := json.Marshal(data); err != nil {
+		return 0, err
+	} else {
+		return f.Publish(topic, json, opts...)
+	}
+}
+
+// State returns the current state of the fake connection
+func (f *Fake) State() State {
+	state, _ := f.state.get()
+	return state
+}
+
+// Since returns the time the current state was entered
+func (f *Fake) Since() time.Time {
+	_, since := f.state.get()
+	return since
+}
+
+// Stats returns the counters of messages published and injected
+func (f *Fake) Stats() Stats {
+	stats := f.metrics.get()
+	stats.Dropped += f.state.drops()
+	if queue := f.getQueue(); queue != nil {
+		stats.Dropped += queue.Dropped()
+	}
+	return stats
+}
+
+// Messages returns a channel which receives injected messages, when the
+// configuration has a queue, or nil otherwise
+func (f *Fake) Messages() <-chan *Event {
+	if queue := f.getQueue(); queue != nil {
+		return queue.C()
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS - TESTS
+
+// Subscriptions returns the topics subscribed to, in order of topic
+func (f *Fake) Subscriptions() []Subscription {
+	return f.subscriptions.list()
+}
+
+// Published returns the messages published, in order
+func (f *Fake) Published() []FakeMessage {
+	f.Lock()
+	defer f.Unlock()
+	return append([]FakeMessage{}, f.published...)
+}
+
+// Reset forgets the messages published
+func (f *Fake) Reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.published = nil
+}
+
+// SetError sets the error returned by Connect and by subsequent requests,
+// to simulate a failure to send. A nil error clears the failure
+func (f *Fake) SetError(err error) {
+	f.Lock()
+	defer f.Unlock()
+	f.err = err
+}
+
+// SetManualAck sets whether requests are acknowledged when Ack is called,
+// rather than before the request returns
+func (f *Fake) SetManualAck(v bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.manual = v
+}
+
+// Pending returns the ids of requests waiting for acknowledgement, in order
+func (f *Fake) Pending() []int {
+	f.Lock()
+	defer f.Unlock()
+	result := make([]int, 0, len(f.pending))
+	for id := range f.pending {
+		result = append(result, id)
+	}
+	sort.Ints(result)
+	return result
+}
+
+// Ack acknowledges a request waiting for acknowledgement. When err is not
+// nil, the request fails: a publish event carries the error, and the
+// subscriptions of a subscribe request are refused
+func (f *Fake) Ack(id int, err error) error {
+	f.Lock()
+	evt, exists := f.pending[id]
+	delete(f.pending, id)
+	f.Unlock()
+	if !exists {
+		return ErrNotFound.Withf("Ack: %v", id)
+	}
+	if err != nil {
+		switch evt.Type {
+		case MOSQ_FLAG_EVENT_SUBSCRIBE:
+			for i := range evt.GrantedQoS {
+				evt.GrantedQoS[i] = MQTT_SUBACK_FAILURE
+			}
+			f.subscriptions.remove(evt.Topics)
+		default:
+			evt.Err = err
+		}
+	}
+	if evt.Type == MOSQ_FLAG_EVENT_PUBLISH {
+		f.metrics.acked(id, err)
+	}
+	f.emit(evt)
+	return nil
+}
+
+// InjectConnect sends a connect event. The state becomes connected, or
+// reconnecting when err is not nil
+func (f *Fake) InjectConnect(err error) {
+	if err == nil {
+		f.metrics.connected()
+		f.state.set(StateConnected, nil)
+	} else {
+		f.state.set(StateReconnecting, err)
+	}
+	evt := NewConnect(err)
+	evt.Broker = f.broker
+	f.emit(evt)
+}
+
+// InjectDisconnect sends a disconnect event, and the state becomes
+// reconnecting
+func (f *Fake) InjectDisconnect(err error) {
+	f.state.set(StateReconnecting, err)
+	evt := NewDisconnect(err)
+	evt.Broker = f.broker
+	f.emit(evt)
+}
+
+// InjectMessage sends a message event, as if received from the broker,
+// whether or not the topic has been subscribed to. The QoS and retain
+// options set the QoS and retain flag of the message
+func (f *Fake) InjectMessage(topic string, data []byte, opts ...ClientOpt) error {
+	if err := validatePublish(topic); err != nil {
+		return err
+	}
+	v := f.opts(opts)
+	f.Lock()
+	f.next++
+	id := f.next
+	f.Unlock()
+	evt := withReason(NewMessage(id, topic, append([]byte{}, data...)), 0, v.props)
+	evt.QoS, evt.Retain = v.qos, v.retain
+	f.metrics.received(v.qos, len(data))
+	f.emit(evt)
+	if queue := f.getQueue(); queue != nil {
+		queue.Put(evt)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return the default options with options applied
+func (f *Fake) opts(opts []ClientOpt) opts {
+	f.Lock()
+	v := f.defaults
+	f.Unlock()
+	for _, opt := range opts {
+		opt(&v)
+	}
+	return v
+}
+
+// Return the queue of messages, if any
+func (f *Fake) getQueue() *Queue {
+	f.Lock()
+	defer f.Unlock()
+	return f.queue
+}
+
+// Record a subscribe request
+func (f *Fake) subscribe(topics []string, v opts) (int, error) {
+	qos := make([]int, len(topics))
+	for i := range qos {
+		qos[i] = v.qos
+	}
+	id, err := f.request(withGranted(NewSubscribe(0), topics, qos))
+	if err != nil {
+		return 0, err
+	}
+	f.subscriptions.add(topics, v.qos, v.options)
+	f.acknowledge(id)
+	return id, nil
+}
+
+// Return an id for a request, and hold the acknowledgement until it is
+// acknowledged. Returns an error if the connection is closed, or the
+// error set with SetError
+func (f *Fake) request(evt *Event) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.State() == StateClosed {
+		return 0, ErrOutOfOrder.With("Client is closed")
+	} else if f.err != nil {
+		return 0, f.err
+	}
+	f.next++
+	evt.Id = f.next
+	f.pending[evt.Id] = evt
+	return evt.Id, nil
+}
+
+// Acknowledge a request unless acknowledgement is manual
+func (f *Fake) acknowledge(id int) {
+	f.Lock()
+	manual := f.manual
+	f.Unlock()
+	if !manual {
+		f.Ack(id, nil)
+	}
+}
+
+// Send an event to the callback, if the type of event was requested
+func (f *Fake) emit(evt *Event) {
+	f.Lock()
+	fn, events := f.fn, f.events
+	f.Unlock()
+	if fn != nil && events&evt.Type != 0 {
+		fn(evt)
+	}
+}
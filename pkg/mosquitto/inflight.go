@@ -0,0 +1,129 @@
+package mosquitto
+
+import (
+	"sync"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// inflight tracks requests which are waiting for acknowledgement from the
+// broker, keyed by message id. As the broker may acknowledge a request
+// before its message id has been returned, acknowledgements which arrive
+// while a request is being sent are kept until the request has a waiter,
+// and the connection may be lost before then
+type inflight struct {
+	sync.Mutex
+	seq     int
+	sending map[int]*request
+	waiters map[int]chan *Event
+	acks    map[int]ack
+}
+
+// request is a request which is being sent, and the error when the
+// connection was lost before the request had a waiter
+type request struct {
+	seq int
+	err error
+}
+
+// ack is an acknowledgement without a waiter, and the sequence of the last
+// request which began before it arrived
+type ack struct {
+	evt *Event
+	seq int
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newInflight() *inflight {
+	return &inflight{
+		sending: make(map[int]*request),
+		waiters: make(map[int]chan *Event),
+		acks:    make(map[int]ack),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// begin is called before a request is sent, and needs to be followed by a
+// call to done with the message id, or zero if the request failed
+func (i *inflight) begin() *request {
+	i.Lock()
+	defer i.Unlock()
+	i.seq++
+	r := &request{seq: i.seq}
+	i.sending[r.seq] = r
+	return r
+}
+
+// wait returns a channel which receives the acknowledgement for the message
+// id of a request. An acknowledgement which arrived before the request began
+// is for an earlier request with the same message id, and is ignored
+func (i *inflight) wait(r *request, id int) <-chan *Event {
+	i.Lock()
+	defer i.Unlock()
+	ch := make(chan *Event, 1)
+	if ack, exists := i.acks[id]; exists && ack.seq >= r.seq {
+		delete(i.acks, id)
+		ch <- ack.evt
+	} else if r.err != nil {
+		evt := NewDisconnect(r.err)
+		evt.Id = id
+		ch <- evt
+	} else {
+		i.waiters[id] = ch
+	}
+	return ch
+}
+
+// done removes the waiter for the message id of a request, and forgets
+// acknowledgements which no request which is being sent can claim
+func (i *inflight) done(r *request, id int) {
+	i.Lock()
+	defer i.Unlock()
+	delete(i.waiters, id)
+	delete(i.sending, r.seq)
+	min := i.seq + 1
+	for seq := range i.sending {
+		if seq < min {
+			min = seq
+		}
+	}
+	for id, ack := range i.acks {
+		if ack.seq < min {
+			delete(i.acks, id)
+		}
+	}
+}
+
+// ack passes an acknowledgement event to the waiter for the message id, or
+// keeps it for a request which is being sent
+func (i *inflight) ack(evt *Event) {
+	i.Lock()
+	defer i.Unlock()
+	if ch, exists := i.waiters[evt.Id]; exists {
+		delete(i.waiters, evt.Id)
+		ch <- evt
+	} else if len(i.sending) > 0 {
+		i.acks[evt.Id] = ack{evt, i.seq}
+	}
+}
+
+// fail passes an event with an error to all waiters, and to requests which
+// are being sent when they wait, when the connection to the broker is lost
+func (i *inflight) fail(err error) {
+	i.Lock()
+	defer i.Unlock()
+	for id, ch := range i.waiters {
+		delete(i.waiters, id)
+		evt := NewDisconnect(err)
+		evt.Id = id
+		ch <- evt
+	}
+	for _, r := range i.sending {
+		r.err = err
+	}
+}
@@ -0,0 +1,74 @@
+package mosquitto
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Return the event received from a channel, or nil if none is received
+func receive(ch <-chan *Event) *Event {
+	select {
+	case evt := <-ch:
+		return evt
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func Test_Inflight_001(t *testing.T) {
+	// The connection is lost after the request is sent and before the
+	// waiter is registered
+	i := newInflight()
+	lost := errors.New("lost")
+	r := i.begin()
+	i.fail(lost)
+	if evt := receive(i.wait(r, 1)); evt == nil || evt.Err != lost || evt.Id != 1 {
+		t.Error("Expected failure, got", evt)
+	}
+	i.done(r, 1)
+
+	// A request which begins after the connection is lost does not fail
+	r = i.begin()
+	if evt := receive(i.wait(r, 2)); evt != nil {
+		t.Error("Unexpected event", evt)
+	}
+	i.done(r, 2)
+}
+
+func Test_Inflight_002(t *testing.T) {
+	// An acknowledgement which arrives before the waiter is registered
+	i := newInflight()
+	r := i.begin()
+	i.ack(NewPublish(1))
+	if evt := receive(i.wait(r, 1)); evt == nil || evt.Id != 1 || evt.Err != nil {
+		t.Error("Expected acknowledgement, got", evt)
+	}
+	i.done(r, 1)
+
+	// An acknowledgement which arrives before the connection is lost
+	r = i.begin()
+	i.ack(NewPublish(2))
+	i.fail(errors.New("lost"))
+	if evt := receive(i.wait(r, 2)); evt == nil || evt.Err != nil {
+		t.Error("Expected acknowledgement, got", evt)
+	}
+	i.done(r, 2)
+}
+
+func Test_Inflight_003(t *testing.T) {
+	// An acknowledgement which is not claimed, while requests overlap, is
+	// not claimed by a later request with the same message id
+	i := newInflight()
+	a := i.begin()
+	i.ack(NewPublish(3))
+	b := i.begin()
+	i.done(a, 1)
+	if evt := receive(i.wait(b, 3)); evt != nil {
+		t.Error("Unexpected event", evt)
+	}
+	i.done(b, 3)
+	if len(i.acks) != 0 || len(i.waiters) != 0 || len(i.sending) != 0 {
+		t.Error("Expected no requests", i.acks, i.waiters, i.sending)
+	}
+}
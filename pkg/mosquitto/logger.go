@@ -0,0 +1,202 @@
+package mosquitto
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Logger receives structured log records from the client, for log lines of
+// the library and for connection, subscribe and publish operations
+type Logger interface {
+	Log(*Record)
+}
+
+// LoggerFunc is a function which receives log records
+type LoggerFunc func(*Record)
+
+// Record is a structured log record
+type Record struct {
+	Time     time.Time
+	Level    Level
+	ClientId string                 // Client id, which is empty when assigned by the broker
+	Broker   string                 // Broker as host:port
+	Message  string                 // Log message
+	Fields   map[string]interface{} // Fields of an operation, such as topic and qos
+}
+
+// logger passes records at or above a minimum level to a Logger
+type logger struct {
+	Logger
+	min      Level
+	clientId string
+}
+
+// stdLogger writes records to a log.Logger
+type stdLogger struct {
+	*log.Logger
+}
+
+// jsonLogger writes records to a writer as JSON, one record per line
+type jsonLogger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewStdLogger returns a logger which writes records to a log.Logger, or to
+// the standard logger if nil
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	return &stdLogger{l}
+}
+
+// NewJSONLogger returns a logger which writes records to a writer as JSON
+// lines, with the fields of the record as members
+func NewJSONLogger(w io.Writer) Logger {
+	return &jsonLogger{w: w}
+}
+
+// Return a logger which passes records at or above a minimum level, or nil
+// if there is no logger
+func newLogger(l Logger, min Level, clientId string) *logger {
+	if l == nil {
+		return nil
+	}
+	return &logger{l, min, clientId}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (r *Record) String() string {
+	str := "[" + levelName(r.Level) + "]"
+	if r.ClientId != "" {
+		str += fmt.Sprintf(" client=%q", r.ClientId)
+	}
+	if r.Broker != "" {
+		str += fmt.Sprintf(" broker=%q", r.Broker)
+	}
+	str += " " + r.Message
+	keys := make([]string, 0, len(r.Fields))
+	for key := range r.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		str += fmt.Sprintf(" %v=%v", key, r.Fields[key])
+	}
+	return str
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+func (fn LoggerFunc) Log(r *Record) {
+	fn(r)
+}
+
+func (l *stdLogger) Log(r *Record) {
+	l.Print(r)
+}
+
+func (l *jsonLogger) Log(r *Record) {
+	v := make(map[string]interface{}, len(r.Fields)+5)
+	for key, value := range r.Fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		v[key] = value
+	}
+	v["time"] = r.Time.Format(time.RFC3339Nano)
+	v["level"] = levelName(r.Level)
+	v["message"] = r.Message
+	if r.ClientId != "" {
+		v["client_id"] = r.ClientId
+	}
+	if r.Broker != "" {
+		v["broker"] = r.Broker
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.w.Write(append(data, '\n'))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Pass a record to the logger when the level is at or above the minimum
+// level. Fields are pairs of names and values
+func (l *logger) log(level Level, broker, message string, fields ...interface{}) {
+	if l == nil || severity(level) < severity(l.min) {
+		return
+	}
+	r := &Record{
+		Time:     time.Now(),
+		Level:    level,
+		ClientId: l.clientId,
+		Broker:   broker,
+		Message:  message,
+	}
+	if len(fields) > 0 {
+		r.Fields = make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			r.Fields[fmt.Sprint(fields[i])] = fields[i+1]
+		}
+	}
+	l.Log(r)
+}
+
+// Return the severity of a level, from debug to error
+func severity(l Level) int {
+	switch l {
+	case MOSQ_LOG_DEBUG:
+		return 0
+	case MOSQ_LOG_INFO:
+		return 1
+	case MOSQ_LOG_NOTICE:
+		return 2
+	case MOSQ_LOG_WARNING:
+		return 3
+	case MOSQ_LOG_ERR:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// Return a short name for a level
+func levelName(l Level) string {
+	switch l {
+	case MOSQ_LOG_DEBUG:
+		return "debug"
+	case MOSQ_LOG_INFO:
+		return "info"
+	case MOSQ_LOG_NOTICE:
+		return "notice"
+	case MOSQ_LOG_WARNING:
+		return "warning"
+	case MOSQ_LOG_ERR:
+		return "error"
+	default:
+		return "none"
+	}
+}
@@ -0,0 +1,102 @@
+package mosquitto
+
+import (
+	"time"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// loop runs the network loop for clients. The loop is started once the
+// client has started to connect, and stopped once the client has been
+// asked to disconnect. The client is in threaded mode before the loop is
+// started, so requests are written by the loop rather than the caller
+type loop interface {
+	// Start the loop for a client
+	start(c *Client) error
+
+	// Wait for the loop for a client to stop
+	stop(c *Client) error
+
+	// Wake the loop when there are packets to write
+	wake(c *Client)
+
+	// Return true if the loop reconnects to the next broker when the
+	// connection fails
+	failover() bool
+}
+
+// goroutineLoop runs the loop for each client in a goroutine
+type goroutineLoop struct{}
+
+// threadLoop runs the loop for each client in a thread started by the library,
+// which reconnects to the same broker when the connection is lost
+type threadLoop struct{}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Loop timeout, which limits how long it takes to stop the loop
+	loopTimeout = 100 * time.Millisecond
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// GOROUTINE LOOP
+
+func (goroutineLoop) start(c *Client) error {
+	// Run the loop in the background, reconnecting when the connection
+	// is lost
+	c.WaitGroup.Add(1)
+	go func() {
+		defer c.WaitGroup.Done()
+		for c.running() {
+			if err := c.client.loop(loopTimeout); err != nil && c.running() {
+				c.reconnect()
+			}
+		}
+	}()
+
+	// Return success
+	return nil
+}
+
+func (goroutineLoop) stop(c *Client) error {
+	c.WaitGroup.Wait()
+	return nil
+}
+
+func (goroutineLoop) wake(c *Client) {
+	// The library wakes the loop
+}
+
+func (goroutineLoop) failover() bool {
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// THREAD LOOP
+
+func (threadLoop) start(c *Client) error {
+	if client, ok := c.client.(threadedBackend); !ok {
+		return ErrNotImplemented.With("Loop thread is not supported by the backend")
+	} else {
+		return client.loopStart()
+	}
+}
+
+func (threadLoop) stop(c *Client) error {
+	return c.client.(threadedBackend).loopStop()
+}
+
+func (threadLoop) wake(c *Client) {
+	// The library wakes the loop
+}
+
+func (threadLoop) failover() bool {
+	// The library reconnects to the same broker
+	return false
+}
@@ -4,13 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"runtime"
+	"sort"
 	"sync"
 	"time"
 
 	// Packages
-	mosq "github.com/mutablelogic/go-mosquitto/sys/mosquitto"
 	multierror "github.com/hashicorp/go-multierror"
+	topic "github.com/mutablelogic/go-mosquitto/pkg/topic"
 
 	// Namespace imports
 	. "github.com/djthorpe/go-errors"
@@ -22,20 +22,54 @@ import (
 
 type Client struct {
 	sync.WaitGroup
-	client     *mosq.ClientEx
-	ch         chan *Event
-	disconnect bool
+	client     backend
+	state      *state
+	stop       chan struct{}
+	v5         bool
+	persistent bool
+	keepalive  time.Duration
+	defaults   opts
+	loop       loop
+	fn         EventFunc
+	events     Flags
+	logger     *logger
+
+	// Brokers to connect to, and the delay between attempts to reconnect
+	brokers *brokers
+
+	// Held by requests to the backend, and by Close to destroy the backend
+	closing sync.RWMutex
+
+	// Topics of subscribe and unsubscribe requests, keyed by request id,
+	// and brokers which fail while connecting for the first time
+	mu       sync.Mutex
+	requests map[int][]string
+	failures chan failure
+
+	// Requests waiting for acknowledgement, keyed by message id
+	inflight *inflight
+
+	// Message handlers, keyed by subscription filter
+	router *router
+
+	// Subscriptions which are replayed on reconnect
+	subscriptions *subscriptions
+
+	// Counters of messages, latency and connections
+	metrics *metrics
+
+	// Queue of messages received, if any
+	queue *Queue
 }
 
 type EventFunc func(*Event)
 type TraceFunc func(string)
 
-////////////////////////////////////////////////////////////////////////////////
-// GLOBALS
-
-var (
-	once = new(sync.Once)
-)
+// failure is a broker which failed to connect, or lost the connection
+type failure struct {
+	broker string
+	err    error
+}
 
 ////////////////////////////////////////////////////////////////////////////////
 // LIFECYCLE
@@ -45,141 +79,115 @@ func New(ctx context.Context, host string, callback EventFunc) (*Client, error)
 	return NewWithConfig(ctx, defaultConfig.WithHost(host).WithCallback(callback))
 }
 
-// New client connection with additional configuration
+// New client connection with additional configuration. Returns when a
+// broker acknowledges the connection, or with an error when the connection
+// to every broker fails or the context is done
 func NewWithConfig(ctx context.Context, cfg Config) (*Client, error) {
 	c := new(Client)
-
-	// Initialize once
-	var result error
-	once.Do(func() {
-		if err := mosq.Init(); err != nil {
-			result = multierror.Append(result, err)
-		}
-		runtime.SetFinalizer(&once, func() {
-			mosq.Cleanup()
-		})
-	})
+	c.logger = newLogger(cfg.logger, cfg.minlevel, cfg.clientId)
 
 	// Create a new client
-	if result != nil {
-		return nil, result
-	} else if client, err := mosq.NewEx(cfg.clientId, true); err != nil {
+	if cfg.persistent && cfg.clientId == "" {
+		return nil, ErrBadParameter.With("Persistent session requires a client id")
+	} else if _, thread := cfg.loop.(threadLoop); thread && len(cfg.brokerList()) > 1 {
+		return nil, ErrBadParameter.With("Library loop thread does not support several brokers")
+	} else if thread && cfg.reconnect.jitter > 0 {
+		return nil, ErrBadParameter.With("Library loop thread does not support reconnect jitter")
+	} else if client, err := newBackend(c, cfg); err != nil {
 		return nil, err
 	} else {
 		c.client = client
-		c.ch = make(chan *Event)
+		c.state = newState()
+		c.stop = make(chan struct{})
+		c.v5 = cfg.protocol == MQTT_PROTOCOL_V5
+		c.keepalive = cfg.keepalive
+		c.defaults = defaultOpts
+		c.defaults.qos = cfg.qos
+		c.loop = cfg.loop
+		if c.loop == nil {
+			c.loop = goroutineLoop{}
+		}
+		c.fn = cfg.fn
+		c.events = cfg.events
+		c.requests = make(map[int][]string)
+		c.inflight = newInflight()
+		c.router = newRouter()
+		c.subscriptions = newSubscriptions()
+		c.metrics = newMetrics()
+		c.persistent = cfg.persistent
 	}
 
-	// Set credentials
-	if cfg.user != "" {
-		if err := c.client.SetCredentials(cfg.user, cfg.password); err != nil {
-			c.client.Destroy()
-			return nil, err
-		}
+	// Set brokers, with the default port when not set
+	list := cfg.brokerList()
+	c.brokers = newBrokers(list, cfg.reconnect)
+
+	// Receive state transitions and failures until connected
+	transitions := c.state.subscribe(nil)
+	defer c.state.unsubscribe(transitions)
+	failures := make(chan failure, 2*len(list))
+	c.failures = failures
+	defer c.forgetFailures()
+
+	// Perform connection, trying each broker in turn
+	err := c.connect(ctx, c.brokers.get())
+	for i := 1; err != nil && i < len(list); i++ {
+		_, broker := c.brokers.next()
+		err = c.connect(ctx, broker)
+	}
+	if err != nil {
+		c.log(MOSQ_LOG_ERR, "Connect failed", "err", err)
+		c.client.destroy()
+		c.state.set(StateClosed, err)
+		return nil, err
 	}
 
-	// Set TLS
-	if cfg.capath != "" {
-		if err := c.client.SetTLS(cfg.capath, cfg.certpath, cfg.keypath); err != nil {
-			c.client.Destroy()
-			return nil, err
-		}
-		if err := c.client.SetTLSInsecure(!cfg.certverify); err != nil {
-			c.client.Destroy()
+	// Create the queue of messages
+	if cfg.queue != nil {
+		if queue, err := NewQueue(*cfg.queue); err != nil {
+			c.client.disconnect()
+			c.client.destroy()
+			c.state.set(StateClosed, err)
 			return nil, err
-		}
-		if cfg.port == 0 {
-			cfg.port = mosq.MOSQ_DEFAULT_SECURE_PORT
-		}
-	} else {
-		if cfg.port == 0 {
-			cfg.port = mosq.MOSQ_DEFAULT_PORT
+		} else {
+			c.queue = queue
 		}
 	}
 
-	// Always set connect and disconnect callbacks
-	c.client.SetConnectCallback(func(err mosq.Error) {
-		err_ := toError(err)
-		select {
-		case c.ch <- NewConnect(err_):
-			break
-		default:
-			break
-		}
-		if cfg.fn != nil {
-			cfg.fn(NewConnect(err_))
-		}
-	})
-	c.client.SetDisconnectCallback(func(err mosq.Error) {
-		err_ := toError(err)
-		select {
-		case c.ch <- NewDisconnect(err_):
-			break
-		default:
-			break
-		}
-		if cfg.fn != nil {
-			cfg.fn(NewDisconnect(err_))
+	// Run the loop in the background
+	if err := c.loop.start(c); err != nil {
+		if c.queue != nil {
+			c.queue.Close()
 		}
-	})
-
-	// Set event callbacks
-	if cfg.fn != nil {
-		c.client.SetSubscribeCallback(func(id int, qos []int) {
-			cfg.fn(NewSubscribe(id))
-		})
-		c.client.SetUnsubscribeCallback(func(id int) {
-			cfg.fn(NewUnsubscribe(id))
-		})
-		c.client.SetPublishCallback(func(id int) {
-			cfg.fn(NewPublish(id))
-		})
-		c.client.SetMessageCallback(func(message *mosq.Message) {
-			// We make a copy of the data
-			// as this is invalidated after the callback ends
-			data := make([]byte, len(message.Data()))
-			copy(data, message.Data())
-			// Emit
-			cfg.fn(NewMessage(message.Id(), message.Topic(), data))
-		})
-	}
-
-	// Set trace callback
-	if cfg.trace != nil {
-		c.client.SetLogCallback(func(level mosq.Level, message string) {
-			cfg.trace(message)
-		})
-	}
-
-	// Perform connection, start loop
-	if err := c.client.Connect(cfg.host, int(cfg.port), int(cfg.keepalive.Seconds()), false); err != nil {
-		c.client.LoopStop(true)
-		c.client.Destroy()
+		c.client.disconnect()
+		c.client.destroy()
+		c.state.set(StateClosed, err)
 		return nil, err
 	}
 
-	// Run the loop in the background
-	c.WaitGroup.Add(1)
-	go func(delta time.Duration) {
-		defer c.WaitGroup.Done()
-		for !c.disconnect {
-			if err := c.client.Loop(int(delta.Milliseconds())); err != nil {
-				break
+	// Wait for connection, cancel, or every broker to fail. The loop moves
+	// to the next broker after a failure, unless it reconnects to the same
+	// broker. On cancel or error the loop is stopped and the client
+	// destroyed
+	brokers := 1
+	if c.loop.failover() {
+		brokers = countBrokers(list)
+	}
+	failed := make(map[string]bool, brokers)
+	for {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			return nil, ctx.Err()
+		case f := <-failures:
+			if failed[f.broker] = true; len(failed) >= brokers {
+				c.log(MOSQ_LOG_ERR, "Connect failed", "err", f.err)
+				c.Close()
+				return nil, f.err
+			}
+		case t := <-transitions:
+			if t.To == StateConnected {
+				return c, nil
 			}
-		}
-	}(time.Second)
-
-	// Wait for connection, cancel, or some other unknown issue
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case evt := <-c.ch:
-		if evt.Type == MOSQ_FLAG_EVENT_CONNECT && evt.Err == nil {
-			return c, nil
-		} else if evt.Err != nil {
-			return nil, evt.Err
-		} else {
-			return nil, ErrOutOfOrder.With(evt.Type)
 		}
 	}
 }
@@ -187,18 +195,48 @@ func NewWithConfig(ctx context.Context, cfg Config) (*Client, error) {
 func (c *Client) Close() error {
 	var result error
 
-	c.disconnect = true
-	if err := c.client.Disconnect(); err != nil {
+	// Return an error if the client is already closing. An error from
+	// disconnecting is ignored unless the client was connected, as there
+	// is no connection to close while connecting or reconnecting
+	state, _ := c.state.get()
+	if !c.state.set(StateDisconnecting, nil) {
+		return ErrOutOfOrder.With("Client is closed")
+	}
+	close(c.stop)
+	if err := c.client.disconnect(); err != nil && state == StateConnected {
 		result = multierror.Append(result, err)
 	}
 
+	// Close the queue, so the loop is not waiting to put messages
+	if c.queue != nil {
+		if err := c.queue.Close(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
 	// Wait for loop to be completed
-	c.WaitGroup.Wait()
+	c.loop.wake(c)
+	if err := c.loop.stop(c); err != nil {
+		result = multierror.Append(result, err)
+	}
 
-	// Destroy client
-	if err := c.client.Destroy(); err != nil {
+	// Destroy client, once requests to the backend have returned
+	c.closing.Lock()
+	if err := c.client.destroy(); err != nil {
 		result = multierror.Append(result, err)
 	}
+	c.closing.Unlock()
+
+	// Fail any requests waiting for acknowledgement
+	c.inflight.fail(ErrOutOfOrder.With("Client is closed"))
+	c.forgetRequests()
+	c.metrics.reset()
+	c.state.set(StateClosed, result)
+	if result != nil {
+		c.log(MOSQ_LOG_WARNING, "Closed", "err", result)
+	} else {
+		c.log(MOSQ_LOG_INFO, "Closed")
+	}
 
 	// Return any errors
 	return result
@@ -207,9 +245,9 @@ func (c *Client) Close() error {
 ////////////////////////////////////////////////////////////////////////////////
 // STRINGIFY
 
+// Version returns the version of libmosquitto, or of Go for the Go backend
 func (c *Client) Version() string {
-	major, minor, revision := mosq.Version()
-	return fmt.Sprintf("%d.%d.%d", major, minor, revision)
+	return c.client.version()
 }
 
 func (c *Client) String() string {
@@ -222,38 +260,262 @@ func (c *Client) String() string {
 // PUBLIC METHODS
 
 func (c *Client) Subscribe(topics string, opts ...ClientOpt) (int, error) {
+	// Check the subscription
+	if err := validateSubscribe(topics); err != nil {
+		return 0, err
+	}
+
 	// Apply options
-	v := defaultOpts
+	v := c.defaults
 	for _, opt := range opts {
 		opt(&v)
 	}
+
 	// Perform the subscribe
-	if id, err := c.client.Subscribe(topics, v.qos); err != nil {
-		return 0, err
-	} else {
-		return id, nil
+	return c.subscribe([]string{topics}, v)
+}
+
+// SubscribeMany subscribes to many topics, each with a QoS. Topics with the
+// same QoS are sent in one request, and the ids of the requests are returned.
+// With MQTT v5 each topic is sent in its own request, so it has its own
+// subscription identifier. The subscribe events carry the topics and the QoS
+// granted for each topic
+func (c *Client) SubscribeMany(topics map[string]int, opts ...ClientOpt) ([]int, error) {
+	// Group the topics by QoS
+	groups := make(map[int][]string)
+	for topic, qos := range topics {
+		if err := validateSubscribe(topic); err != nil {
+			return nil, err
+		}
+		groups[qos] = append(groups[qos], topic)
+	}
+	if len(groups) == 0 {
+		return nil, ErrBadParameter.With("No topics")
+	}
+
+	// Apply options
+	v := c.defaults
+	for _, opt := range opts {
+		opt(&v)
+	}
+
+	// Perform the subscribes in order of QoS
+	qos := make([]int, 0, len(groups))
+	for k := range groups {
+		qos = append(qos, k)
 	}
+	sort.Ints(qos)
+	result := make([]int, 0, len(qos))
+	for _, k := range qos {
+		sort.Strings(groups[k])
+		v.qos = k
+		for _, topics := range c.split(groups[k]) {
+			if id, err := c.subscribe(topics, v); err != nil {
+				return result, err
+			} else {
+				result = append(result, id)
+			}
+		}
+	}
+
+	// Return success
+	return result, nil
 }
 
-func (c *Client) Unsubscribe(topics string) (int, error) {
-	if id, err := c.client.Unsubscribe(topics); err != nil {
-		return 0, err
-	} else {
-		return id, nil
+func (c *Client) Unsubscribe(topics string, opts ...ClientOpt) (int, error) {
+	return c.UnsubscribeMany([]string{topics}, opts...)
+}
+
+// UnsubscribeMany unsubscribes from many topics in one request
+func (c *Client) UnsubscribeMany(topics []string, opts ...ClientOpt) (int, error) {
+	// Check the subscriptions
+	if len(topics) == 0 {
+		return 0, ErrBadParameter.With("No topics")
+	}
+	for _, topic := range topics {
+		if err := validateSubscribe(topic); err != nil {
+			return 0, err
+		}
+	}
+
+	// Apply options
+	v := c.defaults
+	for _, opt := range opts {
+		opt(&v)
 	}
+
+	// Perform the unsubscribe
+	return c.unsubscribe(topics, v)
 }
 
 func (c *Client) Publish(topic string, data []byte, opts ...ClientOpt) (int, error) {
+	// Check the topic
+	if err := validatePublish(topic); err != nil {
+		return 0, err
+	}
+
 	// Apply options
-	v := defaultOpts
+	v := c.defaults
 	for _, opt := range opts {
 		opt(&v)
 	}
-	// Send message
-	if id, err := c.client.Publish(topic, data, v.qos, v.retain); err != nil {
+	// Send message, unless the client is closing
+	c.closing.RLock()
+	defer c.closing.RUnlock()
+	if !c.running() {
+		return 0, ErrOutOfOrder.With("Client is closed")
+	}
+	sent := time.Now()
+	id, err := c.client.publish(topic, data, v.qos, v.retain, v.props)
+	if err != nil {
+		c.log(MOSQ_LOG_ERR, "Publish failed", "topic", topic, "qos", v.qos, "err", err)
 		return 0, err
+	}
+	c.log(MOSQ_LOG_DEBUG, "Publish", "id", id, "topic", topic, "qos", v.qos, "retain", v.retain, "size", len(data))
+	c.metrics.sent(id, v.qos, len(data), sent)
+
+	// Wake the loop to write the message, and return success
+	c.loop.wake(c)
+	return id, nil
+}
+
+// State returns the current state of the connection to the broker
+func (c *Client) State() State {
+	state, _ := c.state.get()
+	return state
+}
+
+// Since returns the time the current state was entered
+func (c *Client) Since() time.Time {
+	_, since := c.state.get()
+	return since
+}
+
+// Stats returns a snapshot of the counters of messages sent and received,
+// the latency of acknowledgements and the connections to the broker
+func (c *Client) Stats() Stats {
+	stats := c.metrics.get()
+	stats.Dropped += c.state.drops()
+	if c.queue != nil {
+		stats.Dropped += c.queue.Dropped()
+	}
+	return stats
+}
+
+// Messages returns a channel which receives messages in the order they
+// were received, when the configuration has a queue, or nil otherwise.
+// The channel is closed when the client is closed
+func (c *Client) Messages() <-chan *Event {
+	if c.queue == nil {
+		return nil
+	}
+	return c.queue.C()
+}
+
+// WaitForState blocks until the client is in a state, the context is done,
+// or the client is closed
+func (c *Client) WaitForState(ctx context.Context, state State) error {
+	return c.state.wait(ctx, state)
+}
+
+// Transitions returns a channel which receives state transitions, which is
+// closed when the context is done or the client is closed. Transitions are
+// dropped when the receiver does not keep up
+func (c *Client) Transitions(ctx context.Context) <-chan Transition {
+	return c.state.subscribe(ctx)
+}
+
+// Subscriptions returns the topics the client has subscribed to, in order of
+// topic. These are subscribed to again when the client reconnects, unless
+// the broker has resumed a persistent session
+func (c *Client) Subscriptions() []Subscription {
+	return c.subscriptions.list()
+}
+
+// Handle adds a handler for messages with topics which match a filter, and
+// returns the id of the handler. A message is passed to every handler with
+// a matching filter. With OptSubscribe the client subscribes to the filter,
+// using any other options for the subscription
+func (c *Client) Handle(filter string, fn EventFunc, opts ...ClientOpt) (int, error) {
+	// Check parameters
+	if err := validateSubscribe(filter); err != nil {
+		return 0, err
+	} else if fn == nil {
+		return 0, ErrBadParameter.With("Handle: nil handler")
+	}
+
+	// Apply options
+	v := c.defaults
+	for _, opt := range opts {
+		opt(&v)
+	}
+
+	// Add the handler, and subscribe if this is the first handler
+	id, subscribe := c.router.add(filter, fn, v.subscribe)
+	if subscribe {
+		if _, err := c.subscribe([]string{filter}, v); err != nil {
+			c.router.fail(id)
+			return 0, err
+		}
+	}
+
+	// Return success
+	return id, nil
+}
+
+// RemoveHandler removes a handler. When the last handler for a filter
+// added with OptSubscribe is removed, the client unsubscribes from the filter
+func (c *Client) RemoveHandler(id int) error {
+	filter, unsubscribe, exists := c.router.remove(id)
+	if !exists {
+		return ErrNotFound.Withf("RemoveHandler: %v", id)
+	} else if unsubscribe {
+		if _, err := c.unsubscribe([]string{filter}, c.defaults); err != nil {
+			return err
+		}
+	}
+
+	// Return success
+	return nil
+}
+
+// PublishWait publishes a message and blocks until the broker acknowledges
+// it, the context is cancelled or the connection is lost. For QoS 0 the
+// message is acknowledged once it has been sent
+func (c *Client) PublishWait(ctx context.Context, topic string, data []byte, opts ...ClientOpt) error {
+	r := c.inflight.begin()
+	id, err := c.Publish(topic, data, opts...)
+	defer c.inflight.done(r, id)
+	if err != nil {
+		return err
+	}
+
+	// Wait for acknowledgement
+	_, err = c.wait(ctx, r, id)
+	return err
+}
+
+// SubscribeWait subscribes to a topic and blocks until the broker
+// acknowledges it, the context is cancelled or the connection is lost.
+// It returns the granted QoS, or an error if the subscription was refused
+func (c *Client) SubscribeWait(ctx context.Context, topics string, opts ...ClientOpt) (int, error) {
+	r := c.inflight.begin()
+	id, err := c.Subscribe(topics, opts...)
+	defer c.inflight.done(r, id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Wait for acknowledgement
+	evt, err := c.wait(ctx, r, id)
+	if err != nil {
+		return 0, err
+	} else if len(evt.GrantedQoS) == 0 {
+		return 0, ErrUnexpectedResponse.With("No granted QoS")
+	} else if qos := evt.GrantedQoS[0]; qos >= MQTT_SUBACK_FAILURE {
+		return 0, c.client.reasonError(qos)
 	} else {
-		return id, nil
+		return qos, nil
 	}
 }
 
@@ -318,10 +580,390 @@ func (this *Client) PublishInflux(topic string, measurement string, fields map[s
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVATE METHODS
 
-func toError(err mosq.Error) error {
-	if err == mosq.MOSQ_ERR_SUCCESS {
-		return nil
+// Subscribe to one or more topics with the same QoS, and record the topics
+// of the request so they can be returned with the subscribe event
+func (c *Client) subscribe(topics []string, v opts) (int, error) {
+	// Refuse the request when the client is closing
+	c.closing.RLock()
+	defer c.closing.RUnlock()
+	if !c.running() {
+		return 0, ErrOutOfOrder.With("Client is closed")
+	}
+
+	// Hold the lock until the request is recorded, as the broker may respond
+	// before the request id is returned
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// With MQTT v5, identify the subscription so messages can be routed to
+	// handlers when the broker sends a message for each subscription
+	if c.v5 && len(topics) == 1 {
+		v.props.SubscriptionIds = []int{c.subscriptions.identify(topics[0])}
+	}
+
+	id, err := c.client.subscribe(topics, v.qos, v.options, v.props)
+	if err != nil {
+		c.log(MOSQ_LOG_ERR, "Subscribe failed", "topics", topics, "qos", v.qos, "err", err)
+		return 0, err
+	}
+	c.log(MOSQ_LOG_DEBUG, "Subscribe", "id", id, "topics", topics, "qos", v.qos)
+	c.requests[id] = topics
+	if c.v5 {
+		c.subscriptions.add(topics, v.qos, v.options)
 	} else {
+		c.subscriptions.add(topics, v.qos, 0)
+	}
+	c.loop.wake(c)
+
+	// Return success
+	return id, nil
+}
+
+// Subscribe again to all subscriptions, grouped by QoS and options, after
+// the client has reconnected
+func (c *Client) resubscribe() error {
+	var result error
+	groups := make(map[[2]int][]string)
+	for _, sub := range c.subscriptions.list() {
+		k := [2]int{sub.QoS, sub.Options}
+		groups[k] = append(groups[k], sub.Topic)
+	}
+	for k, topics := range groups {
+		for _, topics := range c.split(topics) {
+			if _, err := c.subscribe(topics, opts{qos: k[0], options: k[1]}); err != nil {
+				result = multierror.Append(result, err)
+			}
+		}
+	}
+
+	// Return any errors
+	return result
+}
+
+// Split topics into one request for each topic with MQTT v5, as a request
+// has one subscription identifier, or return the topics as one request
+func (c *Client) split(topics []string) [][]string {
+	if !c.v5 {
+		return [][]string{topics}
+	}
+	result := make([][]string, 0, len(topics))
+	for _, topic := range topics {
+		result = append(result, []string{topic})
+	}
+	return result
+}
+
+// Unsubscribe from one or more topics, and record the topics of the request
+// so they can be returned with the unsubscribe event
+func (c *Client) unsubscribe(topics []string, v opts) (int, error) {
+	// Refuse the request when the client is closing
+	c.closing.RLock()
+	defer c.closing.RUnlock()
+	if !c.running() {
+		return 0, ErrOutOfOrder.With("Client is closed")
+	}
+
+	// Hold the lock until the request is recorded
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.client.unsubscribe(topics, v.props)
+	if err != nil {
+		c.log(MOSQ_LOG_ERR, "Unsubscribe failed", "topics", topics, "err", err)
+		return 0, err
+	}
+	c.log(MOSQ_LOG_DEBUG, "Unsubscribe", "id", id, "topics", topics)
+	if c.fn != nil && c.events&MOSQ_FLAG_EVENT_UNSUBSCRIBE != 0 {
+		// The topics are only returned with the unsubscribe event, and the
+		// acknowledgement is not received when the event is not requested
+		c.requests[id] = topics
+	}
+	c.subscriptions.remove(topics)
+	c.loop.wake(c)
+
+	// Return success
+	return id, nil
+}
+
+// Wait for the acknowledgement of a request, or for the context to be done
+func (c *Client) wait(ctx context.Context, r *request, id int) (*Event, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case evt := <-c.inflight.wait(r, id):
+		return evt, evt.Err
+	}
+}
+
+// Return the topics of a subscribe or unsubscribe request, and forget them
+func (c *Client) requestTopics(id int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := c.requests[id]
+	delete(c.requests, id)
+	return topics
+}
+
+// Forget the topics of requests which will not be acknowledged, when the
+// connection is lost or the client is closed
+func (c *Client) forgetRequests() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = make(map[int][]string)
+}
+
+// Record a broker which failed, while connecting for the first time. The
+// failure is dropped if it is not being waited for
+func (c *Client) failed(b broker, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case c.failures <- failure{b.String(), err}:
+	default:
+	}
+}
+
+// Stop recording brokers which fail, once connected for the first time
+func (c *Client) forgetFailures() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures = nil
+}
+
+// Connect to a broker without waiting for the connection to complete,
+// which is completed by the loop
+func (c *Client) connect(ctx context.Context, b broker) error {
+	c.logger.log(MOSQ_LOG_INFO, b.String(), "Connecting")
+	if err := c.client.connect(ctx, b, c.keepalive); err != nil {
+		c.logger.log(MOSQ_LOG_WARNING, b.String(), "Connect failed", "err", err)
+		c.failed(b, err)
 		return err
 	}
+
+	// Return success
+	return nil
+}
+
+// Wait for the reconnect delay, then connect to the next broker. Returns
+// early if the client is closed. Errors are not returned, as the loop
+// fails and reconnects again
+func (c *Client) reconnect() {
+	delay, broker := c.brokers.next()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-c.stop:
+		return
+	case <-timer.C:
+		ctx, cancel := c.context()
+		defer cancel()
+		c.connect(ctx, broker)
+	}
+}
+
+// Return a context which is cancelled when the client is closed, to cancel
+// an attempt to reconnect
+func (c *Client) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Called when the client has connected, to subscribe again unless the
+// broker has resumed a persistent session
+func (c *Client) connected(flags int) {
+	if c.persistent && flags&sessionPresent != 0 {
+		return
+	}
+	c.resubscribe()
+}
+
+// Forget subscriptions which were refused by the broker
+func (c *Client) subscribed(evt *Event) *Event {
+	for topic, qos := range evt.Granted() {
+		if qos >= MQTT_SUBACK_FAILURE {
+			c.log(MOSQ_LOG_WARNING, "Subscription refused", "id", evt.Id, "topic", topic, "reason", qos)
+			c.subscriptions.remove([]string{topic})
+		}
+	}
+	return evt
+}
+
+// Emit a connect or disconnect event to the callback, after changing state.
+// A connection error or lost connection moves the client to reconnecting
+func (c *Client) emit(evt *Event, flags int) {
+	evt.Broker = c.brokers.get().String()
+	switch {
+	case evt.Type == MOSQ_FLAG_EVENT_CONNECT && evt.Err == nil:
+		c.log(MOSQ_LOG_NOTICE, "Connected", "session_present", flags&sessionPresent != 0)
+		c.brokers.connected()
+		c.metrics.connected()
+		c.state.set(StateConnected, nil)
+		c.connected(flags)
+	case evt.Type == MOSQ_FLAG_EVENT_CONNECT:
+		c.log(MOSQ_LOG_WARNING, "Connect refused", "reason", evt.ReasonCode, "err", evt.Err)
+		c.failed(c.brokers.get(), evt.Err)
+		c.state.set(StateReconnecting, evt.Err)
+	case evt.Type == MOSQ_FLAG_EVENT_DISCONNECT && evt.Err == nil:
+		c.log(MOSQ_LOG_INFO, "Disconnected")
+		c.inflight.fail(c.lostError(evt.Err))
+		c.forgetRequests()
+		c.metrics.reset()
+		c.state.set(StateReconnecting, evt.Err)
+	case evt.Type == MOSQ_FLAG_EVENT_DISCONNECT:
+		c.log(MOSQ_LOG_WARNING, "Connection lost", "reason", evt.ReasonCode, "err", evt.Err)
+		c.failed(c.brokers.get(), evt.Err)
+		c.inflight.fail(c.lostError(evt.Err))
+		c.forgetRequests()
+		c.metrics.reset()
+		c.state.set(StateReconnecting, evt.Err)
+	}
+	c.callback(evt)
+}
+
+// Pass an event to the callback, if the type of event was requested
+func (c *Client) callback(evt *Event) {
+	if c.fn != nil && c.events&evt.Type != 0 {
+		c.fn(evt)
+	}
+}
+
+// Return true if the client is not disconnecting or closed
+func (c *Client) running() bool {
+	state, _ := c.state.get()
+	return state != StateDisconnecting && state != StateClosed
+}
+
+// Return the error passed to requests waiting for acknowledgement when
+// the client disconnects
+func (c *Client) lostError(err error) error {
+	if err == nil {
+		return c.client.lostError()
+	}
+	return err
+}
+
+// Called by the backend when the broker acknowledges or refuses the
+// connection
+func (c *Client) onConnect(err error, rc int, flags int, props Properties) {
+	c.emit(withReason(NewConnect(err), rc, props), flags)
+}
+
+// Called by the backend when the connection is closed or lost
+func (c *Client) onDisconnect(err error, rc int, props Properties) {
+	c.emit(withReason(NewDisconnect(err), rc, props), 0)
+}
+
+// Called by the backend when a subscribe request is acknowledged, to forget
+// the request and acknowledge waiters
+func (c *Client) onSubscribe(id int, qos []int, props Properties) {
+	c.log(MOSQ_LOG_DEBUG, "Subscribe acknowledged", "id", id, "granted", qos)
+	evt := withReason(c.subscribed(withGranted(NewSubscribe(id), c.requestTopics(id), qos)), 0, props)
+	c.inflight.ack(evt)
+	c.callback(evt)
+}
+
+// Called by the backend when an unsubscribe request is acknowledged
+func (c *Client) onUnsubscribe(id int, props Properties) {
+	c.log(MOSQ_LOG_DEBUG, "Unsubscribe acknowledged", "id", id)
+	c.callback(withReason(withGranted(NewUnsubscribe(id), c.requestTopics(id), nil), 0, props))
+}
+
+// Called by the backend when a message has been sent, or acknowledged by
+// the broker, to acknowledge waiters
+func (c *Client) onPublish(id int, err error, rc int, props Properties) {
+	if err != nil {
+		c.log(MOSQ_LOG_WARNING, "Publish failed", "id", id, "reason", rc, "err", err)
+	} else {
+		c.log(MOSQ_LOG_DEBUG, "Publish acknowledged", "id", id)
+	}
+	c.metrics.acked(id, err)
+	evt := withReason(NewPublish(id), rc, props)
+	evt.Err = err
+	c.inflight.ack(evt)
+	c.callback(evt)
+}
+
+// Called by the backend when a message is received, to dispatch the message
+// to handlers. The data is not used by the backend after the call
+func (c *Client) onMessage(id int, topic string, data []byte, qos int, retain, dup bool, props Properties) {
+	evt := withReason(NewMessage(id, topic, data), 0, props)
+	evt.QoS, evt.Retain, evt.Duplicate = qos, retain, dup
+	c.metrics.received(qos, len(data))
+	c.router.dispatch(evt, c.subscriptions.match(topic))
+	c.callback(evt)
+	if c.queue != nil {
+		c.queue.Put(evt)
+	}
+}
+
+// Called by the backend with a log message
+func (c *Client) onLog(level Level, message string) {
+	c.log(level, message)
+	c.callback(NewLog(level, message))
+}
+
+// Pass a record to the logger, with the current broker. Fields are pairs
+// of names and values
+func (c *Client) log(level Level, message string, fields ...interface{}) {
+	if c.logger == nil {
+		return
+	}
+	broker := ""
+	if c.brokers != nil {
+		broker = c.brokers.get().String()
+	}
+	c.logger.log(level, broker, message, fields...)
+}
+
+// Return an error if a topic cannot be published to
+func validatePublish(v string) error {
+	if v == "" {
+		return ErrBadParameter.With("Empty topic")
+	}
+	return topic.ValidatePublish(v)
+}
+
+// Return an error if a subscription filter is not valid
+func validateSubscribe(v string) error {
+	if v == "" {
+		return ErrBadParameter.With("Empty subscription")
+	}
+	return topic.ValidateSubscribe(v)
+}
+
+// Set the topics of a request and the granted QoS on an event
+func withGranted(evt *Event, topics []string, qos []int) *Event {
+	evt.Topics = topics
+	evt.GrantedQoS = qos
+	return evt
+}
+
+// Set the reason code and properties on an event
+func withReason(evt *Event, rc int, props Properties) *Event {
+	evt.ReasonCode = rc
+	evt.Properties = props
+	return evt
+}
+
+// Return the number of different brokers in a list
+func countBrokers(list []broker) int {
+	brokers := make(map[broker]bool, len(list))
+	for _, b := range list {
+		brokers[b] = true
+	}
+	return len(brokers)
+}
+
+// Return a duration in whole seconds, with a minimum of one second
+func seconds(d time.Duration) uint {
+	if d < time.Second {
+		return 1
+	}
+	return uint(d / time.Second)
 }
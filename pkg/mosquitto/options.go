@@ -1,11 +1,21 @@
 package mosquitto
 
+import (
+	"time"
+
+	// Packages
+	mqtt "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+)
+
 ////////////////////////////////////////////////////////////////////////////////
 // TYPES
 
 type opts struct {
-	qos    int
-	retain bool
+	qos       int
+	retain    bool
+	options   int
+	props     Properties
+	subscribe bool
 }
 
 type ClientOpt func(opts *opts)
@@ -51,9 +61,80 @@ func OptQoS(qos int) ClientOpt {
 	}
 }
 
+// Subscribe when a handler is added for a filter, and unsubscribe when
+// the last handler for the filter is removed
+func OptSubscribe() ClientOpt {
+	return func(opts *opts) {
+		opts.subscribe = true
+	}
+}
+
 // Make the message retained
 func OptRetain() ClientOpt {
 	return func(opts *opts) {
 		opts.retain = true
 	}
 }
+
+// Do not receive messages published by this client (MQTT v5 only)
+func OptNoLocal() ClientOpt {
+	return func(opts *opts) {
+		opts.options |= mqtt.MQTT_SUB_OPT_NO_LOCAL
+	}
+}
+
+// Keep the retain flag as published on received messages (MQTT v5 only)
+func OptRetainAsPublished() ClientOpt {
+	return func(opts *opts) {
+		opts.options |= mqtt.MQTT_SUB_OPT_RETAIN_AS_PUBLISHED
+	}
+}
+
+// Only send retained messages for new subscriptions (MQTT v5 only)
+func OptRetainNew() ClientOpt {
+	return func(opts *opts) {
+		opts.options |= mqtt.MQTT_SUB_OPT_SEND_RETAIN_NEW
+	}
+}
+
+// Never send retained messages on subscription (MQTT v5 only)
+func OptRetainNever() ClientOpt {
+	return func(opts *opts) {
+		opts.options |= mqtt.MQTT_SUB_OPT_SEND_RETAIN_NEVER
+	}
+}
+
+// Add a user property to a message (MQTT v5 only)
+func OptUserProperty(name, value string) ClientOpt {
+	return func(opts *opts) {
+		opts.props.UserProperties = append(opts.props.UserProperties, UserProperty{name, value})
+	}
+}
+
+// Set the content type of a message (MQTT v5 only)
+func OptContentType(v string) ClientOpt {
+	return func(opts *opts) {
+		opts.props.ContentType = v
+	}
+}
+
+// Set the lifetime of a message, rounded to seconds (MQTT v5 only)
+func OptMessageExpiry(v time.Duration) ClientOpt {
+	return func(opts *opts) {
+		opts.props.MessageExpiry = v
+	}
+}
+
+// Set the topic for a response to a message (MQTT v5 only)
+func OptResponseTopic(v string) ClientOpt {
+	return func(opts *opts) {
+		opts.props.ResponseTopic = v
+	}
+}
+
+// Set the correlation data for a response to a message (MQTT v5 only)
+func OptCorrelationData(v []byte) ClientOpt {
+	return func(opts *opts) {
+		opts.props.CorrelationData = v
+	}
+}
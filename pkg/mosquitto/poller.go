@@ -0,0 +1,318 @@
+//go:build linux
+// +build linux
+
+package mosquitto
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Poller runs the network loop for many clients in one goroutine, waiting
+// for the sockets of the clients to be ready with epoll
+type Poller struct {
+	sync.Mutex
+	sync.WaitGroup
+	epfd    int
+	pipe    [2]int
+	closed  bool
+	clients map[*Client]*polled
+	sockets map[int]*Client
+}
+
+// polled is the state of a client in the poller. Apart from closing, which
+// is set by stop, it is only accessed by the poller goroutine
+type polled struct {
+	socket  int
+	events  uint32
+	misc    time.Time
+	retry   time.Time
+	broker  broker
+	closing bool
+	expires time.Time
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Maximum number of events returned by each wait
+	pollerEvents = 128
+
+	// Interval between calls to loop misc, for keepalive
+	pollerMisc = time.Second
+
+	// Time to wait for a client to disconnect
+	pollerDisconnect = time.Second
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewPoller returns a poller, which can be shared by many clients with
+// Config.WithPoller. Close the poller after all the clients are closed
+func NewPoller() (*Poller, error) {
+	p := new(Poller)
+	p.clients = make(map[*Client]*polled)
+	p.sockets = make(map[int]*Client)
+
+	// Create epoll and a pipe to wake the poller
+	if fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, err
+	} else {
+		p.epfd = fd
+	}
+	if err := syscall.Pipe2(p.pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(p.epfd)
+		return nil, err
+	}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, p.pipe[0], &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.pipe[0])}); err != nil {
+		p.closefds()
+		return nil, err
+	}
+
+	// Run the poller in the background
+	p.WaitGroup.Add(1)
+	go p.run()
+
+	// Return success
+	return p, nil
+}
+
+// Close stops the poller. Any clients which have not been closed no
+// longer receive events
+func (p *Poller) Close() error {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return ErrOutOfOrder.With("Poller is closed")
+	}
+	p.closed = true
+	p.Unlock()
+
+	// Wait for the poller to stop, and release any clients waiting to stop
+	p.signal()
+	p.WaitGroup.Wait()
+	p.Lock()
+	for c := range p.clients {
+		delete(p.clients, c)
+		c.WaitGroup.Done()
+	}
+	p.Unlock()
+
+	// Close file descriptors
+	return p.closefds()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LOOP
+
+func (p *Poller) start(c *Client) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return ErrOutOfOrder.With("Poller is closed")
+	} else if _, ok := c.client.(socketBackend); !ok {
+		return ErrNotImplemented.With("Poller is not supported by the backend")
+	}
+	c.WaitGroup.Add(1)
+	p.clients[c] = &polled{socket: -1}
+	p.signal()
+	return nil
+}
+
+func (p *Poller) stop(c *Client) error {
+	p.Lock()
+	if state, exists := p.clients[c]; exists {
+		state.closing = true
+	}
+	p.Unlock()
+	p.signal()
+	c.WaitGroup.Wait()
+	return nil
+}
+
+func (p *Poller) wake(c *Client) {
+	p.signal()
+}
+
+func (p *Poller) failover() bool {
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Wake the poller by writing to the pipe. When the pipe is full, the
+// poller is already awake
+func (p *Poller) signal() {
+	syscall.Write(p.pipe[1], []byte{0})
+}
+
+func (p *Poller) closefds() error {
+	var result error
+	for _, fd := range []int{p.pipe[0], p.pipe[1], p.epfd} {
+		if err := syscall.Close(fd); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (p *Poller) run() {
+	defer p.WaitGroup.Done()
+	events := make([]syscall.EpollEvent, pollerEvents)
+	for {
+		// Take a copy of the clients
+		p.Lock()
+		if p.closed {
+			p.Unlock()
+			return
+		}
+		clients := make(map[*Client]*polled, len(p.clients))
+		closing := make(map[*Client]bool, len(p.clients))
+		for c, state := range p.clients {
+			clients[c], closing[c] = state, state.closing
+		}
+		p.Unlock()
+
+		// Remove sockets which have changed before adding any, as the
+		// library may reuse a socket for a different client
+		now := time.Now()
+		for c, state := range clients {
+			if p.update(c, state, closing[c], now) {
+				delete(clients, c)
+			}
+		}
+		for c, state := range clients {
+			p.register(c, state, closing[c], now)
+		}
+
+		// Wait for sockets to be ready
+		n, err := syscall.EpollWait(p.epfd, events, int(loopTimeout.Milliseconds()))
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			time.Sleep(loopTimeout)
+			continue
+		}
+
+		// Read and write packets
+		for _, event := range events[:n] {
+			fd := int(event.Fd)
+			if fd == p.pipe[0] {
+				p.drain()
+				continue
+			}
+			c := p.sockets[fd]
+			if c == nil {
+				continue
+			}
+			var err error
+			if event.Events&(syscall.EPOLLIN|syscall.EPOLLERR|syscall.EPOLLHUP) != 0 {
+				err = c.client.(socketBackend).loopRead()
+			}
+			if err == nil && event.Events&syscall.EPOLLOUT != 0 {
+				c.client.(socketBackend).loopWrite()
+			}
+		}
+	}
+}
+
+// update removes a closed client and returns true, or removes the socket
+// of a client when it has changed
+func (p *Poller) update(c *Client, state *polled, closing bool, now time.Time) bool {
+	socket := c.client.(socketBackend).socket()
+
+	// Remove the previous socket
+	if state.socket >= 0 && socket != state.socket {
+		syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, state.socket, nil)
+		if p.sockets[state.socket] == c {
+			delete(p.sockets, state.socket)
+		}
+		state.socket, state.events = -1, 0
+	}
+
+	// Remove the client once disconnected
+	if closing {
+		if state.expires.IsZero() {
+			state.expires = now.Add(pollerDisconnect)
+		}
+		if socket < 0 || now.After(state.expires) {
+			if state.socket >= 0 {
+				syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, state.socket, nil)
+				delete(p.sockets, state.socket)
+			}
+			p.Lock()
+			delete(p.clients, c)
+			p.Unlock()
+			c.WaitGroup.Done()
+			return true
+		}
+	}
+
+	// Client remains
+	return false
+}
+
+// register the socket of a client, with the events it is waiting for,
+// reconnect when disconnected, and perform keepalive
+func (p *Poller) register(c *Client, state *polled, closing bool, now time.Time) {
+	socket := c.client.(socketBackend).socket()
+
+	// Reconnect after a delay
+	if socket < 0 && !closing && c.running() {
+		if state.retry.IsZero() {
+			var delay time.Duration
+			delay, state.broker = c.brokers.next()
+			state.retry = now.Add(delay)
+		} else if now.After(state.retry) {
+			state.retry = time.Time{}
+			ctx, cancel := c.context()
+			c.connect(ctx, state.broker)
+			cancel()
+			socket = c.client.(socketBackend).socket()
+		}
+	}
+
+	// Add or modify the socket
+	if socket >= 0 {
+		events := uint32(syscall.EPOLLIN)
+		if c.client.(socketBackend).wantWrite() {
+			events |= syscall.EPOLLOUT
+		}
+		if state.socket < 0 {
+			if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, socket, &syscall.EpollEvent{Events: events, Fd: int32(socket)}); err == nil {
+				state.socket, state.events = socket, events
+				p.sockets[socket] = c
+			}
+		} else if events != state.events {
+			if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, socket, &syscall.EpollEvent{Events: events, Fd: int32(socket)}); err == nil {
+				state.events = events
+			}
+		}
+	}
+
+	// Perform keepalive
+	if now.Sub(state.misc) >= pollerMisc {
+		state.misc = now
+		c.client.(socketBackend).loopMisc()
+	}
+}
+
+// Read from the pipe until empty
+func (p *Poller) drain() {
+	buf := make([]byte, 64)
+	for {
+		if n, err := syscall.Read(p.pipe[0], buf); n <= 0 || err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !linux
+// +build !linux
+
+package mosquitto
+
+import (
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Poller runs the network loop for many clients in one goroutine, which
+// requires epoll and is only supported on linux
+type Poller struct{}
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewPoller returns an error, as epoll is not supported
+func NewPoller() (*Poller, error) {
+	return nil, ErrNotImplemented.With("NewPoller")
+}
+
+func (p *Poller) Close() error {
+	return ErrNotImplemented.With("Close")
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LOOP
+
+func (p *Poller) start(c *Client) error {
+	return ErrNotImplemented.With("Poller")
+}
+
+func (p *Poller) stop(c *Client) error {
+	return nil
+}
+
+func (p *Poller) wake(c *Client) {}
+
+func (p *Poller) failover() bool {
+	return true
+}
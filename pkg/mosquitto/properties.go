@@ -0,0 +1,87 @@
+package mosquitto
+
+import (
+	"fmt"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Properties are the MQTT v5 properties which are sent with a message or
+// received from the broker. Empty values are not sent.
+type Properties struct {
+	ContentType      string         // Content type of the payload
+	ResponseTopic    string         // Topic for a response to the message
+	CorrelationData  []byte         // Correlation data for a response
+	MessageExpiry    time.Duration  // Lifetime of the message
+	PayloadFormat    int            // Set to 1 when the payload is UTF-8
+	SubscriptionIds  []int          // Subscription identifiers of a received message, or of a subscribe request
+	AssignedClientId string         // Client identifier assigned by the broker
+	SessionExpiry    time.Duration  // Session expiry interval
+	WillDelay        time.Duration  // Delay before the broker publishes a will message
+	ServerKeepAlive  time.Duration  // Keepalive set by the broker
+	ReasonString     string         // Human-readable reason for a response
+	ServerReference  string         // Another broker to use
+	UserProperties   []UserProperty // Name and value pairs
+}
+
+// UserProperty is a name and value pair. A name can appear more than once.
+type UserProperty struct {
+	Name  string
+	Value string
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// UserProperty returns the first user property value for a name, or false
+// if there is no such property
+func (p Properties) UserProperty(name string) (string, bool) {
+	for _, prop := range p.UserProperties {
+		if prop.Name == name {
+			return prop.Value, true
+		}
+	}
+	return "", false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (p Properties) String() string {
+	str := ""
+	if p.ContentType != "" {
+		str += fmt.Sprintf(" content_type=%q", p.ContentType)
+	}
+	if p.ResponseTopic != "" {
+		str += fmt.Sprintf(" response_topic=%q", p.ResponseTopic)
+	}
+	if len(p.CorrelationData) > 0 {
+		str += fmt.Sprintf(" correlation_data=%q", p.CorrelationData)
+	}
+	if p.MessageExpiry > 0 {
+		str += fmt.Sprint(" message_expiry=", p.MessageExpiry)
+	}
+	if p.AssignedClientId != "" {
+		str += fmt.Sprintf(" assigned_client_id=%q", p.AssignedClientId)
+	}
+	if p.ReasonString != "" {
+		str += fmt.Sprintf(" reason=%q", p.ReasonString)
+	}
+	for _, prop := range p.UserProperties {
+		str += fmt.Sprintf(" %s=%q", prop.Name, prop.Value)
+	}
+	return str
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return true if no properties have been set
+func (p Properties) empty() bool {
+	return p.ContentType == "" && p.ResponseTopic == "" && len(p.CorrelationData) == 0 &&
+		p.MessageExpiry == 0 && p.PayloadFormat == 0 && len(p.SubscriptionIds) == 0 &&
+		p.AssignedClientId == "" && p.SessionExpiry == 0 && p.WillDelay == 0 && p.ServerKeepAlive == 0 &&
+		p.ReasonString == "" && p.ServerReference == "" && len(p.UserProperties) == 0
+}
@@ -0,0 +1,418 @@
+package mosquitto
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Policy is what a queue does with an event when it is full
+type Policy uint
+
+// DropFunc is called with each event which a queue drops
+type DropFunc func(*Event)
+
+// QueueConfig is the configuration of a queue
+type QueueConfig struct {
+	capacity int
+	policy   Policy
+	dir      string
+	drop     DropFunc
+}
+
+// Queue is a bounded queue of events between the network loop, which puts
+// events, and a consumer which receives events from a channel. When the
+// queue is full, the policy decides whether to wait, drop an event or
+// write events to a file until there is space
+type Queue struct {
+	sync.Mutex
+	cond    *sync.Cond // Signalled when events are put or taken, and on close
+	cfg     QueueConfig
+	items   []*Event
+	spill   *spill
+	out     chan *Event
+	done    chan struct{}
+	closed  bool
+	dropped uint64
+}
+
+// spill is a file of events, encoded as JSON lines, which are read in the
+// order they were written
+type spill struct {
+	w     *os.File
+	r     *os.File
+	br    *bufio.Reader
+	count int
+}
+
+// spillEvent is an event with the error as a string
+type spillEvent struct {
+	*Event
+	Err string `json:",omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	PolicyBlock      Policy = iota // Wait until there is space, which holds up the network loop
+	PolicyDropNewest               // Drop the event being put
+	PolicyDropOldest               // Drop the oldest event in the queue
+	PolicySpill                    // Write events to a file until there is space
+)
+
+const (
+	// Pattern of the name of a spill file
+	spillPattern = "mosquitto-queue-*.jsonl"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CONFIGURATION OPTIONS
+
+// NewQueueConfig returns the configuration for a queue with a capacity,
+// which waits for space when full
+func NewQueueConfig(capacity int) QueueConfig {
+	return QueueConfig{capacity: capacity}
+}
+
+// WithPolicy sets what the queue does with an event when it is full
+func (c QueueConfig) WithPolicy(v Policy) QueueConfig {
+	c.policy = v
+	return c
+}
+
+// WithSpill writes events to a file in a directory when the queue is full,
+// until there is space. An empty directory uses the temporary directory
+func (c QueueConfig) WithSpill(dir string) QueueConfig {
+	c.policy = PolicySpill
+	c.dir = dir
+	return c
+}
+
+// WithDrop sets a function which is called with each event which is dropped
+func (c QueueConfig) WithDrop(fn DropFunc) QueueConfig {
+	c.drop = fn
+	return c
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewQueue returns a queue, which needs to be closed when done
+func NewQueue(cfg QueueConfig) (*Queue, error) {
+	q := new(Queue)
+	if cfg.capacity <= 0 {
+		return nil, ErrBadParameter.With("Queue capacity: ", cfg.capacity)
+	} else if cfg.policy > PolicySpill {
+		return nil, ErrBadParameter.With("Queue policy: ", cfg.policy)
+	} else {
+		q.cfg = cfg
+		q.cond = sync.NewCond(&q.Mutex)
+		q.items = make([]*Event, 0, cfg.capacity)
+		q.out = make(chan *Event)
+		q.done = make(chan struct{})
+	}
+
+	// Create the spill file
+	if cfg.policy == PolicySpill {
+		if spill, err := newSpill(cfg.dir); err != nil {
+			return nil, err
+		} else {
+			q.spill = spill
+		}
+	}
+
+	// Move events from the queue to the channel in the background
+	go q.run()
+
+	// Return success
+	return q, nil
+}
+
+// Close the queue, and the channel of events. Events which have not been
+// received are discarded, and the spill file is removed
+func (q *Queue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return ErrOutOfOrder.With("Queue is closed")
+	}
+	q.closed = true
+	q.items = nil
+	close(q.done)
+	q.cond.Broadcast()
+	if q.spill != nil {
+		return q.spill.close()
+	}
+	return nil
+}
+
+// ParsePolicy returns a policy from a name, which is one of "block",
+// "drop-newest", "drop-oldest" or "spill"
+func ParsePolicy(v string) (Policy, error) {
+	name := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(v)))
+	switch strings.TrimPrefix(name, "policy") {
+	case "block":
+		return PolicyBlock, nil
+	case "dropnewest":
+		return PolicyDropNewest, nil
+	case "dropoldest":
+		return PolicyDropOldest, nil
+	case "spill":
+		return PolicySpill, nil
+	default:
+		return 0, ErrBadParameter.With("Policy: ", v)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyBlock:
+		return "PolicyBlock"
+	case PolicyDropNewest:
+		return "PolicyDropNewest"
+	case PolicyDropOldest:
+		return "PolicyDropOldest"
+	case PolicySpill:
+		return "PolicySpill"
+	default:
+		return "[?? Invalid Policy value]"
+	}
+}
+
+func (q *Queue) String() string {
+	str := "<queue"
+	str += fmt.Sprint(" policy=", q.cfg.policy)
+	str += fmt.Sprint(" capacity=", q.cfg.capacity)
+	str += fmt.Sprint(" len=", q.Len())
+	if dropped := q.Dropped(); dropped > 0 {
+		str += fmt.Sprint(" dropped=", dropped)
+	}
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// C returns the channel which receives events in the order they were put,
+// and which is closed when the queue is closed
+func (q *Queue) C() <-chan *Event {
+	return q.out
+}
+
+// Len returns the number of events waiting to be received, including
+// events in the spill file
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	n := len(q.items)
+	if q.spill != nil {
+		n += q.spill.count
+	}
+	return n
+}
+
+// Dropped returns the number of events which have been dropped
+func (q *Queue) Dropped() uint64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.dropped
+}
+
+// Put an event in the queue. Returns false if the event was dropped, or the
+// queue is closed. With PolicyBlock, waits until there is space or the
+// queue is closed
+func (q *Queue) Put(evt *Event) bool {
+	q.Lock()
+	for {
+		if q.closed {
+			q.Unlock()
+			return false
+		}
+
+		// Put the event in memory when there is space, and no events are
+		// waiting in the spill file
+		if len(q.items) < q.cfg.capacity && (q.spill == nil || q.spill.count == 0) {
+			q.items = append(q.items, evt)
+			q.cond.Broadcast()
+			q.Unlock()
+			return true
+		}
+
+		// Otherwise apply the policy
+		switch q.cfg.policy {
+		case PolicyBlock:
+			q.cond.Wait()
+		case PolicyDropOldest:
+			oldest := q.items[0]
+			q.items = append(q.items[1:], evt)
+			q.cond.Broadcast()
+			q.Unlock()
+			q.drop(oldest)
+			return true
+		case PolicySpill:
+			if err := q.spill.write(evt); err == nil {
+				q.cond.Broadcast()
+				q.Unlock()
+				return true
+			}
+			q.Unlock()
+			q.drop(evt)
+			return false
+		default:
+			q.Unlock()
+			q.drop(evt)
+			return false
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Send events to the channel until the queue is closed
+func (q *Queue) run() {
+	defer close(q.out)
+	for {
+		q.Lock()
+		for len(q.items) == 0 && !q.closed {
+			if q.spill != nil && q.spill.count > 0 {
+				q.refill()
+			} else {
+				q.cond.Wait()
+			}
+		}
+		if q.closed {
+			q.Unlock()
+			return
+		}
+		evt := q.items[0]
+		q.items[0] = nil
+		q.items = q.items[1:]
+		q.cond.Broadcast()
+		q.Unlock()
+
+		select {
+		case q.out <- evt:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Read events from the spill file into memory, up to the capacity. If the
+// file cannot be read, the events in the file are dropped
+func (q *Queue) refill() {
+	for len(q.items) < q.cfg.capacity && q.spill.count > 0 {
+		if evt, err := q.spill.read(); err != nil {
+			q.dropped += uint64(q.spill.count)
+			q.spill.reset()
+		} else {
+			q.items = append(q.items, evt)
+		}
+	}
+	q.cond.Broadcast()
+}
+
+// Count a dropped event, and call the drop function
+func (q *Queue) drop(evt *Event) {
+	q.Lock()
+	q.dropped++
+	q.Unlock()
+	if q.cfg.drop != nil {
+		q.cfg.drop(evt)
+	}
+}
+
+// Create a spill file in a directory
+func newSpill(dir string) (*spill, error) {
+	w, err := ioutil.TempFile(dir, spillPattern)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+	return &spill{w: w, r: r, br: bufio.NewReader(r)}, nil
+}
+
+// Write an event to the end of the file
+func (s *spill) write(evt *Event) error {
+	v := spillEvent{Event: evt}
+	if evt.Err != nil {
+		v.Err = evt.Err.Error()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// Read the next event from the file, and empty the file when all events
+// have been read
+func (s *spill) read() (*Event, error) {
+	line, err := s.br.ReadBytes('\n')
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	v := spillEvent{Event: new(Event)}
+	if err := json.Unmarshal(line, &v); err != nil {
+		return nil, err
+	}
+	if v.Err != "" {
+		v.Event.Err = errors.New(v.Err)
+	}
+	if s.count--; s.count == 0 {
+		s.reset()
+	}
+	return v.Event, nil
+}
+
+// Empty the file, and read from the start
+func (s *spill) reset() {
+	s.count = 0
+	s.w.Truncate(0)
+	s.w.Seek(0, io.SeekStart)
+	s.r.Seek(0, io.SeekStart)
+	s.br.Reset(s.r)
+}
+
+// Close and remove the file
+func (s *spill) close() error {
+	var result error
+	if err := s.r.Close(); err != nil {
+		result = err
+	}
+	if err := s.w.Close(); err != nil && result == nil {
+		result = err
+	}
+	if err := os.Remove(s.w.Name()); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package mosquitto
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// broker is a host and port to connect to
+type broker struct {
+	host string
+	port uint
+}
+
+// reconnect is the delay between attempts to reconnect. When max is greater
+// than initial the delay increases with each attempt, either linearly or
+// exponentially, and a random jitter is added
+type reconnect struct {
+	initial     time.Duration
+	max         time.Duration
+	exponential bool
+	jitter      time.Duration
+}
+
+// brokers is a list of brokers to connect to, with the number of
+// consecutive failures of each broker and the number of attempts to
+// reconnect since the client was last connected
+type brokers struct {
+	sync.Mutex
+	reconnect
+	brokers  []broker
+	failures []int
+	current  int
+	attempts int
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Minimum delay between attempts to reconnect
+	minReconnectDelay = 100 * time.Millisecond
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newBrokers(list []broker, r reconnect) *brokers {
+	return &brokers{
+		reconnect: r,
+		brokers:   list,
+		failures:  make([]int, len(list)),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (b broker) String() string {
+	if b.unix() {
+		return b.host
+	}
+	return net.JoinHostPort(b.host, strconv.FormatUint(uint64(b.port), 10))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// unix returns true if the broker is a path to a unix socket, which
+// is connected to with a zero port
+func (b broker) unix() bool {
+	return strings.HasPrefix(b.host, "/")
+}
+
+// get returns the broker currently in use
+func (b *brokers) get() broker {
+	b.Lock()
+	defer b.Unlock()
+	return b.brokers[b.current]
+}
+
+// connected resets the failures of the current broker and the attempts
+func (b *brokers) connected() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures[b.current] = 0
+	b.attempts = 0
+}
+
+// next records a failure of the current broker, and returns the delay
+// before reconnecting and the broker to reconnect to. The broker is the
+// one with fewest consecutive failures, starting after the current broker
+// so that brokers with equal failures are used in turn, and the current
+// broker is used again only when it has the fewest failures
+func (b *brokers) next() (time.Duration, broker) {
+	b.Lock()
+	defer b.Unlock()
+	b.failures[b.current]++
+	next := -1
+	for i := 1; i <= len(b.brokers); i++ {
+		j := (b.current + i) % len(b.brokers)
+		if next < 0 || b.failures[j] < b.failures[next] {
+			next = j
+		}
+	}
+	b.current = next
+	b.attempts++
+	return b.delay(b.attempts), b.brokers[next]
+}
+
+// delay returns the delay before an attempt to reconnect, which is at
+// least the minimum delay
+func (r reconnect) delay(attempt int) time.Duration {
+	delay := r.initial
+	if delay < minReconnectDelay {
+		delay = minReconnectDelay
+	}
+	if r.max > delay {
+		for i := 1; i < attempt && delay < r.max; i++ {
+			if r.exponential {
+				delay *= 2
+			} else {
+				delay += r.initial
+			}
+		}
+		if delay > r.max {
+			delay = r.max
+		}
+	}
+	if r.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(r.jitter)))
+	}
+	return delay
+}
@@ -0,0 +1,157 @@
+package mosquitto
+
+import (
+	"sort"
+	"sync"
+
+	// Packages
+	topic "github.com/mutablelogic/go-mosquitto/pkg/topic"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// router dispatches message events to the handlers for each subscription
+// filter which matches the topic of the message. A broker can send a
+// message once for each matching subscription, so with MQTT v5 each handler
+// is called for the copy with the subscription identifier of its filter
+type router struct {
+	sync.RWMutex
+	next    int
+	routes  map[string]*route
+	filters map[int]string
+}
+
+type route struct {
+	handlers   map[int]EventFunc
+	subscribed bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newRouter() *router {
+	return &router{
+		routes:  make(map[string]*route),
+		filters: make(map[int]string),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// add a handler for a filter and return the handler id. Returns true if
+// the filter should be subscribed to, which is when subscribe is set and
+// the filter has not already been subscribed to by the router
+func (r *router) add(filter string, fn EventFunc, subscribe bool) (int, bool) {
+	r.Lock()
+	defer r.Unlock()
+	rt, exists := r.routes[filter]
+	if !exists {
+		rt = &route{handlers: make(map[int]EventFunc)}
+		r.routes[filter] = rt
+	}
+	r.next++
+	rt.handlers[r.next] = fn
+	r.filters[r.next] = filter
+	if subscribe && !rt.subscribed {
+		rt.subscribed = true
+		return r.next, true
+	} else {
+		return r.next, false
+	}
+}
+
+// remove a handler and return the filter. Returns true if the filter should
+// be unsubscribed from, which is when the last handler has been removed and
+// the filter was subscribed to by the router
+func (r *router) remove(id int) (string, bool, bool) {
+	r.Lock()
+	defer r.Unlock()
+	filter, exists := r.filters[id]
+	if !exists {
+		return "", false, false
+	}
+	rt := r.routes[filter]
+	delete(r.filters, id)
+	delete(rt.handlers, id)
+	if len(rt.handlers) > 0 {
+		return filter, false, true
+	}
+	delete(r.routes, filter)
+	return filter, rt.subscribed, true
+}
+
+// fail removes a handler when the subscription for the filter failed
+func (r *router) fail(id int) {
+	r.Lock()
+	defer r.Unlock()
+	if filter, exists := r.filters[id]; exists {
+		rt := r.routes[filter]
+		rt.subscribed = false
+		delete(r.filters, id)
+		delete(rt.handlers, id)
+		if len(rt.handlers) == 0 {
+			delete(r.routes, filter)
+		}
+	}
+}
+
+// dispatch a message event to every handler with a matching filter, in the
+// order the handlers were added, with the subscriptions which match the
+// topic of the message. Handlers are called outside of the lock so handlers
+// can add and remove handlers. Without subscription identifiers, which is
+// always the case with MQTT v3, every message received is dispatched
+func (r *router) dispatch(evt *Event, subscribed map[string]int) {
+	r.RLock()
+	ids := make([]int, 0, len(r.filters))
+	fns := make(map[int]EventFunc, len(r.filters))
+	for filter, rt := range r.routes {
+		if match, err := topic.Match(filter, evt.Topic); err != nil || !match {
+			continue
+		} else if !delivers(filter, evt.SubscriptionIds, subscribed) {
+			continue
+		}
+		for id, fn := range rt.handlers {
+			ids = append(ids, id)
+			fns[id] = fn
+		}
+	}
+	r.RUnlock()
+
+	sort.Ints(ids)
+	for _, id := range ids {
+		fns[id](evt)
+	}
+}
+
+// delivers returns true if the copy of a message with subscription
+// identifiers is the copy for the handlers of a filter. This is the copy
+// for the subscription to the filter or, when the filter is not subscribed
+// to, the copy for the first matching subscription in order of topic.
+// Without subscription identifiers, or when none are known, every copy is
+// delivered
+func delivers(filter string, ids []int, subscribed map[string]int) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	want := subscribed[filter]
+	if want == 0 {
+		first := ""
+		for v, id := range subscribed {
+			if id > 0 && (first == "" || v < first) {
+				first, want = v, id
+			}
+		}
+	}
+	known := false
+	for _, id := range ids {
+		if id == want {
+			return true
+		}
+		for _, v := range subscribed {
+			known = known || (v > 0 && v == id)
+		}
+	}
+	return !known
+}
@@ -0,0 +1,213 @@
+package mosquitto
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// State of the connection to the broker
+type State uint
+
+// Transition from one state to another, with the error which caused the
+// transition, if any
+type Transition struct {
+	From State
+	To   State
+	Err  error
+	Time time.Time
+}
+
+// state is the current state of a client, which notifies subscribers
+// on each transition
+type state struct {
+	sync.Mutex
+	state       State
+	since       time.Time
+	changed     chan struct{}
+	closed      chan struct{}
+	subscribers map[chan Transition]struct{}
+	dropped     uint64
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateReconnecting
+	StateDisconnecting
+	StateClosed
+)
+
+const (
+	// Capacity of a transition channel
+	transitionCapacity = 16
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newState() *state {
+	return &state{
+		state:       StateConnecting,
+		since:       time.Now(),
+		changed:     make(chan struct{}),
+		closed:      make(chan struct{}),
+		subscribers: make(map[chan Transition]struct{}),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "StateConnecting"
+	case StateConnected:
+		return "StateConnected"
+	case StateReconnecting:
+		return "StateReconnecting"
+	case StateDisconnecting:
+		return "StateDisconnecting"
+	case StateClosed:
+		return "StateClosed"
+	default:
+		return "[?? Invalid State value]"
+	}
+}
+
+func (t Transition) String() string {
+	str := "<transition"
+	str += " from=" + t.From.String()
+	str += " to=" + t.To.String()
+	if t.Err != nil {
+		str += " err=" + t.Err.Error()
+	}
+	if !t.Time.IsZero() {
+		str += " time=" + t.Time.Format(time.RFC3339)
+	}
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// get returns the current state and the time it was entered
+func (s *state) get() (State, time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	return s.state, s.since
+}
+
+// set changes the state and notifies subscribers. A transition to the same
+// state is only made when there is an error to report. Once disconnecting,
+// the only transition is to closed, and once closed the state cannot change
+func (s *state) set(to State, err error) bool {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case s.state == StateClosed:
+		return false
+	case s.state == StateDisconnecting && to != StateClosed:
+		return false
+	case s.state == to && err == nil:
+		return false
+	}
+
+	t := Transition{From: s.state, To: to, Err: err, Time: time.Now()}
+	s.state, s.since = to, t.Time
+
+	// Wake up any waiters
+	close(s.changed)
+	s.changed = make(chan struct{})
+	if to == StateClosed {
+		close(s.closed)
+	}
+
+	// Notify subscribers, dropping the transition for any subscriber
+	// which is not keeping up. Close subscribers when closed
+	for ch := range s.subscribers {
+		select {
+		case ch <- t:
+		default:
+			s.dropped++
+		}
+		if to == StateClosed {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	// Return success
+	return true
+}
+
+// wait blocks until the state is reached, the context is done or the state
+// is closed
+func (s *state) wait(ctx context.Context, to State) error {
+	for {
+		s.Lock()
+		state, changed := s.state, s.changed
+		s.Unlock()
+		if state == to {
+			return nil
+		} else if state == StateClosed {
+			return ErrOutOfOrder.With("Client is closed")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// subscribe returns a channel which receives transitions, and which is
+// closed when the state is closed or unsubscribe is called. The channel
+// is also closed when the context is done, if not nil
+func (s *state) subscribe(ctx context.Context) chan Transition {
+	s.Lock()
+	defer s.Unlock()
+	ch := make(chan Transition, transitionCapacity)
+	if s.state == StateClosed {
+		close(ch)
+	} else {
+		s.subscribers[ch] = struct{}{}
+		if ctx != nil {
+			go func() {
+				select {
+				case <-ctx.Done():
+					s.unsubscribe(ch)
+				case <-s.closed:
+				}
+			}()
+		}
+	}
+	return ch
+}
+
+func (s *state) unsubscribe(ch chan Transition) {
+	s.Lock()
+	defer s.Unlock()
+	if _, exists := s.subscribers[ch]; exists {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// drops returns the number of transitions dropped as subscribers did not
+// keep up
+func (s *state) drops() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.dropped
+}
@@ -0,0 +1,224 @@
+package mosquitto
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Stats is a snapshot of the counters of a connection
+type Stats struct {
+	Sent          [3]Counter // Messages and bytes published, by QoS
+	Received      [3]Counter // Messages and bytes received, by QoS
+	Latency       Histogram  // Time from publish to acknowledgement
+	Reconnects    uint64     // Connections after the first connection
+	Dropped       uint64     // Events and transitions dropped as receivers did not keep up
+	Inflight      int        // Messages published and not yet acknowledged
+	LastConnected time.Time  // Time of the last connection, or zero
+}
+
+// Counter is the number of messages and bytes
+type Counter struct {
+	Messages uint64
+	Bytes    uint64
+}
+
+// Histogram is a distribution of durations. Counts are cumulative, so
+// Counts[i] is the number of durations less than or equal to Buckets[i],
+// and Count is the number of all durations
+type Histogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// metrics are the counters of a connection, which are updated by requests
+// and by the loop
+type metrics struct {
+	sync.Mutex
+	stats   Stats
+	pending map[int]time.Time // Time each publish request was sent
+	early   map[int]time.Time // Acknowledgements received before the request returned
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Acknowledgements without a request are forgotten after this time, and
+	// no more than this number are kept
+	earlyExpiry = 10 * time.Second
+	earlyMax    = 1000
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// GLOBALS
+
+var (
+	// Upper bounds of the latency histogram
+	latencyBuckets = []time.Duration{
+		time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+		25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+		250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+		2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+	}
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newMetrics() *metrics {
+	m := new(metrics)
+	m.stats.Latency.Buckets = latencyBuckets
+	m.stats.Latency.Counts = make([]uint64, len(latencyBuckets))
+	m.pending = make(map[int]time.Time)
+	m.early = make(map[int]time.Time)
+	return m
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (s Stats) String() string {
+	str := "<stats"
+	for qos, c := range s.Sent {
+		if c.Messages > 0 {
+			str += fmt.Sprintf(" sent[%d]=%d/%dB", qos, c.Messages, c.Bytes)
+		}
+	}
+	for qos, c := range s.Received {
+		if c.Messages > 0 {
+			str += fmt.Sprintf(" received[%d]=%d/%dB", qos, c.Messages, c.Bytes)
+		}
+	}
+	if s.Latency.Count > 0 {
+		str += fmt.Sprint(" latency=", s.Latency.Mean())
+	}
+	if s.Reconnects > 0 {
+		str += fmt.Sprint(" reconnects=", s.Reconnects)
+	}
+	if s.Dropped > 0 {
+		str += fmt.Sprint(" dropped=", s.Dropped)
+	}
+	if s.Inflight > 0 {
+		str += fmt.Sprint(" inflight=", s.Inflight)
+	}
+	if !s.LastConnected.IsZero() {
+		str += fmt.Sprint(" last_connected=", s.LastConnected.Format(time.RFC3339))
+	}
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Mean returns the mean duration, or zero if there are no durations
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return a snapshot of the counters
+func (m *metrics) get() Stats {
+	m.Lock()
+	defer m.Unlock()
+	s := m.stats
+	s.Latency.Counts = append([]uint64{}, m.stats.Latency.Counts...)
+	s.Inflight = len(m.pending)
+	return s
+}
+
+// Record a message published with a QoS, which was sent at a time. The
+// broker may acknowledge the message before the request returns
+func (m *metrics) sent(id, qos, size int, t time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	if qos >= 0 && qos < len(m.stats.Sent) {
+		m.stats.Sent[qos].Messages++
+		m.stats.Sent[qos].Bytes += uint64(size)
+	}
+	if ack, exists := m.early[id]; exists {
+		delete(m.early, id)
+		m.observe(ack.Sub(t))
+	} else {
+		m.pending[id] = t
+	}
+}
+
+// Record the acknowledgement of a message published, or the failure to
+// publish when err is not nil, which is not added to the latency histogram
+func (m *metrics) acked(id int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if t, exists := m.pending[id]; exists {
+		delete(m.pending, id)
+		if err == nil {
+			m.observe(time.Since(t))
+		}
+	} else if err == nil {
+		m.expire(time.Now())
+		if len(m.early) < earlyMax {
+			m.early[id] = time.Now()
+		}
+	}
+}
+
+// Record a message received with a QoS
+func (m *metrics) received(qos, size int) {
+	m.Lock()
+	defer m.Unlock()
+	if qos >= 0 && qos < len(m.stats.Received) {
+		m.stats.Received[qos].Messages++
+		m.stats.Received[qos].Bytes += uint64(size)
+	}
+}
+
+// Record a connection, which is a reconnection after the first
+func (m *metrics) connected() {
+	m.Lock()
+	defer m.Unlock()
+	if !m.stats.LastConnected.IsZero() {
+		m.stats.Reconnects++
+	}
+	m.stats.LastConnected = time.Now()
+}
+
+// Forget messages which will not be acknowledged, when the connection is
+// lost or closed
+func (m *metrics) reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.pending = make(map[int]time.Time)
+	m.early = make(map[int]time.Time)
+}
+
+// Forget acknowledgements which have not been claimed by a request, as the
+// request failed or was not a publish
+func (m *metrics) expire(now time.Time) {
+	for id, t := range m.early {
+		if now.Sub(t) > earlyExpiry {
+			delete(m.early, id)
+		}
+	}
+}
+
+// Add a duration to the latency histogram
+func (m *metrics) observe(d time.Duration) {
+	h := &m.stats.Latency
+	for i, bucket := range h.Buckets {
+		if d <= bucket {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += d
+}
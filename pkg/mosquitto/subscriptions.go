@@ -0,0 +1,103 @@
+package mosquitto
+
+import (
+	"sort"
+	"sync"
+
+	// Packages
+	topic "github.com/mutablelogic/go-mosquitto/pkg/topic"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Subscription is a topic filter which the client has subscribed to, with
+// the requested QoS and subscription options
+type Subscription struct {
+	Topic   string
+	QoS     int
+	Options int
+}
+
+// subscriptions is the set of subscriptions made by the client, which are
+// replayed when the client reconnects, and the subscription identifier of
+// each subscription with MQTT v5
+type subscriptions struct {
+	sync.Mutex
+	topics map[string]Subscription
+	ids    map[string]int
+	next   int
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		topics: make(map[string]Subscription),
+		ids:    make(map[string]int),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// add or replace subscriptions to topics
+func (s *subscriptions) add(topics []string, qos, options int) {
+	s.Lock()
+	defer s.Unlock()
+	for _, topic := range topics {
+		s.topics[topic] = Subscription{topic, qos, options}
+	}
+}
+
+// remove subscriptions to topics
+func (s *subscriptions) remove(topics []string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, topic := range topics {
+		delete(s.topics, topic)
+		delete(s.ids, topic)
+	}
+}
+
+// identify returns the subscription identifier for a topic, which is the
+// same each time the topic is subscribed to until it is unsubscribed from
+func (s *subscriptions) identify(topic string) int {
+	s.Lock()
+	defer s.Unlock()
+	if id, exists := s.ids[topic]; exists {
+		return id
+	}
+	s.next++
+	s.ids[topic] = s.next
+	return s.next
+}
+
+// match returns the subscriptions which match the topic of a message, with
+// the subscription identifier of each, or zero when there is none
+func (s *subscriptions) match(v string) map[string]int {
+	s.Lock()
+	defer s.Unlock()
+	result := make(map[string]int)
+	for filter := range s.topics {
+		if match, err := topic.Match(filter, v); err == nil && match {
+			result[filter] = s.ids[filter]
+		}
+	}
+	return result
+}
+
+// list returns the subscriptions in order of topic
+func (s *subscriptions) list() []Subscription {
+	s.Lock()
+	defer s.Unlock()
+	result := make([]Subscription, 0, len(s.topics))
+	for _, sub := range s.topics {
+		result = append(result, sub)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Topic < result[j].Topic
+	})
+	return result
+}
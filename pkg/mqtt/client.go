@@ -0,0 +1,822 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Client is a connection to an MQTT broker. The connection is driven by
+// calling Loop, which reads packets, calls the callbacks, performs
+// keepalive and returns an error when the connection is lost. Requests
+// can be made from any goroutine
+type Client struct {
+	sync.Mutex
+	wmu sync.Mutex
+
+	// Connection parameters
+	clientId string
+	clean    bool
+	version  int
+	username string
+	password []byte
+	will     *Packet
+	props    Properties
+	tls      *tls.Config
+	dialer   net.Dialer
+
+	// Current connection, which is nil when disconnected
+	conn      *conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	keepalive time.Duration
+	lastOut   time.Time
+	ping      time.Time
+
+	// Message identifiers and requests waiting for acknowledgement
+	next     uint16
+	outgoing map[uint16]*Packet // PUBLISH and PUBREL
+	requests map[uint16]PacketType
+	incoming map[uint16]*Packet // PUBLISH with QoS 2 waiting for PUBREL
+	sent     []uint16           // PUBLISH with QoS 0 written and not yet reported by Loop
+
+	// Callbacks
+	cb callbacks
+}
+
+// ConnectCallback is called when the broker acknowledges or refuses the
+// connection. Flags is MQTT_CONNACK_SESSION_PRESENT when the broker has
+// resumed a session
+type ConnectCallback func(rc ReasonCode, flags int, props Properties)
+
+// DisconnectCallback is called when the connection is closed. The error is
+// nil when the client disconnects, a ReasonCode when the broker disconnects,
+// or the reason the connection was lost
+type DisconnectCallback func(err error, props Properties)
+
+// SubscribeCallback is called when the broker acknowledges a subscribe
+// request, with the QoS granted for each topic or a failure reason code
+type SubscribeCallback func(id int, granted []int, props Properties)
+
+// UnsubscribeCallback is called when the broker acknowledges an
+// unsubscribe request
+type UnsubscribeCallback func(id int, props Properties)
+
+// PublishCallback is called when a message has been sent with QoS 0, or
+// when the broker acknowledges a message with QoS 1 or 2
+type PublishCallback func(id int, rc ReasonCode, props Properties)
+
+// MessageCallback is called with a PUBLISH packet received from the broker
+type MessageCallback func(message *Packet)
+
+// LogCallback is called with log messages
+type LogCallback func(level Level, message string)
+
+// Level is the level of a log message
+type Level int
+
+// callbacks are the functions called on events
+type callbacks struct {
+	connect     ConnectCallback
+	disconnect  DisconnectCallback
+	subscribe   SubscribeCallback
+	unsubscribe UnsubscribeCallback
+	publish     PublishCallback
+	message     MessageCallback
+	log         LogCallback
+}
+
+// conn is a network connection, with a goroutine which reads packets
+type conn struct {
+	net.Conn
+	packets chan *Packet
+	sent    chan struct{} // Signalled when a message with QoS 0 has been written
+	done    chan struct{}
+	err     error
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	MQTT_LOG_INFO    Level = 0x01
+	MQTT_LOG_NOTICE  Level = 0x02
+	MQTT_LOG_WARNING Level = 0x04
+	MQTT_LOG_ERR     Level = 0x08
+	MQTT_LOG_DEBUG   Level = 0x10
+)
+
+// Flags of a connection acknowledgement
+const (
+	MQTT_CONNACK_SESSION_PRESENT = 0x01
+)
+
+const (
+	// Timeout for writing a packet
+	writeTimeout = 10 * time.Second
+
+	// Maximum number of packets handled by each call to Loop
+	loopPackets = 100
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// New returns a client with a client identifier, which asks the broker to
+// discard any previous session when clean is true. An empty identifier is
+// assigned by the broker, which requires a clean session
+func New(clientId string, clean bool) (*Client, error) {
+	if clientId == "" && !clean {
+		return nil, ErrBadParameter.With("Client id required for a persistent session")
+	}
+	c := new(Client)
+	c.clientId = clientId
+	c.clean = clean
+	c.version = MQTT_PROTOCOL_V311
+	c.outgoing = make(map[uint16]*Packet)
+	c.requests = make(map[uint16]PacketType)
+	c.incoming = make(map[uint16]*Packet)
+	return c, nil
+}
+
+// Close the connection without sending a disconnect, and discard any
+// messages waiting for acknowledgement
+func (c *Client) Close() error {
+	c.Lock()
+	conn := c.conn
+	c.conn = nil
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.outgoing = make(map[uint16]*Packet)
+	c.requests = make(map[uint16]PacketType)
+	c.incoming = make(map[uint16]*Packet)
+	c.Unlock()
+	if conn != nil {
+		return conn.close()
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (c *Client) String() string {
+	c.Lock()
+	defer c.Unlock()
+	str := "<mqtt.client"
+	if c.clientId != "" {
+		str += fmt.Sprintf(" client_id=%q", c.clientId)
+	}
+	str += fmt.Sprint(" version=", c.version)
+	if c.conn != nil {
+		str += fmt.Sprintf(" remote=%q", c.conn.RemoteAddr())
+	}
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONFIGURATION
+
+// SetProtocol sets the protocol version, which is MQTT_PROTOCOL_V311 by
+// default. Call this before Connect
+func (c *Client) SetProtocol(version int) error {
+	switch version {
+	case MQTT_PROTOCOL_V31, MQTT_PROTOCOL_V311, MQTT_PROTOCOL_V5:
+		c.Lock()
+		defer c.Unlock()
+		c.version = version
+		return nil
+	default:
+		return ErrBadParameter.Withf("SetProtocol: %v", version)
+	}
+}
+
+// SetCredentials sets the username and password sent when connecting
+func (c *Client) SetCredentials(username, password string) {
+	c.Lock()
+	defer c.Unlock()
+	c.username = username
+	if password != "" {
+		c.password = []byte(password)
+	} else {
+		c.password = nil
+	}
+}
+
+// SetTLS sets the TLS configuration, or nil to connect without TLS. The
+// server name is set from the broker host when not set
+func (c *Client) SetTLS(config *tls.Config) {
+	c.Lock()
+	defer c.Unlock()
+	c.tls = config
+}
+
+// SetDialer sets the dialer used to connect, which can set a timeout and
+// the local address
+func (c *Client) SetDialer(dialer net.Dialer) {
+	c.Lock()
+	defer c.Unlock()
+	c.dialer = dialer
+}
+
+// SetWill sets the message published by the broker when the connection is
+// lost. Properties require MQTT v5
+func (c *Client) SetWill(topic string, payload []byte, qos int, retain bool, props Properties) error {
+	if topic == "" {
+		return ErrBadParameter.With("SetWill: empty topic")
+	} else if qos < 0 || qos > 2 {
+		return ErrBadParameter.Withf("SetWill: invalid qos %v", qos)
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.will = &Packet{Type: CMD_PUBLISH, Topic: topic, Payload: payload, QoS: qos, Retain: retain, Properties: props}
+	return nil
+}
+
+// SetConnectProperties sets the properties sent when connecting with MQTT v5
+func (c *Client) SetConnectProperties(props Properties) {
+	c.Lock()
+	defer c.Unlock()
+	c.props = props
+}
+
+// SetConnectCallback sets the function called on connection acknowledgement
+func (c *Client) SetConnectCallback(fn ConnectCallback) {
+	c.Lock()
+	defer c.Unlock()
+	c.cb.connect = fn
+}
+
+// SetDisconnectCallback sets the function called when the connection closes
+func (c *Client) SetDisconnectCallback(fn DisconnectCallback) {
+	c.Lock()
+	defer c.Unlock()
+	c.cb.disconnect = fn
+}
+
+// SetSubscribeCallback sets the function called on subscribe acknowledgement
+func (c *Client) SetSubscribeCallback(fn SubscribeCallback) {
+	c.Lock()
+	defer c.Unlock()
+	c.cb.subscribe = fn
+}
+
+// SetUnsubscribeCallback sets the function called on unsubscribe
+// acknowledgement
+func (c *Client) SetUnsubscribeCallback(fn UnsubscribeCallback) {
+	c.Lock()
+	defer c.Unlock()
+	c.cb.unsubscribe = fn
+}
+
+// SetPublishCallback sets the function called when a message is published
+func (c *Client) SetPublishCallback(fn PublishCallback) {
+	c.Lock()
+	defer c.Unlock()
+	c.cb.publish = fn
+}
+
+// SetMessageCallback sets the function called when a message is received
+func (c *Client) SetMessageCallback(fn MessageCallback) {
+	c.Lock()
+	defer c.Unlock()
+	c.cb.message = fn
+}
+
+// SetLogCallback sets the function called with log messages
+func (c *Client) SetLogCallback(fn LogCallback) {
+	c.Lock()
+	defer c.Unlock()
+	c.cb.log = fn
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Connect to a broker on a network ("tcp" or "unix") and send the connect
+// request. The broker acknowledges the connection in Loop. Any previous
+// connection is closed. A keepalive of zero disables keepalive. The context
+// cancels dialing and the TLS handshake, but not the connection once made
+func (c *Client) Connect(ctx context.Context, network, address string, keepalive time.Duration) error {
+	c.Lock()
+	if c.conn != nil {
+		c.conn.close()
+		c.conn = nil
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	ctx, dialer, config, version := c.ctx, c.dialer, c.tls, c.version
+	connect := &Packet{
+		Type:       CMD_CONNECT,
+		Version:    c.version,
+		ClientId:   c.clientId,
+		Clean:      c.clean,
+		KeepAlive:  uint16(keepalive / time.Second),
+		Username:   c.username,
+		Password:   c.password,
+		Will:       c.will,
+		Properties: c.props,
+	}
+	c.Unlock()
+
+	// Check parameters
+	if keepalive < 0 || keepalive/time.Second > 0xFFFF {
+		return ErrBadParameter.Withf("Connect: invalid keepalive %v", keepalive)
+	} else if version != MQTT_PROTOCOL_V5 && (len(connect.Properties) > 0 || (connect.Will != nil && len(connect.Will.Properties) > 0)) {
+		return ErrBadParameter.With("Connect: properties require MQTT v5")
+	}
+
+	// Dial the broker, and perform the TLS handshake
+	c.log(MQTT_LOG_DEBUG, "Connecting to %v", address)
+	nc, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		if config.ServerName == "" && network != "unix" {
+			config = config.Clone()
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				config.ServerName = host
+			}
+		}
+		tc := tls.Client(nc, config)
+		tc.SetDeadline(time.Now().Add(writeTimeout))
+		if err := tc.HandshakeContext(ctx); err != nil {
+			nc.Close()
+			return err
+		}
+		tc.SetDeadline(time.Time{})
+		nc = tc
+	}
+
+	// Set the connection, unless the client has been closed while dialing
+	conn := &conn{Conn: nc, packets: make(chan *Packet), sent: make(chan struct{}, 1), done: make(chan struct{})}
+	c.Lock()
+	if ctx.Err() != nil {
+		c.Unlock()
+		nc.Close()
+		return ctx.Err()
+	}
+	c.conn = conn
+	c.keepalive = keepalive
+	c.ping = time.Time{}
+	c.Unlock()
+
+	// Read packets in the background, and send the connect request
+	go conn.read(version)
+	return c.write(conn, connect)
+}
+
+// Disconnect sends a disconnect request with a reason code for MQTT v5,
+// and closes the connection. The disconnect callback is called with a nil
+// error
+func (c *Client) Disconnect(rc ReasonCode, props Properties) error {
+	c.Lock()
+	conn := c.conn
+	c.Unlock()
+	if conn == nil {
+		return ErrOutOfOrder.With("Not connected")
+	}
+	err := c.write(conn, &Packet{Type: CMD_DISCONNECT, ReasonCode: rc, Properties: props})
+	c.lost(conn, nil, nil)
+	return err
+}
+
+// Subscribe to one or more topics with a QoS and MQTT v5 subscription
+// options, and return the message id of the request
+func (c *Client) Subscribe(topics []string, qos, options int, props Properties) (int, error) {
+	if len(topics) == 0 {
+		return 0, ErrBadParameter.With("Subscribe: no topics")
+	} else if qos < 0 || qos > 2 {
+		return 0, ErrBadParameter.Withf("Subscribe: invalid qos %v", qos)
+	}
+	p := &Packet{Type: CMD_SUBSCRIBE, Properties: props}
+	for _, topic := range topics {
+		p.Subscriptions = append(p.Subscriptions, Subscription{Topic: topic, Options: qos | options})
+	}
+	return c.request(p)
+}
+
+// Unsubscribe from one or more topics, and return the message id of the
+// request
+func (c *Client) Unsubscribe(topics []string, props Properties) (int, error) {
+	if len(topics) == 0 {
+		return 0, ErrBadParameter.With("Unsubscribe: no topics")
+	}
+	return c.request(&Packet{Type: CMD_UNSUBSCRIBE, Topics: topics, Properties: props})
+}
+
+// Publish a message, and return the message id
+func (c *Client) Publish(topic string, payload []byte, qos int, retain bool, props Properties) (int, error) {
+	if topic == "" {
+		return 0, ErrBadParameter.With("Publish: empty topic")
+	} else if qos < 0 || qos > 2 {
+		return 0, ErrBadParameter.Withf("Publish: invalid qos %v", qos)
+	}
+	return c.request(&Packet{Type: CMD_PUBLISH, Topic: topic, Payload: payload, QoS: qos, Retain: retain, Properties: props})
+}
+
+// Loop waits up to the timeout for packets from the broker, calls the
+// callbacks, and performs keepalive. Returns an error when the client is
+// not connected or the connection has been lost
+func (c *Client) Loop(timeout time.Duration) error {
+	// Report messages with QoS 0 which have been written
+	c.published()
+
+	c.Lock()
+	conn := c.conn
+	c.Unlock()
+	if conn == nil {
+		return ErrOutOfOrder.With("Not connected")
+	}
+
+	// Wait for a packet, then handle any others which are waiting
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for n := 0; n < loopPackets; n++ {
+		var p *Packet
+		var ok bool
+		if n == 0 {
+			select {
+			case p, ok = <-conn.packets:
+			case <-conn.sent:
+				c.published()
+				return c.keepAlive(conn)
+			case <-timer.C:
+				return c.keepAlive(conn)
+			}
+		} else {
+			select {
+			case p, ok = <-conn.packets:
+			default:
+				return c.keepAlive(conn)
+			}
+		}
+		if !ok {
+			return c.lost(conn, conn.err, nil)
+		} else if err := c.handle(conn, p); err != nil {
+			return err
+		}
+	}
+
+	// Perform keepalive
+	return c.keepAlive(conn)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Read packets from the connection until it is closed
+func (conn *conn) read(version int) {
+	defer close(conn.packets)
+	r := bufio.NewReader(conn)
+	for {
+		p, err := ReadPacket(r, version)
+		if err != nil {
+			conn.err = err
+			return
+		}
+		select {
+		case conn.packets <- p:
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// Close the connection and stop reading
+func (conn *conn) close() error {
+	select {
+	case <-conn.done:
+		return nil
+	default:
+		close(conn.done)
+	}
+	return conn.Close()
+}
+
+// Allocate a message id, and send a request. Requests with QoS 1 or 2 are
+// sent again when the client reconnects. A message with QoS 0 is reported
+// to the publish callback by Loop, once it has been written
+func (c *Client) request(p *Packet) (int, error) {
+	c.Lock()
+	conn := c.conn
+	version := c.version
+	if conn == nil {
+		c.Unlock()
+		return 0, ErrOutOfOrder.With("Not connected")
+	} else if version != MQTT_PROTOCOL_V5 && len(p.Properties) > 0 {
+		c.Unlock()
+		return 0, ErrBadParameter.With("Properties require MQTT v5")
+	}
+	id, err := c.id()
+	if err != nil {
+		c.Unlock()
+		return 0, err
+	}
+	p.Id = id
+	switch {
+	case p.Type == CMD_PUBLISH && p.QoS > 0:
+		c.outgoing[id] = p
+	case p.Type == CMD_SUBSCRIBE || p.Type == CMD_UNSUBSCRIBE:
+		c.requests[id] = p.Type
+	}
+	c.Unlock()
+
+	// Write the request. A message with QoS 0 has been published once written
+	if err := c.write(conn, p); err != nil {
+		c.Lock()
+		delete(c.outgoing, id)
+		delete(c.requests, id)
+		c.Unlock()
+		return 0, err
+	} else if p.Type == CMD_PUBLISH && p.QoS == 0 {
+		c.Lock()
+		c.sent = append(c.sent, id)
+		c.Unlock()
+		select {
+		case conn.sent <- struct{}{}:
+		default:
+		}
+	}
+
+	// Return success
+	return int(id), nil
+}
+
+// Return an unused message id, or an error when every message id is in
+// use. The lock is held
+func (c *Client) id() (uint16, error) {
+	for i := 0; i < math.MaxUint16; i++ {
+		c.next++
+		if c.next == 0 {
+			c.next++
+		}
+		_, publish := c.outgoing[c.next]
+		_, request := c.requests[c.next]
+		if !publish && !request {
+			return c.next, nil
+		}
+	}
+	return 0, ErrChannelBlocked.With("No message ids available")
+}
+
+// Call the publish callback for messages with QoS 0 which have been written
+func (c *Client) published() {
+	c.Lock()
+	sent, fn := c.sent, c.cb.publish
+	c.sent = nil
+	c.Unlock()
+	if fn != nil {
+		for _, id := range sent {
+			fn(int(id), MQTT_RC_SUCCESS, nil)
+		}
+	}
+}
+
+// Write a packet to the connection. On error, the connection is closed so
+// that Loop returns an error
+func (c *Client) write(conn *conn, p *Packet) error {
+	c.Lock()
+	version := c.version
+	c.Unlock()
+	data, err := p.Encode(version)
+	if err != nil {
+		return err
+	}
+
+	// Write the packet
+	c.wmu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(data)
+	c.wmu.Unlock()
+	if err != nil {
+		conn.close()
+		return err
+	}
+
+	// Record the time of the write, for keepalive
+	c.Lock()
+	c.lastOut = time.Now()
+	c.Unlock()
+	c.log(MQTT_LOG_DEBUG, "Client %v sending %v", c.clientId, p)
+
+	// Return success
+	return nil
+}
+
+// Send a PINGREQ when nothing has been sent for the keepalive interval, and
+// return an error if the broker has not responded within the interval
+func (c *Client) keepAlive(conn *conn) error {
+	c.Lock()
+	keepalive, last, ping := c.keepalive, c.lastOut, c.ping
+	c.Unlock()
+	if keepalive == 0 {
+		return nil
+	} else if !ping.IsZero() && time.Since(ping) >= keepalive {
+		return c.lost(conn, MQTT_RC_KEEP_ALIVE_TIMEOUT, nil)
+	} else if ping.IsZero() && time.Since(last) >= keepalive {
+		c.Lock()
+		c.ping = time.Now()
+		c.Unlock()
+		c.write(conn, &Packet{Type: CMD_PINGREQ})
+	}
+	return nil
+}
+
+// Called when a connection is lost or closed, which discards requests
+// waiting for acknowledgement, except messages which are sent again on
+// reconnect. Calls the disconnect callback once for each connection
+func (c *Client) lost(conn *conn, err error, props Properties) error {
+	c.Lock()
+	if c.conn != conn {
+		c.Unlock()
+		return err
+	}
+	c.conn = nil
+	c.requests = make(map[uint16]PacketType)
+	fn := c.cb.disconnect
+	c.Unlock()
+
+	// Close the connection and call the callback
+	conn.close()
+	if err != nil {
+		c.log(MQTT_LOG_NOTICE, "Client %v disconnected: %v", c.clientId, err)
+	}
+	if fn != nil {
+		fn(err, props)
+	}
+	if err == nil {
+		return ErrOutOfOrder.With("Disconnected")
+	}
+	return err
+}
+
+// Return the callbacks
+func (c *Client) callbacks() callbacks {
+	c.Lock()
+	defer c.Unlock()
+	return c.cb
+}
+
+// Handle a packet received from the broker, and return an error if the
+// connection has been closed
+func (c *Client) handle(conn *conn, p *Packet) error {
+	c.log(MQTT_LOG_DEBUG, "Client %v received %v", c.clientId, p)
+	cb := c.callbacks()
+	switch p.Type {
+	case CMD_CONNACK:
+		flags := 0
+		if p.SessionPresent {
+			flags |= MQTT_CONNACK_SESSION_PRESENT
+		}
+		if cb.connect != nil {
+			cb.connect(p.ReasonCode, flags, p.Properties)
+		}
+		if p.ReasonCode.Failed() {
+			return c.lost(conn, p.ReasonCode, p.Properties)
+		}
+		c.resend(conn)
+	case CMD_PUBLISH:
+		switch p.QoS {
+		case 0:
+			if cb.message != nil {
+				cb.message(p)
+			}
+		case 1:
+			if cb.message != nil {
+				cb.message(p)
+			}
+			c.write(conn, &Packet{Type: CMD_PUBACK, Id: p.Id})
+		case 2:
+			// The message is delivered on PUBREL
+			c.Lock()
+			if _, exists := c.incoming[p.Id]; !exists {
+				c.incoming[p.Id] = p
+			}
+			c.Unlock()
+			c.write(conn, &Packet{Type: CMD_PUBREC, Id: p.Id})
+		}
+	case CMD_PUBREL:
+		c.Lock()
+		message, exists := c.incoming[p.Id]
+		delete(c.incoming, p.Id)
+		c.Unlock()
+		if exists && cb.message != nil {
+			cb.message(message)
+		}
+		c.write(conn, &Packet{Type: CMD_PUBCOMP, Id: p.Id})
+	case CMD_PUBACK, CMD_PUBCOMP:
+		c.Lock()
+		request, exists := c.outgoing[p.Id]
+		if exists && ((p.Type == CMD_PUBACK && request.Type == CMD_PUBLISH && request.QoS == 1) || (p.Type == CMD_PUBCOMP && request.Type == CMD_PUBREL)) {
+			delete(c.outgoing, p.Id)
+		} else {
+			exists = false
+		}
+		c.Unlock()
+		if exists && cb.publish != nil {
+			cb.publish(int(p.Id), p.ReasonCode, p.Properties)
+		}
+	case CMD_PUBREC:
+		c.Lock()
+		request, exists := c.outgoing[p.Id]
+		exists = exists && request.Type == CMD_PUBLISH && request.QoS == 2
+		release := &Packet{Type: CMD_PUBREL, Id: p.Id}
+		if exists && p.ReasonCode.Failed() {
+			delete(c.outgoing, p.Id)
+		} else if exists {
+			c.outgoing[p.Id] = release
+		} else {
+			release.ReasonCode = MQTT_RC_PACKET_ID_NOT_FOUND
+		}
+		c.Unlock()
+		if exists && p.ReasonCode.Failed() {
+			if cb.publish != nil {
+				cb.publish(int(p.Id), p.ReasonCode, p.Properties)
+			}
+		} else {
+			c.write(conn, release)
+		}
+	case CMD_SUBACK, CMD_UNSUBACK:
+		c.Lock()
+		request, exists := c.requests[p.Id]
+		delete(c.requests, p.Id)
+		c.Unlock()
+		switch {
+		case !exists:
+			c.log(MQTT_LOG_WARNING, "Client %v received %v for unknown request", c.clientId, p.Type)
+		case p.Type == CMD_SUBACK && request == CMD_SUBSCRIBE && cb.subscribe != nil:
+			granted := make([]int, len(p.ReasonCodes))
+			for i, rc := range p.ReasonCodes {
+				granted[i] = int(rc)
+			}
+			cb.subscribe(int(p.Id), granted, p.Properties)
+		case p.Type == CMD_UNSUBACK && request == CMD_UNSUBSCRIBE && cb.unsubscribe != nil:
+			cb.unsubscribe(int(p.Id), p.Properties)
+		}
+	case CMD_PINGRESP:
+		c.Lock()
+		c.ping = time.Time{}
+		c.Unlock()
+	case CMD_DISCONNECT:
+		return c.lost(conn, p.ReasonCode, p.Properties)
+	default:
+		return c.lost(conn, MQTT_RC_PROTOCOL_ERROR, nil)
+	}
+
+	// Return success
+	return nil
+}
+
+// Send messages which have not been acknowledged again, in order of
+// message id, after the broker has acknowledged a connection
+func (c *Client) resend(conn *conn) {
+	c.Lock()
+	ids := make([]int, 0, len(c.outgoing))
+	for id := range c.outgoing {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	packets := make([]*Packet, 0, len(ids))
+	for _, id := range ids {
+		p := c.outgoing[uint16(id)]
+		if p.Type == CMD_PUBLISH {
+			dup := *p
+			dup.Dup = true
+			p = &dup
+		}
+		packets = append(packets, p)
+	}
+	c.Unlock()
+	for _, p := range packets {
+		if err := c.write(conn, p); err != nil {
+			return
+		}
+	}
+}
+
+// Call the log callback
+func (c *Client) log(level Level, format string, args ...interface{}) {
+	c.Lock()
+	fn := c.cb.log
+	c.Unlock()
+	if fn != nil {
+		fn(level, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,89 @@
+package mqtt_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	// Packages
+	mqtttest "github.com/mutablelogic/go-mosquitto/pkg/mqtttest"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+)
+
+// Return a client connected to a broker, which needs to be closed
+func connect(t *testing.T, broker *mqtttest.Broker) *Client {
+	t.Helper()
+	c, err := New("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan ReasonCode, 1)
+	c.SetConnectCallback(func(rc ReasonCode, flags int, props Properties) {
+		connected <- rc
+	})
+	if err := c.Connect(context.Background(), "tcp", broker.Addr(), 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err := c.Loop(100 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case rc := <-connected:
+			if rc != MQTT_RC_SUCCESS {
+				t.Fatal("Connect refused", rc)
+			}
+			return c
+		default:
+		}
+	}
+}
+
+func Test_Client_001(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	c := connect(t, broker)
+	defer c.Close()
+
+	// A message with QoS 0 is reported by the loop, not by Publish
+	published := 0
+	c.SetPublishCallback(func(id int, rc ReasonCode, props Properties) {
+		published++
+	})
+	if _, err := c.Publish("test", []byte("test"), 0, false, nil); err != nil {
+		t.Fatal(err)
+	} else if published != 0 {
+		t.Error("Unexpected publish callback from Publish")
+	}
+	if err := c.Loop(time.Second); err != nil {
+		t.Fatal(err)
+	} else if published != 1 {
+		t.Error("Expected publish callback from Loop, got", published)
+	}
+}
+
+func Test_Client_002(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	c := connect(t, broker)
+	defer c.Close()
+
+	// Without calling Loop no message is acknowledged, so every message id
+	// is used and then an error is returned
+	for i := 0; i < 0xFFFF; i++ {
+		if _, err := c.Publish("test", nil, 1, false, nil); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if _, err := c.Publish("test", nil, 1, false, nil); err == nil {
+		t.Error("Expected error when every message id is in use")
+	}
+}
@@ -0,0 +1,9 @@
+/*
+Pure Go implementation of the MQTT 3.1, 3.1.1 and 5 protocols, with
+a packet encoder and decoder and a client which does not depend on
+libmosquitto. The client is used by pkg/mosquitto when built without cgo,
+or when the Go backend is selected in the configuration.
+For more information please see
+https://github.com/mutablelogic/go-mosquitto/blob/master/README.md
+*/
+package mqtt
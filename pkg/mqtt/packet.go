@@ -0,0 +1,734 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// PacketType is the type of a control packet
+type PacketType byte
+
+// Packet is an MQTT control packet. Only the fields for the type of packet
+// are encoded, and the protocol version determines the encoding
+type Packet struct {
+	Type PacketType
+	Id   uint16 // Packet identifier
+
+	// CONNECT
+	Version   int    // Protocol version
+	ClientId  string // Client identifier
+	Clean     bool   // Clean session or clean start
+	KeepAlive uint16 // Keepalive in seconds
+	Username  string // Set when not empty
+	Password  []byte // Set when not nil
+	Will      *Packet
+
+	// CONNACK
+	SessionPresent bool
+
+	// PUBLISH, and the will message of CONNECT
+	Topic   string
+	Payload []byte
+	QoS     int
+	Retain  bool
+	Dup     bool
+
+	// SUBSCRIBE and UNSUBSCRIBE
+	Subscriptions []Subscription
+	Topics        []string
+
+	// Acknowledgements, DISCONNECT and AUTH
+	ReasonCode  ReasonCode
+	ReasonCodes []ReasonCode // SUBACK and UNSUBACK
+
+	// MQTT v5 properties
+	Properties Properties
+}
+
+// Subscription is a topic filter and its options, with the QoS in the
+// lowest two bits of the options
+type Subscription struct {
+	Topic   string
+	Options int
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	CMD_CONNECT     PacketType = 0x10
+	CMD_CONNACK     PacketType = 0x20
+	CMD_PUBLISH     PacketType = 0x30
+	CMD_PUBACK      PacketType = 0x40
+	CMD_PUBREC      PacketType = 0x50
+	CMD_PUBREL      PacketType = 0x60
+	CMD_PUBCOMP     PacketType = 0x70
+	CMD_SUBSCRIBE   PacketType = 0x80
+	CMD_SUBACK      PacketType = 0x90
+	CMD_UNSUBSCRIBE PacketType = 0xA0
+	CMD_UNSUBACK    PacketType = 0xB0
+	CMD_PINGREQ     PacketType = 0xC0
+	CMD_PINGRESP    PacketType = 0xD0
+	CMD_DISCONNECT  PacketType = 0xE0
+	CMD_AUTH        PacketType = 0xF0
+)
+
+// Protocol versions
+const (
+	MQTT_PROTOCOL_V31  = 3
+	MQTT_PROTOCOL_V311 = 4
+	MQTT_PROTOCOL_V5   = 5
+)
+
+// Subscription options for MQTT v5, combined with the QoS
+const (
+	MQTT_SUB_OPT_NO_LOCAL            = 0x04
+	MQTT_SUB_OPT_RETAIN_AS_PUBLISHED = 0x08
+	MQTT_SUB_OPT_SEND_RETAIN_ALWAYS  = 0x00
+	MQTT_SUB_OPT_SEND_RETAIN_NEW     = 0x10
+	MQTT_SUB_OPT_SEND_RETAIN_NEVER   = 0x20
+)
+
+const (
+	// Largest value of a variable byte integer
+	maxVarint = 268435455
+
+	// Connect flags
+	connectUsername   = 0x80
+	connectPassword   = 0x40
+	connectWillRetain = 0x20
+	connectWill       = 0x04
+	connectClean      = 0x02
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// ReadPacket reads a packet, decoding it for a protocol version. The
+// version of a CONNECT packet is read from the packet
+func ReadPacket(r io.Reader, version int) (*Packet, error) {
+	var header [1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	// Read the remaining length, then the remainder of the packet
+	var length, shift uint32
+	for i := 0; ; i++ {
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		} else if i == 3 && b[0]&0x80 != 0 {
+			return nil, ErrUnexpectedResponse.With("Malformed remaining length")
+		}
+		length |= uint32(b[0]&0x7F) << shift
+		if b[0]&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// Decode the packet
+	return decodePacket(header[0], body, version)
+}
+
+// Write encodes a packet for a protocol version, and writes it
+func (p *Packet) Write(w io.Writer, version int) error {
+	if data, err := p.Encode(version); err != nil {
+		return err
+	} else if _, err := w.Write(data); err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// Encode a packet for a protocol version. The version of a CONNECT packet
+// is set in the packet
+func (p *Packet) Encode(version int) ([]byte, error) {
+	var body encoder
+	flags := byte(0)
+	v5 := version == MQTT_PROTOCOL_V5
+	switch p.Type {
+	case CMD_CONNECT:
+		if err := p.encodeConnect(&body); err != nil {
+			return nil, err
+		}
+	case CMD_CONNACK:
+		if p.SessionPresent {
+			body.byte(1)
+		} else {
+			body.byte(0)
+		}
+		if v5 {
+			body.byte(byte(p.ReasonCode))
+			p.Properties.encode(&body)
+		} else {
+			body.byte(byte(connackCode(p.ReasonCode)))
+		}
+	case CMD_PUBLISH:
+		if p.QoS < 0 || p.QoS > 2 {
+			return nil, ErrBadParameter.Withf("Invalid QoS %v", p.QoS)
+		}
+		flags = byte(p.QoS) << 1
+		if p.Dup {
+			flags |= 0x08
+		}
+		if p.Retain {
+			flags |= 0x01
+		}
+		body.string(p.Topic)
+		if p.QoS > 0 {
+			body.uint16(p.Id)
+		}
+		if v5 {
+			p.Properties.encode(&body)
+		}
+		body.bytes(p.Payload)
+	case CMD_PUBACK, CMD_PUBREC, CMD_PUBREL, CMD_PUBCOMP:
+		if p.Type == CMD_PUBREL {
+			flags = 0x02
+		}
+		body.uint16(p.Id)
+		if v5 && (p.ReasonCode != MQTT_RC_SUCCESS || len(p.Properties) > 0) {
+			body.byte(byte(p.ReasonCode))
+			if len(p.Properties) > 0 {
+				p.Properties.encode(&body)
+			}
+		}
+	case CMD_SUBSCRIBE:
+		if len(p.Subscriptions) == 0 {
+			return nil, ErrBadParameter.With("No subscriptions")
+		}
+		flags = 0x02
+		body.uint16(p.Id)
+		if v5 {
+			p.Properties.encode(&body)
+		}
+		for _, sub := range p.Subscriptions {
+			body.string(sub.Topic)
+			if v5 {
+				body.byte(byte(sub.Options))
+			} else {
+				body.byte(byte(sub.Options & 0x03))
+			}
+		}
+	case CMD_SUBACK, CMD_UNSUBACK:
+		body.uint16(p.Id)
+		if v5 {
+			p.Properties.encode(&body)
+		}
+		if v5 || p.Type == CMD_SUBACK {
+			for _, rc := range p.ReasonCodes {
+				body.byte(byte(rc))
+			}
+		}
+	case CMD_UNSUBSCRIBE:
+		if len(p.Topics) == 0 {
+			return nil, ErrBadParameter.With("No topics")
+		}
+		flags = 0x02
+		body.uint16(p.Id)
+		if v5 {
+			p.Properties.encode(&body)
+		}
+		for _, topic := range p.Topics {
+			body.string(topic)
+		}
+	case CMD_PINGREQ, CMD_PINGRESP:
+		// No variable header or payload
+	case CMD_DISCONNECT:
+		if v5 && (p.ReasonCode != MQTT_RC_SUCCESS || len(p.Properties) > 0) {
+			body.byte(byte(p.ReasonCode))
+			if len(p.Properties) > 0 {
+				p.Properties.encode(&body)
+			}
+		}
+	case CMD_AUTH:
+		if !v5 {
+			return nil, ErrBadParameter.With("AUTH requires MQTT v5")
+		}
+		body.byte(byte(p.ReasonCode))
+		p.Properties.encode(&body)
+	default:
+		return nil, ErrBadParameter.Withf("Invalid packet type %v", p.Type)
+	}
+	if body.err != nil {
+		return nil, body.err
+	} else if len(body.buf) > maxVarint {
+		return nil, ErrBadParameter.With("Packet too large")
+	}
+
+	// Prepend the fixed header
+	var packet encoder
+	packet.byte(byte(p.Type) | flags)
+	packet.varint(uint32(len(body.buf)))
+	packet.bytes(body.buf)
+	return packet.buf, packet.err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (t PacketType) String() string {
+	switch t {
+	case CMD_CONNECT:
+		return "CONNECT"
+	case CMD_CONNACK:
+		return "CONNACK"
+	case CMD_PUBLISH:
+		return "PUBLISH"
+	case CMD_PUBACK:
+		return "PUBACK"
+	case CMD_PUBREC:
+		return "PUBREC"
+	case CMD_PUBREL:
+		return "PUBREL"
+	case CMD_PUBCOMP:
+		return "PUBCOMP"
+	case CMD_SUBSCRIBE:
+		return "SUBSCRIBE"
+	case CMD_SUBACK:
+		return "SUBACK"
+	case CMD_UNSUBSCRIBE:
+		return "UNSUBSCRIBE"
+	case CMD_UNSUBACK:
+		return "UNSUBACK"
+	case CMD_PINGREQ:
+		return "PINGREQ"
+	case CMD_PINGRESP:
+		return "PINGRESP"
+	case CMD_DISCONNECT:
+		return "DISCONNECT"
+	case CMD_AUTH:
+		return "AUTH"
+	default:
+		return "[?? Invalid PacketType value]"
+	}
+}
+
+func (p *Packet) String() string {
+	str := "<" + p.Type.String()
+	if p.Id != 0 {
+		str += fmt.Sprint(" id=", p.Id)
+	}
+	switch p.Type {
+	case CMD_CONNECT:
+		str += fmt.Sprintf(" version=%v client_id=%q clean=%v keepalive=%v", p.Version, p.ClientId, p.Clean, p.KeepAlive)
+		if p.Username != "" {
+			str += fmt.Sprintf(" username=%q", p.Username)
+		}
+		if p.Will != nil {
+			str += fmt.Sprintf(" will=%q", p.Will.Topic)
+		}
+	case CMD_CONNACK:
+		str += fmt.Sprintf(" session_present=%v reason=%q", p.SessionPresent, p.ReasonCode)
+	case CMD_PUBLISH:
+		str += fmt.Sprintf(" topic=%q qos=%v", p.Topic, p.QoS)
+		if p.Retain {
+			str += " retain"
+		}
+		if p.Dup {
+			str += " dup"
+		}
+		str += fmt.Sprintf(" payload=%d bytes", len(p.Payload))
+	case CMD_SUBSCRIBE:
+		for _, sub := range p.Subscriptions {
+			str += fmt.Sprintf(" %q:%v", sub.Topic, sub.Options)
+		}
+	case CMD_UNSUBSCRIBE:
+		str += fmt.Sprintf(" topics=%q", p.Topics)
+	case CMD_SUBACK, CMD_UNSUBACK:
+		if len(p.ReasonCodes) > 0 {
+			str += fmt.Sprint(" reason_codes=", p.ReasonCodes)
+		}
+	case CMD_PUBACK, CMD_PUBREC, CMD_PUBREL, CMD_PUBCOMP, CMD_DISCONNECT, CMD_AUTH:
+		if p.ReasonCode != MQTT_RC_SUCCESS {
+			str += fmt.Sprintf(" reason=%q", p.ReasonCode)
+		}
+	}
+	for _, prop := range p.Properties {
+		str += " " + prop.String()
+	}
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+func (p *Packet) encodeConnect(w *encoder) error {
+	switch p.Version {
+	case MQTT_PROTOCOL_V31:
+		w.string("MQIsdp")
+	case MQTT_PROTOCOL_V311, MQTT_PROTOCOL_V5:
+		w.string("MQTT")
+	default:
+		return ErrBadParameter.Withf("Invalid protocol version %v", p.Version)
+	}
+	w.byte(byte(p.Version))
+
+	// Connect flags
+	flags := byte(0)
+	if p.Username != "" {
+		flags |= connectUsername
+	}
+	if p.Password != nil {
+		flags |= connectPassword
+	}
+	if p.Will != nil {
+		if p.Will.QoS < 0 || p.Will.QoS > 2 {
+			return ErrBadParameter.Withf("Invalid will QoS %v", p.Will.QoS)
+		}
+		flags |= connectWill | byte(p.Will.QoS)<<3
+		if p.Will.Retain {
+			flags |= connectWillRetain
+		}
+	}
+	if p.Clean {
+		flags |= connectClean
+	}
+	w.byte(flags)
+	w.uint16(p.KeepAlive)
+	if p.Version == MQTT_PROTOCOL_V5 {
+		p.Properties.encode(w)
+	}
+
+	// Payload
+	w.string(p.ClientId)
+	if p.Will != nil {
+		if p.Version == MQTT_PROTOCOL_V5 {
+			p.Will.Properties.encode(w)
+		}
+		w.string(p.Will.Topic)
+		w.binary(p.Will.Payload)
+	}
+	if p.Username != "" {
+		w.string(p.Username)
+	}
+	if p.Password != nil {
+		w.binary(p.Password)
+	}
+
+	// Return any errors
+	return w.err
+}
+
+func decodePacket(header byte, data []byte, version int) (*Packet, error) {
+	p := &Packet{Type: PacketType(header & 0xF0)}
+	flags := header & 0x0F
+	r := &decoder{buf: data}
+	v5 := version == MQTT_PROTOCOL_V5
+
+	// Check the reserved flags
+	switch p.Type {
+	case CMD_PUBLISH:
+		// Flags are the QoS, retain and duplicate
+	case CMD_PUBREL, CMD_SUBSCRIBE, CMD_UNSUBSCRIBE:
+		if flags != 0x02 {
+			return nil, ErrUnexpectedResponse.Withf("Invalid flags for %v", p.Type)
+		}
+	default:
+		if flags != 0 {
+			return nil, ErrUnexpectedResponse.Withf("Invalid flags for %v", p.Type)
+		}
+	}
+
+	switch p.Type {
+	case CMD_CONNECT:
+		p.decodeConnect(r)
+	case CMD_CONNACK:
+		p.SessionPresent = r.byte()&0x01 != 0
+		if v5 {
+			p.ReasonCode = ReasonCode(r.byte())
+			if r.remaining() > 0 {
+				p.Properties = decodeProperties(r)
+			}
+		} else {
+			p.ReasonCode = connackReason(ReasonCode(r.byte()))
+		}
+	case CMD_PUBLISH:
+		p.QoS = int(flags>>1) & 0x03
+		p.Retain = flags&0x01 != 0
+		p.Dup = flags&0x08 != 0
+		if p.QoS > 2 {
+			return nil, ErrUnexpectedResponse.Withf("Invalid QoS %v", p.QoS)
+		}
+		p.Topic = r.string()
+		if p.QoS > 0 {
+			p.Id = r.uint16()
+		}
+		if v5 {
+			p.Properties = decodeProperties(r)
+		}
+		p.Payload = r.bytes(r.remaining())
+	case CMD_PUBACK, CMD_PUBREC, CMD_PUBREL, CMD_PUBCOMP:
+		p.Id = r.uint16()
+		if v5 && r.remaining() > 0 {
+			p.ReasonCode = ReasonCode(r.byte())
+			if r.remaining() > 0 {
+				p.Properties = decodeProperties(r)
+			}
+		}
+	case CMD_SUBSCRIBE:
+		p.Id = r.uint16()
+		if v5 {
+			p.Properties = decodeProperties(r)
+		}
+		for r.err == nil && r.remaining() > 0 {
+			p.Subscriptions = append(p.Subscriptions, Subscription{Topic: r.string(), Options: int(r.byte())})
+		}
+		if len(p.Subscriptions) == 0 {
+			r.fail("No subscriptions")
+		}
+	case CMD_SUBACK, CMD_UNSUBACK:
+		p.Id = r.uint16()
+		if v5 {
+			p.Properties = decodeProperties(r)
+		}
+		for r.err == nil && r.remaining() > 0 {
+			p.ReasonCodes = append(p.ReasonCodes, ReasonCode(r.byte()))
+		}
+	case CMD_UNSUBSCRIBE:
+		p.Id = r.uint16()
+		if v5 {
+			p.Properties = decodeProperties(r)
+		}
+		for r.err == nil && r.remaining() > 0 {
+			p.Topics = append(p.Topics, r.string())
+		}
+		if len(p.Topics) == 0 {
+			r.fail("No topics")
+		}
+	case CMD_PINGREQ, CMD_PINGRESP:
+		// No variable header or payload
+	case CMD_DISCONNECT:
+		if v5 && r.remaining() > 0 {
+			p.ReasonCode = ReasonCode(r.byte())
+			if r.remaining() > 0 {
+				p.Properties = decodeProperties(r)
+			}
+		}
+	case CMD_AUTH:
+		if !v5 {
+			r.fail("AUTH requires MQTT v5")
+		} else if r.remaining() > 0 {
+			p.ReasonCode = ReasonCode(r.byte())
+			p.Properties = decodeProperties(r)
+		}
+	default:
+		r.fail("Invalid packet type 0x%02X", header)
+	}
+
+	// Check for errors and unexpected data
+	if r.err != nil {
+		return nil, r.err
+	} else if r.remaining() > 0 {
+		return nil, ErrUnexpectedResponse.Withf("Unexpected data in %v", p.Type)
+	} else {
+		return p, nil
+	}
+}
+
+func (p *Packet) decodeConnect(r *decoder) {
+	name := r.string()
+	p.Version = int(r.byte())
+	switch {
+	case name == "MQIsdp" && p.Version == MQTT_PROTOCOL_V31:
+	case name == "MQTT" && (p.Version == MQTT_PROTOCOL_V311 || p.Version == MQTT_PROTOCOL_V5):
+	default:
+		r.fail("Unsupported protocol %q version %v", name, p.Version)
+		return
+	}
+	flags := r.byte()
+	if flags&0x01 != 0 {
+		r.fail("Invalid connect flags")
+		return
+	}
+	p.Clean = flags&connectClean != 0
+	p.KeepAlive = r.uint16()
+	if p.Version == MQTT_PROTOCOL_V5 {
+		p.Properties = decodeProperties(r)
+	}
+
+	// Payload
+	p.ClientId = r.string()
+	if flags&connectWill != 0 {
+		p.Will = &Packet{Type: CMD_PUBLISH}
+		p.Will.QoS = int(flags>>3) & 0x03
+		p.Will.Retain = flags&connectWillRetain != 0
+		if p.Version == MQTT_PROTOCOL_V5 {
+			p.Will.Properties = decodeProperties(r)
+		}
+		p.Will.Topic = r.string()
+		p.Will.Payload = r.binary()
+	}
+	if flags&connectUsername != 0 {
+		p.Username = r.string()
+	}
+	if flags&connectPassword != 0 {
+		p.Password = r.binary()
+		if p.Password == nil {
+			p.Password = []byte{}
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ENCODER
+
+// encoder appends values to a buffer, recording the first error
+type encoder struct {
+	buf []byte
+	err error
+}
+
+func (w *encoder) byte(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *encoder) uint16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *encoder) varint(v uint32) {
+	if v > maxVarint && w.err == nil {
+		w.err = ErrBadParameter.Withf("Value %v too large", v)
+	}
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v > 0 {
+			b |= 0x80
+		}
+		w.buf = append(w.buf, b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func (w *encoder) bytes(v []byte) {
+	w.buf = append(w.buf, v...)
+}
+
+func (w *encoder) binary(v []byte) {
+	if len(v) > 0xFFFF && w.err == nil {
+		w.err = ErrBadParameter.Withf("Data of %d bytes too large", len(v))
+	}
+	w.uint16(uint16(len(v)))
+	w.bytes(v)
+}
+
+func (w *encoder) string(v string) {
+	if !utf8.ValidString(v) && w.err == nil {
+		w.err = ErrBadParameter.Withf("Invalid string %q", v)
+	}
+	w.binary([]byte(v))
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// DECODER
+
+// decoder reads values from a buffer, recording the first error. Once
+// there is an error, zero values are returned
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (r *decoder) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = ErrUnexpectedResponse.Withf(format, args...)
+	}
+}
+
+func (r *decoder) remaining() int {
+	return len(r.buf)
+}
+
+func (r *decoder) bytes(n int) []byte {
+	if r.err != nil || n == 0 {
+		return nil
+	} else if n > len(r.buf) {
+		r.fail("Packet too short")
+		return nil
+	}
+	v := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *decoder) sub(n int) *decoder {
+	data := r.bytes(n)
+	return &decoder{buf: data, err: r.err}
+}
+
+func (r *decoder) byte() byte {
+	if v := r.bytes(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *decoder) uint16() uint16 {
+	if v := r.bytes(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *decoder) uint32() uint32 {
+	if v := r.bytes(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *decoder) varint() uint32 {
+	var v, shift uint32
+	for i := 0; i < 4; i++ {
+		b := r.byte()
+		v |= uint32(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+		shift += 7
+	}
+	r.fail("Malformed variable byte integer")
+	return 0
+}
+
+func (r *decoder) binary() []byte {
+	n := r.uint16()
+	if n == 0 {
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+func (r *decoder) string() string {
+	v := r.binary()
+	if !utf8.Valid(v) {
+		r.fail("Invalid string")
+		return ""
+	}
+	return string(v)
+}
@@ -0,0 +1,115 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+)
+
+var packetTests = []struct {
+	Version int
+	Packet  *Packet
+}{
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_CONNECT, Version: MQTT_PROTOCOL_V311, ClientId: "id", Clean: true, KeepAlive: 60}},
+	{MQTT_PROTOCOL_V31, &Packet{Type: CMD_CONNECT, Version: MQTT_PROTOCOL_V31, ClientId: "id", KeepAlive: 60, Username: "user", Password: []byte("pass")}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_CONNECT, Version: MQTT_PROTOCOL_V5, ClientId: "id", Clean: true, Will: &Packet{Type: CMD_PUBLISH, Topic: "will", Payload: []byte("gone"), QoS: 1, Retain: true, Properties: Properties{{Id: MQTT_PROP_WILL_DELAY_INTERVAL, Int: 10}}}, Properties: Properties{{Id: MQTT_PROP_RECEIVE_MAXIMUM, Int: 10}}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_CONNACK, SessionPresent: true}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_CONNACK, ReasonCode: MQTT_RC_NOT_AUTHORIZED}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_CONNACK, ReasonCode: MQTT_RC_BANNED, Properties: Properties{{Id: MQTT_PROP_REASON_STRING, Value: "banned"}}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_PUBLISH, Topic: "a/b", Payload: []byte("data")}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_PUBLISH, Id: 10, Topic: "a/b", Payload: []byte("data"), QoS: 2, Retain: true, Dup: true}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_PUBLISH, Id: 1, Topic: "a/b", QoS: 1, Properties: Properties{{Id: MQTT_PROP_USER_PROPERTY, Name: "name", Value: "value"}, {Id: MQTT_PROP_CORRELATION_DATA, Binary: []byte{1, 2}}}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_PUBACK, Id: 1}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_PUBREC, Id: 2, ReasonCode: MQTT_RC_NO_MATCHING_SUBSCRIBERS}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_PUBREL, Id: 3}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_PUBCOMP, Id: 4, Properties: Properties{{Id: MQTT_PROP_REASON_STRING, Value: "ok"}}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_SUBSCRIBE, Id: 5, Subscriptions: []Subscription{{"a/#", 1}, {"b/+", 2}}}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_SUBSCRIBE, Id: 5, Subscriptions: []Subscription{{"a/#", 1 | MQTT_SUB_OPT_NO_LOCAL}}, Properties: Properties{{Id: MQTT_PROP_SUBSCRIPTION_IDENTIFIER, Int: 1000}}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_SUBACK, Id: 5, ReasonCodes: []ReasonCode{1, 0x80}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_UNSUBSCRIBE, Id: 6, Topics: []string{"a/#", "b/+"}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_UNSUBACK, Id: 6}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_UNSUBACK, Id: 6, ReasonCodes: []ReasonCode{MQTT_RC_SUCCESS, MQTT_RC_NO_SUBSCRIPTION_EXISTED}}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_PINGREQ}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_PINGRESP}},
+	{MQTT_PROTOCOL_V311, &Packet{Type: CMD_DISCONNECT}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_DISCONNECT, ReasonCode: MQTT_RC_SESSION_TAKEN_OVER}},
+	{MQTT_PROTOCOL_V5, &Packet{Type: CMD_AUTH, ReasonCode: MQTT_RC_CONTINUE_AUTHENTICATION, Properties: Properties{{Id: MQTT_PROP_AUTHENTICATION_METHOD, Value: "method"}}}},
+}
+
+func Test_Packet_001(t *testing.T) {
+	for _, test := range packetTests {
+		var buf bytes.Buffer
+		if err := test.Packet.Write(&buf, test.Version); err != nil {
+			t.Error(test.Packet, err)
+			continue
+		}
+		if p, err := ReadPacket(&buf, test.Version); err != nil {
+			t.Error(test.Packet, err)
+		} else if !reflect.DeepEqual(p, test.Packet) {
+			t.Errorf("Expected %v, got %v", test.Packet, p)
+		} else if buf.Len() != 0 {
+			t.Error("Unexpected data after", p)
+		}
+	}
+}
+
+func Test_Packet_002(t *testing.T) {
+	// Malformed packets
+	tests := [][]byte{
+		{0x10, 0x00},                         // CONNECT without protocol
+		{0x20, 0x01, 0x00},                   // CONNACK too short
+		{0x32, 0x03, 0x00, 0x01, 'a'},        // PUBLISH QoS 1 without id
+		{0x36, 0x05, 0x00, 0x01, 'a', 0, 1},  // PUBLISH QoS 3
+		{0x60, 0x02, 0x00, 0x01},             // PUBREL with invalid flags
+		{0x82, 0x02, 0x00, 0x01},             // SUBSCRIBE without topics
+		{0xC0, 0x01, 0x00},                   // PINGREQ with data
+		{0x00, 0x00},                         // Reserved packet type
+		{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, // Remaining length too long
+	}
+	for _, test := range tests {
+		if p, err := ReadPacket(bytes.NewReader(test), MQTT_PROTOCOL_V311); err == nil {
+			t.Errorf("Expected error for %v, got %v", test, p)
+		}
+	}
+}
+
+func Test_Packet_003(t *testing.T) {
+	var props Properties
+	if err := props.AddString(MQTT_PROP_CONTENT_TYPE, "text/plain"); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddInt32(MQTT_PROP_CONTENT_TYPE, 1); err == nil {
+		t.Error("Expected error for wrong property type")
+	}
+	if err := props.AddStringPair(MQTT_PROP_USER_PROPERTY, "a", "1"); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddStringPair(MQTT_PROP_USER_PROPERTY, "a", "2"); err != nil {
+		t.Error(err)
+	}
+	if v, ok := props.GetString(MQTT_PROP_CONTENT_TYPE); !ok || v != "text/plain" {
+		t.Error("Unexpected content type", v)
+	}
+	if pairs := props.GetStringPairs(MQTT_PROP_USER_PROPERTY); len(pairs) != 2 || pairs[1][1] != "2" {
+		t.Error("Unexpected user properties", pairs)
+	}
+	if _, ok := props.GetInt32(MQTT_PROP_MESSAGE_EXPIRY_INTERVAL); ok {
+		t.Error("Unexpected message expiry")
+	}
+}
+
+func Test_Packet_004(t *testing.T) {
+	// MQTT v3 return codes are mapped to reason codes
+	var buf bytes.Buffer
+	buf.Write([]byte{0x20, 0x02, 0x00, 0x04})
+	if p, err := ReadPacket(&buf, MQTT_PROTOCOL_V311); err != nil {
+		t.Error(err)
+	} else if p.ReasonCode != MQTT_RC_BAD_USERNAME_OR_PASSWORD {
+		t.Error("Unexpected reason code", p.ReasonCode)
+	} else if !p.ReasonCode.Failed() {
+		t.Error("Expected failure")
+	}
+}
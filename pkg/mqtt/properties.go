@@ -0,0 +1,376 @@
+package mqtt
+
+import (
+	"fmt"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// PropertyId identifies an MQTT v5 property
+type PropertyId int
+
+// Property is an MQTT v5 property. Integer values are stored in Int and
+// string values in Value, and a user property also stores the name in Name
+type Property struct {
+	Id     PropertyId
+	Int    uint32
+	Value  string
+	Name   string
+	Binary []byte
+}
+
+// Properties is an ordered list of MQTT v5 properties
+type Properties []Property
+
+// Type of the value of a property
+type propertyType int
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	MQTT_PROP_PAYLOAD_FORMAT_INDICATOR     PropertyId = 0x01
+	MQTT_PROP_MESSAGE_EXPIRY_INTERVAL      PropertyId = 0x02
+	MQTT_PROP_CONTENT_TYPE                 PropertyId = 0x03
+	MQTT_PROP_RESPONSE_TOPIC               PropertyId = 0x08
+	MQTT_PROP_CORRELATION_DATA             PropertyId = 0x09
+	MQTT_PROP_SUBSCRIPTION_IDENTIFIER      PropertyId = 0x0B
+	MQTT_PROP_SESSION_EXPIRY_INTERVAL      PropertyId = 0x11
+	MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER   PropertyId = 0x12
+	MQTT_PROP_SERVER_KEEP_ALIVE            PropertyId = 0x13
+	MQTT_PROP_AUTHENTICATION_METHOD        PropertyId = 0x15
+	MQTT_PROP_AUTHENTICATION_DATA          PropertyId = 0x16
+	MQTT_PROP_REQUEST_PROBLEM_INFORMATION  PropertyId = 0x17
+	MQTT_PROP_WILL_DELAY_INTERVAL          PropertyId = 0x18
+	MQTT_PROP_REQUEST_RESPONSE_INFORMATION PropertyId = 0x19
+	MQTT_PROP_RESPONSE_INFORMATION         PropertyId = 0x1A
+	MQTT_PROP_SERVER_REFERENCE             PropertyId = 0x1C
+	MQTT_PROP_REASON_STRING                PropertyId = 0x1F
+	MQTT_PROP_RECEIVE_MAXIMUM              PropertyId = 0x21
+	MQTT_PROP_TOPIC_ALIAS_MAXIMUM          PropertyId = 0x22
+	MQTT_PROP_TOPIC_ALIAS                  PropertyId = 0x23
+	MQTT_PROP_MAXIMUM_QOS                  PropertyId = 0x24
+	MQTT_PROP_RETAIN_AVAILABLE             PropertyId = 0x25
+	MQTT_PROP_USER_PROPERTY                PropertyId = 0x26
+	MQTT_PROP_MAXIMUM_PACKET_SIZE          PropertyId = 0x27
+	MQTT_PROP_WILDCARD_SUB_AVAILABLE       PropertyId = 0x28
+	MQTT_PROP_SUBSCRIPTION_ID_AVAILABLE    PropertyId = 0x29
+	MQTT_PROP_SHARED_SUB_AVAILABLE         PropertyId = 0x2A
+)
+
+const (
+	propertyNone propertyType = iota
+	propertyByte
+	propertyInt16
+	propertyInt32
+	propertyVarint
+	propertyString
+	propertyBinary
+	propertyStringPair
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// AddByte adds a one byte property
+func (p *Properties) AddByte(id PropertyId, v uint8) error {
+	return p.add(propertyByte, Property{Id: id, Int: uint32(v)})
+}
+
+// AddInt16 adds a two byte integer property
+func (p *Properties) AddInt16(id PropertyId, v uint16) error {
+	return p.add(propertyInt16, Property{Id: id, Int: uint32(v)})
+}
+
+// AddInt32 adds a four byte integer property
+func (p *Properties) AddInt32(id PropertyId, v uint32) error {
+	return p.add(propertyInt32, Property{Id: id, Int: v})
+}
+
+// AddVarint adds a variable byte integer property
+func (p *Properties) AddVarint(id PropertyId, v uint32) error {
+	if v > maxVarint {
+		return ErrBadParameter.Withf("AddVarint: %v", v)
+	}
+	return p.add(propertyVarint, Property{Id: id, Int: v})
+}
+
+// AddString adds a string property
+func (p *Properties) AddString(id PropertyId, v string) error {
+	return p.add(propertyString, Property{Id: id, Value: v})
+}
+
+// AddBinary adds a binary property
+func (p *Properties) AddBinary(id PropertyId, v []byte) error {
+	return p.add(propertyBinary, Property{Id: id, Binary: v})
+}
+
+// AddStringPair adds a name and value property
+func (p *Properties) AddStringPair(id PropertyId, name, value string) error {
+	return p.add(propertyStringPair, Property{Id: id, Name: name, Value: value})
+}
+
+// GetByte returns the first one byte property with an id
+func (p Properties) GetByte(id PropertyId) (uint8, bool) {
+	if prop, exists := p.get(propertyByte, id); exists {
+		return uint8(prop.Int), true
+	}
+	return 0, false
+}
+
+// GetInt16 returns the first two byte integer property with an id
+func (p Properties) GetInt16(id PropertyId) (uint16, bool) {
+	if prop, exists := p.get(propertyInt16, id); exists {
+		return uint16(prop.Int), true
+	}
+	return 0, false
+}
+
+// GetInt32 returns the first four byte integer property with an id
+func (p Properties) GetInt32(id PropertyId) (uint32, bool) {
+	if prop, exists := p.get(propertyInt32, id); exists {
+		return prop.Int, true
+	}
+	return 0, false
+}
+
+// GetVarints returns all the variable byte integer properties with an id
+func (p Properties) GetVarints(id PropertyId) []uint32 {
+	var result []uint32
+	for _, prop := range p {
+		if prop.Id == id && id.valueType() == propertyVarint {
+			result = append(result, prop.Int)
+		}
+	}
+	return result
+}
+
+// GetString returns the first string property with an id
+func (p Properties) GetString(id PropertyId) (string, bool) {
+	if prop, exists := p.get(propertyString, id); exists {
+		return prop.Value, true
+	}
+	return "", false
+}
+
+// GetBinary returns the first binary property with an id
+func (p Properties) GetBinary(id PropertyId) ([]byte, bool) {
+	if prop, exists := p.get(propertyBinary, id); exists {
+		return prop.Binary, true
+	}
+	return nil, false
+}
+
+// GetStringPairs returns all the name and value properties with an id
+func (p Properties) GetStringPairs(id PropertyId) [][2]string {
+	var result [][2]string
+	for _, prop := range p {
+		if prop.Id == id && id.valueType() == propertyStringPair {
+			result = append(result, [2]string{prop.Name, prop.Value})
+		}
+	}
+	return result
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (id PropertyId) String() string {
+	switch id {
+	case MQTT_PROP_PAYLOAD_FORMAT_INDICATOR:
+		return "MQTT_PROP_PAYLOAD_FORMAT_INDICATOR"
+	case MQTT_PROP_MESSAGE_EXPIRY_INTERVAL:
+		return "MQTT_PROP_MESSAGE_EXPIRY_INTERVAL"
+	case MQTT_PROP_CONTENT_TYPE:
+		return "MQTT_PROP_CONTENT_TYPE"
+	case MQTT_PROP_RESPONSE_TOPIC:
+		return "MQTT_PROP_RESPONSE_TOPIC"
+	case MQTT_PROP_CORRELATION_DATA:
+		return "MQTT_PROP_CORRELATION_DATA"
+	case MQTT_PROP_SUBSCRIPTION_IDENTIFIER:
+		return "MQTT_PROP_SUBSCRIPTION_IDENTIFIER"
+	case MQTT_PROP_SESSION_EXPIRY_INTERVAL:
+		return "MQTT_PROP_SESSION_EXPIRY_INTERVAL"
+	case MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER:
+		return "MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER"
+	case MQTT_PROP_SERVER_KEEP_ALIVE:
+		return "MQTT_PROP_SERVER_KEEP_ALIVE"
+	case MQTT_PROP_AUTHENTICATION_METHOD:
+		return "MQTT_PROP_AUTHENTICATION_METHOD"
+	case MQTT_PROP_AUTHENTICATION_DATA:
+		return "MQTT_PROP_AUTHENTICATION_DATA"
+	case MQTT_PROP_REQUEST_PROBLEM_INFORMATION:
+		return "MQTT_PROP_REQUEST_PROBLEM_INFORMATION"
+	case MQTT_PROP_WILL_DELAY_INTERVAL:
+		return "MQTT_PROP_WILL_DELAY_INTERVAL"
+	case MQTT_PROP_REQUEST_RESPONSE_INFORMATION:
+		return "MQTT_PROP_REQUEST_RESPONSE_INFORMATION"
+	case MQTT_PROP_RESPONSE_INFORMATION:
+		return "MQTT_PROP_RESPONSE_INFORMATION"
+	case MQTT_PROP_SERVER_REFERENCE:
+		return "MQTT_PROP_SERVER_REFERENCE"
+	case MQTT_PROP_REASON_STRING:
+		return "MQTT_PROP_REASON_STRING"
+	case MQTT_PROP_RECEIVE_MAXIMUM:
+		return "MQTT_PROP_RECEIVE_MAXIMUM"
+	case MQTT_PROP_TOPIC_ALIAS_MAXIMUM:
+		return "MQTT_PROP_TOPIC_ALIAS_MAXIMUM"
+	case MQTT_PROP_TOPIC_ALIAS:
+		return "MQTT_PROP_TOPIC_ALIAS"
+	case MQTT_PROP_MAXIMUM_QOS:
+		return "MQTT_PROP_MAXIMUM_QOS"
+	case MQTT_PROP_RETAIN_AVAILABLE:
+		return "MQTT_PROP_RETAIN_AVAILABLE"
+	case MQTT_PROP_USER_PROPERTY:
+		return "MQTT_PROP_USER_PROPERTY"
+	case MQTT_PROP_MAXIMUM_PACKET_SIZE:
+		return "MQTT_PROP_MAXIMUM_PACKET_SIZE"
+	case MQTT_PROP_WILDCARD_SUB_AVAILABLE:
+		return "MQTT_PROP_WILDCARD_SUB_AVAILABLE"
+	case MQTT_PROP_SUBSCRIPTION_ID_AVAILABLE:
+		return "MQTT_PROP_SUBSCRIPTION_ID_AVAILABLE"
+	case MQTT_PROP_SHARED_SUB_AVAILABLE:
+		return "MQTT_PROP_SHARED_SUB_AVAILABLE"
+	default:
+		return "[?? Invalid PropertyId value]"
+	}
+}
+
+func (p Property) String() string {
+	switch p.Id.valueType() {
+	case propertyString:
+		return fmt.Sprintf("%v=%q", p.Id, p.Value)
+	case propertyBinary:
+		return fmt.Sprintf("%v=%q", p.Id, p.Binary)
+	case propertyStringPair:
+		return fmt.Sprintf("%v=%q:%q", p.Id, p.Name, p.Value)
+	default:
+		return fmt.Sprintf("%v=%v", p.Id, p.Int)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return the type of the value of a property
+func (id PropertyId) valueType() propertyType {
+	switch id {
+	case MQTT_PROP_PAYLOAD_FORMAT_INDICATOR, MQTT_PROP_REQUEST_PROBLEM_INFORMATION,
+		MQTT_PROP_REQUEST_RESPONSE_INFORMATION, MQTT_PROP_MAXIMUM_QOS, MQTT_PROP_RETAIN_AVAILABLE,
+		MQTT_PROP_WILDCARD_SUB_AVAILABLE, MQTT_PROP_SUBSCRIPTION_ID_AVAILABLE, MQTT_PROP_SHARED_SUB_AVAILABLE:
+		return propertyByte
+	case MQTT_PROP_SERVER_KEEP_ALIVE, MQTT_PROP_RECEIVE_MAXIMUM, MQTT_PROP_TOPIC_ALIAS_MAXIMUM, MQTT_PROP_TOPIC_ALIAS:
+		return propertyInt16
+	case MQTT_PROP_MESSAGE_EXPIRY_INTERVAL, MQTT_PROP_SESSION_EXPIRY_INTERVAL, MQTT_PROP_WILL_DELAY_INTERVAL,
+		MQTT_PROP_MAXIMUM_PACKET_SIZE:
+		return propertyInt32
+	case MQTT_PROP_SUBSCRIPTION_IDENTIFIER:
+		return propertyVarint
+	case MQTT_PROP_CONTENT_TYPE, MQTT_PROP_RESPONSE_TOPIC, MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER,
+		MQTT_PROP_AUTHENTICATION_METHOD, MQTT_PROP_RESPONSE_INFORMATION, MQTT_PROP_SERVER_REFERENCE,
+		MQTT_PROP_REASON_STRING:
+		return propertyString
+	case MQTT_PROP_CORRELATION_DATA, MQTT_PROP_AUTHENTICATION_DATA:
+		return propertyBinary
+	case MQTT_PROP_USER_PROPERTY:
+		return propertyStringPair
+	default:
+		return propertyNone
+	}
+}
+
+// Add a property, checking the type of value for the id
+func (p *Properties) add(t propertyType, prop Property) error {
+	if prop.Id.valueType() != t {
+		return ErrBadParameter.Withf("Property %v has a different type", prop.Id)
+	}
+	*p = append(*p, prop)
+	return nil
+}
+
+// Return the first property with an id, when the type of value matches
+func (p Properties) get(t propertyType, id PropertyId) (Property, bool) {
+	if id.valueType() != t {
+		return Property{}, false
+	}
+	for _, prop := range p {
+		if prop.Id == id {
+			return prop, true
+		}
+	}
+	return Property{}, false
+}
+
+// Encode properties, preceded by their length
+func (p Properties) encode(w *encoder) {
+	var body encoder
+	for _, prop := range p {
+		body.varint(uint32(prop.Id))
+		switch prop.Id.valueType() {
+		case propertyByte:
+			body.byte(uint8(prop.Int))
+		case propertyInt16:
+			body.uint16(uint16(prop.Int))
+		case propertyInt32:
+			body.uint32(prop.Int)
+		case propertyVarint:
+			body.varint(prop.Int)
+		case propertyString:
+			body.string(prop.Value)
+		case propertyBinary:
+			body.binary(prop.Binary)
+		case propertyStringPair:
+			body.string(prop.Name)
+			body.string(prop.Value)
+		default:
+			body.err = ErrBadParameter.Withf("Invalid property 0x%02X", int(prop.Id))
+		}
+	}
+	if body.err != nil && w.err == nil {
+		w.err = body.err
+	}
+	w.varint(uint32(len(body.buf)))
+	w.bytes(body.buf)
+}
+
+// Decode properties, preceded by their length
+func decodeProperties(r *decoder) Properties {
+	n := r.varint()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	body := r.sub(int(n))
+	var result Properties
+	for body.err == nil && body.remaining() > 0 {
+		prop := Property{Id: PropertyId(body.varint())}
+		switch prop.Id.valueType() {
+		case propertyByte:
+			prop.Int = uint32(body.byte())
+		case propertyInt16:
+			prop.Int = uint32(body.uint16())
+		case propertyInt32:
+			prop.Int = body.uint32()
+		case propertyVarint:
+			prop.Int = body.varint()
+		case propertyString:
+			prop.Value = body.string()
+		case propertyBinary:
+			prop.Binary = body.binary()
+		case propertyStringPair:
+			prop.Name = body.string()
+			prop.Value = body.string()
+		default:
+			body.fail("Invalid property 0x%02X", int(prop.Id))
+		}
+		result = append(result, prop)
+	}
+	if body.err != nil {
+		r.err = body.err
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,222 @@
+package mqtt
+
+import (
+	"fmt"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// ReasonCode is an MQTT v5 reason code, as returned by the broker. Return
+// codes of MQTT v3 connection acknowledgements are mapped to reason codes
+type (
+	ReasonCode int
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	MQTT_RC_SUCCESS                        ReasonCode = 0x00
+	MQTT_RC_NORMAL_DISCONNECTION           ReasonCode = 0x00
+	MQTT_RC_GRANTED_QOS0                   ReasonCode = 0x00
+	MQTT_RC_GRANTED_QOS1                   ReasonCode = 0x01
+	MQTT_RC_GRANTED_QOS2                   ReasonCode = 0x02
+	MQTT_RC_DISCONNECT_WITH_WILL_MSG       ReasonCode = 0x04
+	MQTT_RC_NO_MATCHING_SUBSCRIBERS        ReasonCode = 0x10
+	MQTT_RC_NO_SUBSCRIPTION_EXISTED        ReasonCode = 0x11
+	MQTT_RC_CONTINUE_AUTHENTICATION        ReasonCode = 0x18
+	MQTT_RC_REAUTHENTICATE                 ReasonCode = 0x19
+	MQTT_RC_UNSPECIFIED                    ReasonCode = 0x80
+	MQTT_RC_MALFORMED_PACKET               ReasonCode = 0x81
+	MQTT_RC_PROTOCOL_ERROR                 ReasonCode = 0x82
+	MQTT_RC_IMPLEMENTATION_SPECIFIC        ReasonCode = 0x83
+	MQTT_RC_UNSUPPORTED_PROTOCOL_VERSION   ReasonCode = 0x84
+	MQTT_RC_CLIENTID_NOT_VALID             ReasonCode = 0x85
+	MQTT_RC_BAD_USERNAME_OR_PASSWORD       ReasonCode = 0x86
+	MQTT_RC_NOT_AUTHORIZED                 ReasonCode = 0x87
+	MQTT_RC_SERVER_UNAVAILABLE             ReasonCode = 0x88
+	MQTT_RC_SERVER_BUSY                    ReasonCode = 0x89
+	MQTT_RC_BANNED                         ReasonCode = 0x8A
+	MQTT_RC_SERVER_SHUTTING_DOWN           ReasonCode = 0x8B
+	MQTT_RC_BAD_AUTHENTICATION_METHOD      ReasonCode = 0x8C
+	MQTT_RC_KEEP_ALIVE_TIMEOUT             ReasonCode = 0x8D
+	MQTT_RC_SESSION_TAKEN_OVER             ReasonCode = 0x8E
+	MQTT_RC_TOPIC_FILTER_INVALID           ReasonCode = 0x8F
+	MQTT_RC_TOPIC_NAME_INVALID             ReasonCode = 0x90
+	MQTT_RC_PACKET_ID_IN_USE               ReasonCode = 0x91
+	MQTT_RC_PACKET_ID_NOT_FOUND            ReasonCode = 0x92
+	MQTT_RC_RECEIVE_MAXIMUM_EXCEEDED       ReasonCode = 0x93
+	MQTT_RC_TOPIC_ALIAS_INVALID            ReasonCode = 0x94
+	MQTT_RC_PACKET_TOO_LARGE               ReasonCode = 0x95
+	MQTT_RC_MESSAGE_RATE_TOO_HIGH          ReasonCode = 0x96
+	MQTT_RC_QUOTA_EXCEEDED                 ReasonCode = 0x97
+	MQTT_RC_ADMINISTRATIVE_ACTION          ReasonCode = 0x98
+	MQTT_RC_PAYLOAD_FORMAT_INVALID         ReasonCode = 0x99
+	MQTT_RC_RETAIN_NOT_SUPPORTED           ReasonCode = 0x9A
+	MQTT_RC_QOS_NOT_SUPPORTED              ReasonCode = 0x9B
+	MQTT_RC_USE_ANOTHER_SERVER             ReasonCode = 0x9C
+	MQTT_RC_SERVER_MOVED                   ReasonCode = 0x9D
+	MQTT_RC_SHARED_SUBS_NOT_SUPPORTED      ReasonCode = 0x9E
+	MQTT_RC_CONNECTION_RATE_EXCEEDED       ReasonCode = 0x9F
+	MQTT_RC_MAXIMUM_CONNECT_TIME           ReasonCode = 0xA0
+	MQTT_RC_SUBSCRIPTION_IDS_NOT_SUPPORTED ReasonCode = 0xA1
+	MQTT_RC_WILDCARD_SUBS_NOT_SUPPORTED    ReasonCode = 0xA2
+)
+
+// Return codes of an MQTT v3 connection acknowledgement
+const (
+	connackAccepted           = 0
+	connackRefusedProtocol    = 1
+	connackRefusedIdentifier  = 2
+	connackRefusedUnavailable = 3
+	connackRefusedCredentials = 4
+	connackRefusedAuthorized  = 5
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Failed returns true if the reason code indicates failure
+func (rc ReasonCode) Failed() bool {
+	return rc >= MQTT_RC_UNSPECIFIED
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (rc ReasonCode) Error() string {
+	switch rc {
+	case MQTT_RC_SUCCESS:
+		return "Success"
+	case MQTT_RC_GRANTED_QOS1:
+		return "Granted QoS 1"
+	case MQTT_RC_GRANTED_QOS2:
+		return "Granted QoS 2"
+	case MQTT_RC_DISCONNECT_WITH_WILL_MSG:
+		return "Disconnect with Will Message"
+	case MQTT_RC_NO_MATCHING_SUBSCRIBERS:
+		return "No matching subscribers"
+	case MQTT_RC_NO_SUBSCRIPTION_EXISTED:
+		return "No subscription existed"
+	case MQTT_RC_CONTINUE_AUTHENTICATION:
+		return "Continue authentication"
+	case MQTT_RC_REAUTHENTICATE:
+		return "Re-authenticate"
+	case MQTT_RC_UNSPECIFIED:
+		return "Unspecified error"
+	case MQTT_RC_MALFORMED_PACKET:
+		return "Malformed Packet"
+	case MQTT_RC_PROTOCOL_ERROR:
+		return "Protocol Error"
+	case MQTT_RC_IMPLEMENTATION_SPECIFIC:
+		return "Implementation specific error"
+	case MQTT_RC_UNSUPPORTED_PROTOCOL_VERSION:
+		return "Unsupported Protocol Version"
+	case MQTT_RC_CLIENTID_NOT_VALID:
+		return "Client Identifier not valid"
+	case MQTT_RC_BAD_USERNAME_OR_PASSWORD:
+		return "Bad User Name or Password"
+	case MQTT_RC_NOT_AUTHORIZED:
+		return "Not authorized"
+	case MQTT_RC_SERVER_UNAVAILABLE:
+		return "Server unavailable"
+	case MQTT_RC_SERVER_BUSY:
+		return "Server busy"
+	case MQTT_RC_BANNED:
+		return "Banned"
+	case MQTT_RC_SERVER_SHUTTING_DOWN:
+		return "Server shutting down"
+	case MQTT_RC_BAD_AUTHENTICATION_METHOD:
+		return "Bad authentication method"
+	case MQTT_RC_KEEP_ALIVE_TIMEOUT:
+		return "Keep Alive timeout"
+	case MQTT_RC_SESSION_TAKEN_OVER:
+		return "Session taken over"
+	case MQTT_RC_TOPIC_FILTER_INVALID:
+		return "Topic Filter invalid"
+	case MQTT_RC_TOPIC_NAME_INVALID:
+		return "Topic Name invalid"
+	case MQTT_RC_PACKET_ID_IN_USE:
+		return "Packet Identifier in use"
+	case MQTT_RC_PACKET_ID_NOT_FOUND:
+		return "Packet Identifier not found"
+	case MQTT_RC_RECEIVE_MAXIMUM_EXCEEDED:
+		return "Receive Maximum exceeded"
+	case MQTT_RC_TOPIC_ALIAS_INVALID:
+		return "Topic Alias invalid"
+	case MQTT_RC_PACKET_TOO_LARGE:
+		return "Packet too large"
+	case MQTT_RC_MESSAGE_RATE_TOO_HIGH:
+		return "Message rate too high"
+	case MQTT_RC_QUOTA_EXCEEDED:
+		return "Quota exceeded"
+	case MQTT_RC_ADMINISTRATIVE_ACTION:
+		return "Administrative action"
+	case MQTT_RC_PAYLOAD_FORMAT_INVALID:
+		return "Payload format invalid"
+	case MQTT_RC_RETAIN_NOT_SUPPORTED:
+		return "Retain not supported"
+	case MQTT_RC_QOS_NOT_SUPPORTED:
+		return "QoS not supported"
+	case MQTT_RC_USE_ANOTHER_SERVER:
+		return "Use another server"
+	case MQTT_RC_SERVER_MOVED:
+		return "Server moved"
+	case MQTT_RC_SHARED_SUBS_NOT_SUPPORTED:
+		return "Shared Subscriptions not supported"
+	case MQTT_RC_CONNECTION_RATE_EXCEEDED:
+		return "Connection rate exceeded"
+	case MQTT_RC_MAXIMUM_CONNECT_TIME:
+		return "Maximum connect time"
+	case MQTT_RC_SUBSCRIPTION_IDS_NOT_SUPPORTED:
+		return "Subscription identifiers not supported"
+	case MQTT_RC_WILDCARD_SUBS_NOT_SUPPORTED:
+		return "Wildcard Subscriptions not supported"
+	default:
+		return fmt.Sprintf("Unknown reason 0x%02X", int(rc))
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return the reason code for the return code of an MQTT v3 connection
+// acknowledgement
+func connackReason(rc ReasonCode) ReasonCode {
+	switch rc {
+	case connackAccepted:
+		return MQTT_RC_SUCCESS
+	case connackRefusedProtocol:
+		return MQTT_RC_UNSUPPORTED_PROTOCOL_VERSION
+	case connackRefusedIdentifier:
+		return MQTT_RC_CLIENTID_NOT_VALID
+	case connackRefusedUnavailable:
+		return MQTT_RC_SERVER_UNAVAILABLE
+	case connackRefusedCredentials:
+		return MQTT_RC_BAD_USERNAME_OR_PASSWORD
+	case connackRefusedAuthorized:
+		return MQTT_RC_NOT_AUTHORIZED
+	default:
+		return MQTT_RC_UNSPECIFIED
+	}
+}
+
+// Return the return code of an MQTT v3 connection acknowledgement for a
+// reason code
+func connackCode(rc ReasonCode) ReasonCode {
+	switch rc {
+	case MQTT_RC_SUCCESS:
+		return connackAccepted
+	case MQTT_RC_UNSUPPORTED_PROTOCOL_VERSION:
+		return connackRefusedProtocol
+	case MQTT_RC_CLIENTID_NOT_VALID:
+		return connackRefusedIdentifier
+	case MQTT_RC_BAD_USERNAME_OR_PASSWORD:
+		return connackRefusedCredentials
+	case MQTT_RC_NOT_AUTHORIZED:
+		return connackRefusedAuthorized
+	default:
+		return connackRefusedUnavailable
+	}
+}
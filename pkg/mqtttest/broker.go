@@ -0,0 +1,657 @@
+package mqtttest
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	// Packages
+	mqtt "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+	topic "github.com/mutablelogic/go-mosquitto/pkg/topic"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// Broker is an MQTT broker for tests, which listens on a local port.
+// Sessions are kept until the broker is closed, but messages are not
+// queued for clients which are not connected, and messages are not sent
+// again when they are not acknowledged
+type Broker struct {
+	sync.Mutex
+	sync.WaitGroup
+	listener net.Listener
+	closed   bool
+
+	// Sessions keyed by client id, connections and retained messages keyed
+	// by topic
+	sessions map[string]*session
+	conns    map[*conn]struct{}
+	retained map[string]*mqtt.Packet
+	next     int
+	each     bool
+
+	// Authentication and fault injection
+	users   map[string]string
+	connack mqtt.ReasonCode
+	delay   time.Duration
+	hook    HookFunc
+}
+
+// HookFunc is called with each packet received from a client, before the
+// packet is handled. The client id is empty for a connect request. Return
+// false to drop the connection without handling the packet
+type HookFunc func(clientId string, p *mqtt.Packet) bool
+
+// session is the state of a client, which is kept while the client is not
+// connected unless the client asked for a clean session
+type session struct {
+	clientId      string
+	clean         bool
+	conn          *conn
+	subscriptions map[string]subscription
+	will          *time.Timer
+}
+
+// subscription is the options of a subscription, including the QoS, and
+// the subscription identifier (MQTT v5 only)
+type subscription struct {
+	options int
+	id      uint32
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Time to wait for a connect request
+	connectTimeout = 10 * time.Second
+
+	// Options of a subscription
+	subQoS = 0x03
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewBroker returns a broker listening on a free port on 127.0.0.1. Close
+// the broker when the test is done
+func NewBroker() (*Broker, error) {
+	b := new(Broker)
+	b.sessions = make(map[string]*session)
+	b.conns = make(map[*conn]struct{})
+	b.retained = make(map[string]*mqtt.Packet)
+	b.users = make(map[string]string)
+
+	// Listen on a free port
+	if listener, err := net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return nil, err
+	} else {
+		b.listener = listener
+	}
+
+	// Accept connections in the background
+	b.WaitGroup.Add(1)
+	go b.run()
+
+	// Return success
+	return b, nil
+}
+
+// Close the broker and the connections of all clients, without publishing
+// will messages
+func (b *Broker) Close() error {
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		return ErrOutOfOrder.With("Broker is closed")
+	}
+	b.closed = true
+	for _, s := range b.sessions {
+		if s.will != nil {
+			s.will.Stop()
+		}
+	}
+	conns := b.connections()
+	b.Unlock()
+
+	// Stop accepting connections, close connections and wait for the
+	// goroutines to end
+	err := b.listener.Close()
+	for _, c := range conns {
+		c.Close()
+	}
+	b.WaitGroup.Wait()
+
+	// Return any error
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (b *Broker) String() string {
+	str := "<broker"
+	str += fmt.Sprintf(" addr=%q", b.Addr())
+	str += fmt.Sprintf(" clients=%q", b.Clients())
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Addr returns the address of the broker as host:port
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Clients returns the ids of the connected clients, in order
+func (b *Broker) Clients() []string {
+	b.Lock()
+	defer b.Unlock()
+	result := make([]string, 0, len(b.sessions))
+	for id, s := range b.sessions {
+		if s.conn != nil {
+			result = append(result, id)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Retained returns the payload of the retained message for a topic, or
+// false if there is no retained message
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.Lock()
+	defer b.Unlock()
+	if msg, exists := b.retained[topic]; exists {
+		return msg.Payload, true
+	} else {
+		return nil, false
+	}
+}
+
+// Publish a message to the clients which have subscribed to the topic
+func (b *Broker) Publish(v string, payload []byte, qos int, retain bool) error {
+	if v == "" {
+		return ErrBadParameter.With("Empty topic")
+	} else if err := topic.ValidatePublish(v); err != nil {
+		return err
+	} else if qos < 0 || qos > 2 {
+		return ErrBadParameter.Withf("Invalid qos %v", qos)
+	}
+	b.publish(nil, &mqtt.Packet{Type: mqtt.CMD_PUBLISH, Topic: v, Payload: payload, QoS: qos, Retain: retain})
+	return nil
+}
+
+// SetCredentials requires clients to connect with a username and password.
+// Call more than once to add more than one user
+func (b *Broker) SetCredentials(user, password string) {
+	b.Lock()
+	defer b.Unlock()
+	b.users[user] = password
+}
+
+// SetConnack refuses connections with a reason code, which is converted to
+// a return code for MQTT v3 clients. Connections are accepted again with
+// MQTT_RC_SUCCESS
+func (b *Broker) SetConnack(rc mqtt.ReasonCode) {
+	b.Lock()
+	defer b.Unlock()
+	b.connack = rc
+}
+
+// SetDeliverEach sets whether a client receives a message once for each
+// matching subscription, with the QoS and subscription identifier of the
+// subscription, as mosquitto does. By default a client receives a message
+// once, with the highest QoS of the matching subscriptions
+func (b *Broker) SetDeliverEach(v bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.each = v
+}
+
+// SetAckDelay delays the acknowledgement of connect, subscribe,
+// unsubscribe and publish requests. Zero removes the delay
+func (b *Broker) SetAckDelay(d time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.delay = d
+}
+
+// SetHook sets a function which is called with each packet received from a
+// client, which can drop the connection. Nil removes the hook
+func (b *Broker) SetHook(fn HookFunc) {
+	b.Lock()
+	defer b.Unlock()
+	b.hook = fn
+}
+
+// Drop closes the connections of all clients without a disconnect, so the
+// will messages of the clients are published, and returns the number of
+// connections closed
+func (b *Broker) Drop() int {
+	b.Lock()
+	conns := b.connections()
+	b.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// DropClient closes the connection of a client without a disconnect, and
+// returns false if the client is not connected
+func (b *Broker) DropClient(clientId string) bool {
+	var c *conn
+	b.Lock()
+	if s, exists := b.sessions[clientId]; exists {
+		c = s.conn
+	}
+	b.Unlock()
+	if c == nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Accept connections until the listener is closed
+func (b *Broker) run() {
+	defer b.WaitGroup.Done()
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.WaitGroup.Add(1)
+		go func() {
+			defer b.WaitGroup.Done()
+			b.serve(nc)
+		}()
+	}
+}
+
+// Serve a connection until it is closed
+func (b *Broker) serve(nc net.Conn) {
+	c := newConn(nc)
+	b.Lock()
+	if b.closed {
+		b.Unlock()
+		nc.Close()
+		return
+	}
+	b.conns[c] = struct{}{}
+	b.Unlock()
+
+	// The first packet is the connect request
+	nc.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := mqtt.ReadPacket(nc, mqtt.MQTT_PROTOCOL_V311)
+	if err != nil || p.Type != mqtt.CMD_CONNECT || !b.hooked(c, p) || !b.connect(c, p) {
+		b.lost(c, false)
+		return
+	}
+
+	// Handle packets until the connection is closed, or the client does not
+	// send a packet within one and a half times the keepalive
+	for {
+		if c.keepalive > 0 {
+			nc.SetReadDeadline(time.Now().Add(c.keepalive * 3 / 2))
+		} else {
+			nc.SetReadDeadline(time.Time{})
+		}
+		p, err := mqtt.ReadPacket(nc, c.version)
+		if err != nil || !b.hooked(c, p) {
+			b.lost(c, true)
+			return
+		} else if !b.handle(c, p) {
+			return
+		}
+	}
+}
+
+// Return false if the hook drops the connection
+func (b *Broker) hooked(c *conn, p *mqtt.Packet) bool {
+	b.Lock()
+	fn := b.hook
+	b.Unlock()
+	return fn == nil || fn(c.clientId, p)
+}
+
+// Authenticate a client and acknowledge the connection. Returns false if
+// the connection is refused
+func (b *Broker) connect(c *conn, p *mqtt.Packet) bool {
+	c.version = p.Version
+	b.Lock()
+	rc, delay := b.connack, b.delay
+	if password, exists := b.users[p.Username]; !rc.Failed() && len(b.users) > 0 && (!exists || password != string(p.Password)) {
+		rc = mqtt.MQTT_RC_BAD_USERNAME_OR_PASSWORD
+	} else if !rc.Failed() && p.ClientId == "" && !p.Clean {
+		rc = mqtt.MQTT_RC_CLIENTID_NOT_VALID
+	}
+	if rc.Failed() {
+		b.Unlock()
+		time.Sleep(delay)
+		c.write(&mqtt.Packet{Type: mqtt.CMD_CONNACK, ReasonCode: rc})
+		return false
+	}
+
+	// Assign a client id when empty
+	var props mqtt.Properties
+	clientId := p.ClientId
+	if clientId == "" {
+		b.next++
+		clientId = fmt.Sprint("mqtttest-", b.next)
+		if c.version == mqtt.MQTT_PROTOCOL_V5 {
+			props.AddString(mqtt.MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER, clientId)
+		}
+	}
+
+	// Take over an existing session, or start a new session
+	s, present := b.sessions[clientId]
+	var old *conn
+	if present {
+		if old = s.conn; old != nil {
+			old.will = nil
+		}
+		if s.will != nil {
+			s.will.Stop()
+			s.will = nil
+		}
+	}
+	if !present || p.Clean {
+		s = &session{clientId: clientId, subscriptions: make(map[string]subscription)}
+		b.sessions[clientId] = s
+	}
+	s.clean = p.Clean
+	s.conn = c
+	c.session = s
+	c.clientId = clientId
+	c.will = p.Will
+	c.keepalive = time.Duration(p.KeepAlive) * time.Second
+	b.Unlock()
+
+	// Close the connection which has been taken over
+	if old != nil {
+		if old.version == mqtt.MQTT_PROTOCOL_V5 {
+			old.write(&mqtt.Packet{Type: mqtt.CMD_DISCONNECT, ReasonCode: mqtt.MQTT_RC_SESSION_TAKEN_OVER})
+		}
+		old.Close()
+	}
+
+	// Acknowledge the connection
+	time.Sleep(delay)
+	return c.write(&mqtt.Packet{Type: mqtt.CMD_CONNACK, SessionPresent: present && !p.Clean, Properties: props}) == nil
+}
+
+// Handle a packet from a client, and return false if the connection has
+// been closed
+func (b *Broker) handle(c *conn, p *mqtt.Packet) bool {
+	switch p.Type {
+	case mqtt.CMD_PUBLISH:
+		if p.Topic == "" || topic.ValidatePublish(p.Topic) != nil {
+			b.lost(c, true)
+			return false
+		}
+		switch p.QoS {
+		case 0:
+			b.publish(c, p)
+		case 1:
+			b.publish(c, p)
+			b.ack(c, &mqtt.Packet{Type: mqtt.CMD_PUBACK, Id: p.Id})
+		case 2:
+			// The message is published once, even if sent again
+			if !c.incoming[p.Id] {
+				c.incoming[p.Id] = true
+				b.publish(c, p)
+			}
+			b.ack(c, &mqtt.Packet{Type: mqtt.CMD_PUBREC, Id: p.Id})
+		}
+	case mqtt.CMD_PUBREL:
+		delete(c.incoming, p.Id)
+		b.ack(c, &mqtt.Packet{Type: mqtt.CMD_PUBCOMP, Id: p.Id})
+	case mqtt.CMD_PUBREC:
+		c.write(&mqtt.Packet{Type: mqtt.CMD_PUBREL, Id: p.Id})
+	case mqtt.CMD_PUBACK, mqtt.CMD_PUBCOMP:
+		// Messages are not sent again, so there is nothing to do
+	case mqtt.CMD_SUBSCRIBE:
+		b.subscribe(c, p)
+	case mqtt.CMD_UNSUBSCRIBE:
+		b.unsubscribe(c, p)
+	case mqtt.CMD_PINGREQ:
+		c.write(&mqtt.Packet{Type: mqtt.CMD_PINGRESP})
+	case mqtt.CMD_DISCONNECT:
+		b.lost(c, c.version == mqtt.MQTT_PROTOCOL_V5 && p.ReasonCode == mqtt.MQTT_RC_DISCONNECT_WITH_WILL_MSG)
+		return false
+	default:
+		b.lost(c, true)
+		return false
+	}
+	return true
+}
+
+// Add subscriptions for a client, then acknowledge the request and send
+// any retained messages
+func (b *Broker) subscribe(c *conn, p *mqtt.Packet) {
+	var id uint32
+	if ids := p.Properties.GetVarints(mqtt.MQTT_PROP_SUBSCRIPTION_IDENTIFIER); len(ids) > 0 {
+		id = ids[0]
+	}
+	packets := []*mqtt.Packet{{Type: mqtt.CMD_SUBACK, Id: p.Id}}
+
+	b.Lock()
+	defer func() {
+		b.Unlock()
+		b.ack(c, packets...)
+	}()
+	s := c.session
+	for _, sub := range p.Subscriptions {
+		qos := sub.Options & subQoS
+		if qos > 2 || sub.Topic == "" || topic.ValidateSubscribe(sub.Topic) != nil {
+			rc := mqtt.MQTT_RC_UNSPECIFIED
+			if c.version == mqtt.MQTT_PROTOCOL_V5 {
+				rc = mqtt.MQTT_RC_TOPIC_FILTER_INVALID
+			}
+			packets[0].ReasonCodes = append(packets[0].ReasonCodes, rc)
+			continue
+		}
+		_, exists := s.subscriptions[sub.Topic]
+		s.subscriptions[sub.Topic] = subscription{sub.Options, id}
+		packets[0].ReasonCodes = append(packets[0].ReasonCodes, mqtt.ReasonCode(qos))
+
+		// Send retained messages, in order of topic
+		if sub.Options&mqtt.MQTT_SUB_OPT_SEND_RETAIN_NEVER != 0 || (exists && sub.Options&mqtt.MQTT_SUB_OPT_SEND_RETAIN_NEW != 0) {
+			continue
+		}
+		topics := make([]string, 0, len(b.retained))
+		for v := range b.retained {
+			if match, _ := topic.Match(sub.Topic, v); match {
+				topics = append(topics, v)
+			}
+		}
+		sort.Strings(topics)
+		for _, v := range topics {
+			var ids []uint32
+			if id > 0 {
+				ids = append(ids, id)
+			}
+			packets = append(packets, message(b.retained[v], qos, true, ids, c.version))
+		}
+	}
+}
+
+// Remove subscriptions for a client, and acknowledge the request
+func (b *Broker) unsubscribe(c *conn, p *mqtt.Packet) {
+	unsuback := &mqtt.Packet{Type: mqtt.CMD_UNSUBACK, Id: p.Id}
+	b.Lock()
+	s := c.session
+	for _, v := range p.Topics {
+		if _, exists := s.subscriptions[v]; exists {
+			delete(s.subscriptions, v)
+			unsuback.ReasonCodes = append(unsuback.ReasonCodes, mqtt.MQTT_RC_SUCCESS)
+		} else {
+			unsuback.ReasonCodes = append(unsuback.ReasonCodes, mqtt.MQTT_RC_NO_SUBSCRIPTION_EXISTED)
+		}
+	}
+	b.Unlock()
+	b.ack(c, unsuback)
+}
+
+// Publish a message from a client, or from the broker when the client is
+// nil, to every connected client with a matching subscription. A client
+// receives the message once, with the highest QoS of the subscriptions,
+// or once for each subscription when SetDeliverEach is set
+func (b *Broker) publish(from *conn, p *mqtt.Packet) {
+	type delivery struct {
+		conn   *conn
+		packet *mqtt.Packet
+	}
+	var deliveries []delivery
+
+	b.Lock()
+	if p.Retain && len(p.Payload) == 0 {
+		delete(b.retained, p.Topic)
+	} else if p.Retain {
+		b.retained[p.Topic] = &mqtt.Packet{Type: mqtt.CMD_PUBLISH, Topic: p.Topic, Payload: p.Payload, QoS: p.QoS, Retain: true, Properties: p.Properties}
+	}
+	for _, s := range b.sessions {
+		if s.conn == nil {
+			continue
+		}
+		qos, retain, matched := 0, false, false
+		var ids []uint32
+		for filter, sub := range s.subscriptions {
+			if match, _ := topic.Match(filter, p.Topic); !match {
+				continue
+			} else if from != nil && from.session == s && sub.options&mqtt.MQTT_SUB_OPT_NO_LOCAL != 0 {
+				continue
+			}
+			if b.each {
+				var each []uint32
+				if sub.id > 0 {
+					each = append(each, sub.id)
+				}
+				deliveries = append(deliveries, delivery{s.conn, message(p, sub.options&subQoS, sub.options&mqtt.MQTT_SUB_OPT_RETAIN_AS_PUBLISHED != 0 && p.Retain, each, s.conn.version)})
+				continue
+			}
+			matched = true
+			if sub.options&subQoS > qos {
+				qos = sub.options & subQoS
+			}
+			if sub.options&mqtt.MQTT_SUB_OPT_RETAIN_AS_PUBLISHED != 0 {
+				retain = p.Retain
+			}
+			if sub.id > 0 {
+				ids = append(ids, sub.id)
+			}
+		}
+		if matched {
+			deliveries = append(deliveries, delivery{s.conn, message(p, qos, retain, ids, s.conn.version)})
+		}
+	}
+	b.Unlock()
+
+	// Send the messages
+	for _, d := range deliveries {
+		d.conn.write(d.packet)
+	}
+}
+
+// Acknowledge a request, after the delay set by SetAckDelay
+func (b *Broker) ack(c *conn, packets ...*mqtt.Packet) {
+	b.Lock()
+	delay := b.delay
+	b.Unlock()
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			c.write(packets...)
+		})
+	} else {
+		c.write(packets...)
+	}
+}
+
+// Called when a connection is closed. The will message of the client is
+// published when will is true, after the will delay unless the session ends
+func (b *Broker) lost(c *conn, will bool) {
+	c.Close()
+
+	b.Lock()
+	delete(b.conns, c)
+	s := c.session
+	if s != nil && s.conn == c {
+		s.conn = nil
+		if s.clean {
+			delete(b.sessions, s.clientId)
+		}
+	}
+	msg := c.will
+	c.will = nil
+	if !will || b.closed {
+		msg = nil
+	} else if delay, _ := willDelay(msg); delay > 0 && s != nil && !s.clean {
+		s.will = time.AfterFunc(delay, func() {
+			b.publish(nil, msg)
+		})
+		msg = nil
+	}
+	b.Unlock()
+
+	// Publish the will message
+	if msg != nil {
+		b.publish(nil, msg)
+	}
+}
+
+// Return the connections, with the lock held
+func (b *Broker) connections() []*conn {
+	result := make([]*conn, 0, len(b.conns))
+	for c := range b.conns {
+		result = append(result, c)
+	}
+	return result
+}
+
+// Return the will delay of a will message
+func willDelay(msg *mqtt.Packet) (time.Duration, bool) {
+	if msg == nil {
+		return 0, false
+	} else if v, ok := msg.Properties.GetInt32(mqtt.MQTT_PROP_WILL_DELAY_INTERVAL); ok {
+		return time.Duration(v) * time.Second, true
+	} else {
+		return 0, false
+	}
+}
+
+// Return a message to send to a client with a protocol version. Properties
+// are only sent to MQTT v5 clients, with the subscription identifiers of
+// the matching subscriptions
+func message(p *mqtt.Packet, qos int, retain bool, ids []uint32, version int) *mqtt.Packet {
+	msg := &mqtt.Packet{Type: mqtt.CMD_PUBLISH, Topic: p.Topic, Payload: p.Payload, QoS: p.QoS, Retain: retain}
+	if qos < msg.QoS {
+		msg.QoS = qos
+	}
+	if version != mqtt.MQTT_PROTOCOL_V5 {
+		return msg
+	}
+	for _, prop := range p.Properties {
+		switch prop.Id {
+		case mqtt.MQTT_PROP_TOPIC_ALIAS, mqtt.MQTT_PROP_SUBSCRIPTION_IDENTIFIER, mqtt.MQTT_PROP_WILL_DELAY_INTERVAL:
+			// Not forwarded
+		default:
+			msg.Properties = append(msg.Properties, prop)
+		}
+	}
+	for _, id := range ids {
+		msg.Properties.AddVarint(mqtt.MQTT_PROP_SUBSCRIPTION_IDENTIFIER, id)
+	}
+	return msg
+}
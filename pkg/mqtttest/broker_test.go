@@ -0,0 +1,300 @@
+package mqtttest_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	// Packages
+	mqtt "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto/pkg/mqtttest"
+)
+
+// client is a connection to the broker, with events received on channels
+type client struct {
+	*mqtt.Client
+	sync.WaitGroup
+	connect  chan mqtt.ReasonCode
+	suback   chan []int
+	publish  chan int
+	messages chan *mqtt.Packet
+	done     chan struct{}
+}
+
+func newClient(t *testing.T, addr, clientId string, fn func(*mqtt.Client)) *client {
+	t.Helper()
+	c, err := mqtt.New(clientId, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &client{
+		Client:   c,
+		connect:  make(chan mqtt.ReasonCode, 1),
+		suback:   make(chan []int, 10),
+		publish:  make(chan int, 10),
+		messages: make(chan *mqtt.Packet, 10),
+		done:     make(chan struct{}),
+	}
+	c.SetConnectCallback(func(rc mqtt.ReasonCode, flags int, props mqtt.Properties) {
+		result.connect <- rc
+	})
+	c.SetSubscribeCallback(func(id int, granted []int, props mqtt.Properties) {
+		result.suback <- granted
+	})
+	c.SetPublishCallback(func(id int, rc mqtt.ReasonCode, props mqtt.Properties) {
+		result.publish <- id
+	})
+	c.SetMessageCallback(func(message *mqtt.Packet) {
+		result.messages <- message
+	})
+	if fn != nil {
+		fn(c)
+	}
+	if err := c.Connect(context.Background(), "tcp", addr, 60*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the loop until closed
+	result.Add(1)
+	go func() {
+		defer result.Done()
+		for {
+			select {
+			case <-result.done:
+				return
+			default:
+				c.Loop(10 * time.Millisecond)
+			}
+		}
+	}()
+	return result
+}
+
+func (c *client) close() {
+	close(c.done)
+	c.Wait()
+	c.Close()
+}
+
+func (c *client) waitConnect(t *testing.T) mqtt.ReasonCode {
+	t.Helper()
+	select {
+	case rc := <-c.connect:
+		return rc
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for connect")
+	}
+	return 0
+}
+
+func (c *client) waitMessage(t *testing.T) *mqtt.Packet {
+	t.Helper()
+	select {
+	case msg := <-c.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+	return nil
+}
+
+func (c *client) waitSuback(t *testing.T) []int {
+	t.Helper()
+	select {
+	case granted := <-c.suback:
+		return granted
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for subscribe")
+	}
+	return nil
+}
+
+func Test_Broker_001(t *testing.T) {
+	broker, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	t.Log(broker)
+
+	// Subscribe with wildcards, then publish with each QoS
+	c := newClient(t, broker.Addr(), "test", nil)
+	defer c.close()
+	if rc := c.waitConnect(t); rc != mqtt.MQTT_RC_SUCCESS {
+		t.Fatal("Unexpected reason code", rc)
+	}
+	if _, err := c.Subscribe([]string{"a/+/c", "b/#", "$SYS/#", "a/#x"}, 2, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if granted := c.waitSuback(t); len(granted) != 4 || granted[0] != 2 || granted[3] != 0x80 {
+		t.Error("Unexpected granted QoS", granted)
+	}
+	for qos := 0; qos <= 2; qos++ {
+		if _, err := c.Publish("a/b/c", []byte("data"), qos, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if msg := c.waitMessage(t); msg.Topic != "a/b/c" || msg.QoS != qos || string(msg.Payload) != "data" {
+			t.Error("Unexpected message", msg)
+		}
+	}
+	if _, err := c.Publish("a/b/d", nil, 0, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-c.messages:
+		t.Error("Unexpected message", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if clients := broker.Clients(); len(clients) != 1 || clients[0] != "test" {
+		t.Error("Unexpected clients", clients)
+	}
+}
+
+func Test_Broker_002(t *testing.T) {
+	broker, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	// Retained messages are sent on subscribe, and removed with an empty payload
+	if err := broker.Publish("a/b", []byte("one"), 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish("a/c", []byte("two"), 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Publish("a/c", nil, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := broker.Retained("a/c"); exists {
+		t.Error("Expected retained message to be removed")
+	}
+	c := newClient(t, broker.Addr(), "", nil)
+	defer c.close()
+	c.waitConnect(t)
+	if _, err := c.Subscribe([]string{"a/#"}, 0, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg := c.waitMessage(t); msg.Topic != "a/b" || !msg.Retain || msg.QoS != 0 {
+		t.Error("Unexpected message", msg)
+	}
+}
+
+func Test_Broker_003(t *testing.T) {
+	broker, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	// The will message is published when the connection is dropped
+	a := newClient(t, broker.Addr(), "a", nil)
+	defer a.close()
+	a.waitConnect(t)
+	if _, err := a.Subscribe([]string{"will"}, 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	a.waitSuback(t)
+	b := newClient(t, broker.Addr(), "b", func(c *mqtt.Client) {
+		c.SetWill("will", []byte("gone"), 1, false, nil)
+	})
+	defer b.close()
+	b.waitConnect(t)
+	if !broker.DropClient("b") {
+		t.Error("Expected client to be dropped")
+	}
+	if msg := a.waitMessage(t); msg.Topic != "will" || string(msg.Payload) != "gone" {
+		t.Error("Unexpected message", msg)
+	}
+	if broker.DropClient("b") {
+		t.Error("Unexpected client")
+	}
+}
+
+func Test_Broker_004(t *testing.T) {
+	broker, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	// Credentials are required
+	broker.SetCredentials("user", "password")
+	for _, version := range []int{mqtt.MQTT_PROTOCOL_V311, mqtt.MQTT_PROTOCOL_V5} {
+		c := newClient(t, broker.Addr(), "", func(c *mqtt.Client) {
+			c.SetProtocol(version)
+			c.SetCredentials("user", "wrong")
+		})
+		if rc := c.waitConnect(t); rc != mqtt.MQTT_RC_BAD_USERNAME_OR_PASSWORD {
+			t.Error("Unexpected reason code", rc)
+		}
+		c.close()
+	}
+	c := newClient(t, broker.Addr(), "", func(c *mqtt.Client) {
+		c.SetCredentials("user", "password")
+	})
+	if rc := c.waitConnect(t); rc != mqtt.MQTT_RC_SUCCESS {
+		t.Error("Unexpected reason code", rc)
+	}
+	c.close()
+
+	// Connections are refused with a reason code
+	broker.SetConnack(mqtt.MQTT_RC_SERVER_UNAVAILABLE)
+	c = newClient(t, broker.Addr(), "", func(c *mqtt.Client) {
+		c.SetCredentials("user", "password")
+	})
+	if rc := c.waitConnect(t); rc != mqtt.MQTT_RC_SERVER_UNAVAILABLE {
+		t.Error("Unexpected reason code", rc)
+	}
+	c.close()
+}
+
+func Test_Broker_005(t *testing.T) {
+	broker, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	// Acknowledgements are delayed
+	c := newClient(t, broker.Addr(), "", nil)
+	defer c.close()
+	c.waitConnect(t)
+	broker.SetAckDelay(200 * time.Millisecond)
+	now := time.Now()
+	if _, err := c.Publish("a", nil, 1, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.publish:
+		if d := time.Since(now); d < 200*time.Millisecond {
+			t.Error("Acknowledgement not delayed", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for acknowledgement")
+	}
+
+	// The hook drops the connection on publish
+	disconnected := make(chan error, 1)
+	c.SetDisconnectCallback(func(err error, props mqtt.Properties) {
+		disconnected <- err
+	})
+	broker.SetHook(func(clientId string, p *mqtt.Packet) bool {
+		return p.Type != mqtt.CMD_PUBLISH
+	})
+	if _, err := c.Publish("a", nil, 0, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-disconnected:
+		if err == nil {
+			t.Error("Expected error for lost connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for disconnect")
+	}
+}
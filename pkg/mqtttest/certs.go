@@ -0,0 +1,108 @@
+package mqtttest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Lifetime of generated certificates
+	certLifetime = 24 * time.Hour
+
+	// Size of the salt of a hashed password
+	saltSize = 12
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Write a certificate authority, a certificate for the broker on 127.0.0.1
+// and localhost, and a client certificate to a directory, with the keys
+func writeCerts(dir string) error {
+	// Create the certificate authority
+	cakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	ca := newCert(1, "mqtttest CA")
+	ca.IsCA = true
+	ca.KeyUsage |= x509.KeyUsageCertSign
+	if err := writeCert(dir, "ca", ca, ca, cakey, cakey); err != nil {
+		return err
+	}
+
+	// Create the broker and client certificates, signed by the certificate
+	// authority
+	server := newCert(2, "localhost")
+	server.DNSNames = []string{"localhost"}
+	server.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	client := newCert(3, "mqtttest client")
+	client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	for name, cert := range map[string]*x509.Certificate{"server": server, "client": client} {
+		if key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		} else if err := writeCert(dir, name, cert, ca, key, cakey); err != nil {
+			return err
+		}
+	}
+
+	// Return success
+	return nil
+}
+
+// Return a certificate template
+func newCert(serial int64, name string) *x509.Certificate {
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+}
+
+// Sign a certificate and write it as name.crt, with the key as name.key
+func writeCert(dir, name string, cert, parent *x509.Certificate, key, signer *ecdsa.PrivateKey) error {
+	der, err := x509.CreateCertificate(rand.Reader, cert, parent, &key.PublicKey, signer)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	data, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: data}), 0600)
+}
+
+// Return a password hashed for a mosquitto password file, which is the
+// SHA512 hash of the password and salt
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := sha512.New()
+	hash.Write([]byte(password))
+	hash.Write(salt)
+	return "$6$" + base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
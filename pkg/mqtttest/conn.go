@@ -0,0 +1,69 @@
+package mqtttest
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	// Packages
+	mqtt "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// conn is a connection from a client. The session, client id and will are
+// set when the connection is acknowledged, and protected by the lock of the
+// broker. Incoming is only used by the goroutine which reads packets
+type conn struct {
+	net.Conn
+	wmu       sync.Mutex
+	version   int
+	keepalive time.Duration
+	clientId  string
+	session   *session
+	will      *mqtt.Packet
+	next      uint16
+	incoming  map[uint16]bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Timeout for writing a packet
+	writeTimeout = 10 * time.Second
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+func newConn(nc net.Conn) *conn {
+	return &conn{
+		Conn:     nc,
+		version:  mqtt.MQTT_PROTOCOL_V311,
+		incoming: make(map[uint16]bool),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Write packets in order, setting the message id of messages with QoS 1 or 2
+func (c *conn) write(packets ...*mqtt.Packet) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for _, p := range packets {
+		if p.Type == mqtt.CMD_PUBLISH && p.QoS > 0 {
+			if c.next++; c.next == 0 {
+				c.next = 1
+			}
+			p.Id = c.next
+		}
+		c.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := p.Write(c.Conn, c.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
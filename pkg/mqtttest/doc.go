@@ -0,0 +1,15 @@
+/*
+Utilities for testing MQTT clients without a network connection to a
+public broker. NewBroker returns a small broker implemented in Go, which
+listens on a local port and supports wildcard subscriptions, retained
+messages, QoS 0, 1 and 2, will messages and authentication, with hooks to
+inject faults such as dropped connections, delayed acknowledgements and
+refused connections.
+
+NewMosquitto runs the mosquitto broker installed on the system instead,
+with TLS listeners, password and access control files generated for the
+test, and skips the test when mosquitto is not installed.
+For more information please see
+https://github.com/mutablelogic/go-mosquitto/blob/master/README.md
+*/
+package mqtttest
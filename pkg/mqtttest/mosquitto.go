@@ -0,0 +1,370 @@
+package mqtttest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// MosquittoConfig is the configuration of a mosquitto broker process
+type MosquittoConfig struct {
+	tls     bool
+	require bool
+	users   [][2]string
+	acl     []string
+	lines   []string
+}
+
+// Mosquitto is a mosquitto broker process, which listens on free ports on
+// 127.0.0.1 for plain connections, and for TLS connections when configured
+type Mosquitto struct {
+	cmd     *exec.Cmd
+	dir     string
+	addr    string
+	tlsaddr string
+	log     *logBuffer
+	done    chan struct{}
+}
+
+// logBuffer is the output of the broker, which is written by the process
+// and read by tests
+type logBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Name of the binary
+	mosquittoBinary = "mosquitto"
+
+	// Time to wait for the broker to be ready, and to stop
+	mosquittoTimeout = 5 * time.Second
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// GLOBALS
+
+var (
+	// Directories searched for the binary when it is not on the path
+	mosquittoPaths = []string{"/usr/sbin", "/usr/local/sbin", "/opt/homebrew/sbin"}
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CONFIGURATION OPTIONS
+
+// NewMosquittoConfig returns a configuration for a broker which allows
+// anonymous clients on a plain listener
+func NewMosquittoConfig() MosquittoConfig {
+	return MosquittoConfig{}
+}
+
+// WithTLS adds a TLS listener, with a certificate authority, broker
+// certificate and client certificate generated for the broker. When
+// require is true, clients need to connect with the client certificate
+func (c MosquittoConfig) WithTLS(require bool) MosquittoConfig {
+	c.tls = true
+	c.require = require
+	return c
+}
+
+// WithUser adds a user to the password file, so anonymous clients are not
+// allowed
+func (c MosquittoConfig) WithUser(user, password string) MosquittoConfig {
+	c.users = append(append([][2]string{}, c.users...), [2]string{user, password})
+	return c
+}
+
+// WithACL adds lines to the access control list file, such as
+// "user name" and "topic readwrite a/#"
+func (c MosquittoConfig) WithACL(lines ...string) MosquittoConfig {
+	c.acl = append(append([]string{}, c.acl...), lines...)
+	return c
+}
+
+// WithConfig adds lines to the configuration file of the broker, which are
+// set before the listeners
+func (c MosquittoConfig) WithConfig(lines ...string) MosquittoConfig {
+	c.lines = append(append([]string{}, c.lines...), lines...)
+	return c
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewMosquitto starts a mosquitto broker and waits until it accepts
+// connections. The test is skipped when the mosquitto binary is not found,
+// and fails if the broker cannot be started. Close the broker when the test
+// is done
+func NewMosquitto(t testing.TB, cfg MosquittoConfig) *Mosquitto {
+	t.Helper()
+	path, err := lookMosquitto()
+	if err != nil {
+		t.Skip(err)
+	}
+	m, err := startMosquitto(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Close stops the broker, and removes the configuration and certificates
+func (m *Mosquitto) Close() error {
+	var result error
+	if err := m.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		result = err
+	}
+	select {
+	case <-m.done:
+	case <-time.After(mosquittoTimeout):
+		m.cmd.Process.Kill()
+		<-m.done
+	}
+	if err := os.RemoveAll(m.dir); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (m *Mosquitto) String() string {
+	str := "<mosquitto"
+	str += fmt.Sprintf(" addr=%q", m.addr)
+	if m.tlsaddr != "" {
+		str += fmt.Sprintf(" tlsaddr=%q", m.tlsaddr)
+	}
+	return str + ">"
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Addr returns the address of the plain listener as host:port
+func (m *Mosquitto) Addr() string {
+	return m.addr
+}
+
+// TLSAddr returns the address of the TLS listener as host:port, or an
+// empty string if there is no TLS listener
+func (m *Mosquitto) TLSAddr() string {
+	return m.tlsaddr
+}
+
+// CAFile returns the path to the certificate authority which signed the
+// broker and client certificates
+func (m *Mosquitto) CAFile() string {
+	return filepath.Join(m.dir, "ca.crt")
+}
+
+// CertFile returns the path to the client certificate
+func (m *Mosquitto) CertFile() string {
+	return filepath.Join(m.dir, "client.crt")
+}
+
+// KeyFile returns the path to the key of the client certificate
+func (m *Mosquitto) KeyFile() string {
+	return filepath.Join(m.dir, "client.key")
+}
+
+// Log returns the output of the broker so far
+func (m *Mosquitto) Log() string {
+	m.log.Lock()
+	defer m.log.Unlock()
+	return m.log.String()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return the path to the mosquitto binary, or an error if not found
+func lookMosquitto() (string, error) {
+	if path, err := exec.LookPath(mosquittoBinary); err == nil {
+		return path, nil
+	}
+	for _, dir := range mosquittoPaths {
+		if path, err := exec.LookPath(filepath.Join(dir, mosquittoBinary)); err == nil {
+			return path, nil
+		}
+	}
+	return "", ErrNotFound.With("mosquitto binary")
+}
+
+// Write the configuration, start the broker and wait until it is ready
+func startMosquitto(path string, cfg MosquittoConfig) (*Mosquitto, error) {
+	m := &Mosquitto{log: new(logBuffer), done: make(chan struct{})}
+	if dir, err := ioutil.TempDir("", "mqtttest"); err != nil {
+		return nil, err
+	} else {
+		m.dir = dir
+	}
+
+	// Write the configuration and start the broker
+	conf, err := m.writeConfig(cfg)
+	if err != nil {
+		os.RemoveAll(m.dir)
+		return nil, err
+	}
+	m.cmd = exec.Command(path, "-c", conf)
+	m.cmd.Stdout = m.log
+	m.cmd.Stderr = m.log
+	if err := m.cmd.Start(); err != nil {
+		os.RemoveAll(m.dir)
+		return nil, err
+	}
+	go func() {
+		m.cmd.Wait()
+		close(m.done)
+	}()
+
+	// Wait for the listeners to accept connections
+	if err := m.wait(); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	// Return success
+	return m, nil
+}
+
+// Write the configuration file, and any password, access control and
+// certificate files, and return the path to the configuration file
+func (m *Mosquitto) writeConfig(cfg MosquittoConfig) (string, error) {
+	lines := []string{
+		"per_listener_settings false",
+		"persistence false",
+		"log_dest stderr",
+		"log_type all",
+	}
+
+	// Write the password file
+	if len(cfg.users) > 0 {
+		var passwords []string
+		for _, user := range cfg.users {
+			if hash, err := hashPassword(user[1]); err != nil {
+				return "", err
+			} else {
+				passwords = append(passwords, user[0]+":"+hash)
+			}
+		}
+		if path, err := m.writeFile("passwords", passwords); err != nil {
+			return "", err
+		} else {
+			lines = append(lines, "allow_anonymous false", "password_file "+path)
+		}
+	} else {
+		lines = append(lines, "allow_anonymous true")
+	}
+
+	// Write the access control list
+	if len(cfg.acl) > 0 {
+		if path, err := m.writeFile("acl", cfg.acl); err != nil {
+			return "", err
+		} else {
+			lines = append(lines, "acl_file "+path)
+		}
+	}
+	lines = append(lines, cfg.lines...)
+
+	// Add a plain listener, and a TLS listener with certificates
+	if addr, err := freeAddr(); err != nil {
+		return "", err
+	} else {
+		m.addr = addr
+		lines = append(lines, listener(addr))
+	}
+	if cfg.tls {
+		if err := writeCerts(m.dir); err != nil {
+			return "", err
+		} else if addr, err := freeAddr(); err != nil {
+			return "", err
+		} else {
+			m.tlsaddr = addr
+			lines = append(lines,
+				listener(addr),
+				"cafile "+m.CAFile(),
+				"certfile "+filepath.Join(m.dir, "server.crt"),
+				"keyfile "+filepath.Join(m.dir, "server.key"),
+				fmt.Sprint("require_certificate ", cfg.require),
+			)
+		}
+	}
+
+	// Write the configuration file
+	return m.writeFile("mosquitto.conf", lines)
+}
+
+// Write lines to a file in the directory, and return the path
+func (m *Mosquitto) writeFile(name string, lines []string) (string, error) {
+	path := filepath.Join(m.dir, name)
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Wait until the listeners accept connections, the broker exits or the
+// timeout expires
+func (m *Mosquitto) wait() error {
+	timeout := time.After(mosquittoTimeout)
+	for _, addr := range []string{m.addr, m.tlsaddr} {
+		for addr != "" {
+			if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+				conn.Close()
+				break
+			}
+			select {
+			case <-m.done:
+				return ErrUnexpectedResponse.Withf("mosquitto exited: %v", strings.TrimSpace(m.Log()))
+			case <-timeout:
+				return ErrUnexpectedResponse.Withf("mosquitto not ready on %v: %v", addr, strings.TrimSpace(m.Log()))
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	}
+
+	// Return success
+	return nil
+}
+
+// Return a free address on 127.0.0.1
+func freeAddr() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
+
+// Return the listener line of the configuration for an address
+func listener(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return "listener " + port + " " + host
+}
+
+// Write output of the broker
+func (b *logBuffer) Write(data []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(data)
+}
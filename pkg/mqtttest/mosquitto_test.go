@@ -0,0 +1,84 @@
+package mqtttest_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+
+	// Packages
+	mqtt "github.com/mutablelogic/go-mosquitto/pkg/mqtt"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto/pkg/mqtttest"
+)
+
+func Test_Mosquitto_001(t *testing.T) {
+	broker := NewMosquitto(t, NewMosquittoConfig())
+	defer broker.Close()
+	t.Log(broker)
+
+	// Publish and receive a message
+	c := newClient(t, broker.Addr(), "test", nil)
+	defer c.close()
+	if rc := c.waitConnect(t); rc != mqtt.MQTT_RC_SUCCESS {
+		t.Fatal("Unexpected reason code", rc)
+	}
+	if _, err := c.Subscribe([]string{"a/#"}, 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	c.waitSuback(t)
+	if _, err := c.Publish("a/b", []byte("data"), 1, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg := c.waitMessage(t); msg.Topic != "a/b" || string(msg.Payload) != "data" {
+		t.Error("Unexpected message", msg)
+	}
+	if log := broker.Log(); log == "" {
+		t.Error("Expected broker log output")
+	}
+}
+
+func Test_Mosquitto_002(t *testing.T) {
+	broker := NewMosquitto(t, NewMosquittoConfig().WithTLS(true).WithUser("user", "password"))
+	defer broker.Close()
+	t.Log(broker)
+
+	// Make the TLS configuration with the client certificate
+	pem, err := ioutil.ReadFile(broker.CAFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		t.Fatal("Unable to read certificate authority")
+	}
+	cert, err := tls.LoadX509KeyPair(broker.CertFile(), broker.KeyFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}
+
+	// Connect over TLS with credentials, for each protocol version
+	for _, version := range []int{mqtt.MQTT_PROTOCOL_V311, mqtt.MQTT_PROTOCOL_V5} {
+		c := newClient(t, broker.TLSAddr(), "", func(c *mqtt.Client) {
+			c.SetProtocol(version)
+			c.SetCredentials("user", "password")
+			c.SetTLS(config)
+		})
+		if rc := c.waitConnect(t); rc != mqtt.MQTT_RC_SUCCESS {
+			t.Error("Unexpected reason code", rc)
+		}
+		c.close()
+	}
+
+	// Connecting with the wrong password is refused
+	c := newClient(t, broker.TLSAddr(), "", func(c *mqtt.Client) {
+		c.SetCredentials("user", "wrong")
+		c.SetTLS(config)
+	})
+	if rc := c.waitConnect(t); rc == mqtt.MQTT_RC_SUCCESS {
+		t.Error("Unexpected reason code", rc)
+	}
+	c.close()
+}
@@ -0,0 +1,181 @@
+/*
+Package topic validates MQTT topic names and subscription filters, and
+matches topic names against filters with the '+' and '#' wildcards. It
+has the same semantics as the libmosquitto functions, but does not
+require cgo.
+*/
+package topic
+
+import (
+	"strings"
+
+	// Namespace imports
+	. "github.com/djthorpe/go-errors"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Maximum length of a topic or filter in bytes
+	MaxLength = 65535
+
+	// Separator between levels of a topic
+	Separator = "/"
+
+	// Wildcards which match a single level, or all remaining levels
+	SingleLevel = '+'
+	MultiLevel  = '#'
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// ValidatePublish returns an error if a topic cannot be used to publish a
+// message, which is when it contains wildcards or is too long. As with
+// mosquitto_pub_topic_check, an empty topic is not checked here
+func ValidatePublish(topic string) error {
+	if i := strings.IndexAny(topic, "+#"); i >= 0 {
+		return ErrBadParameter.Withf("Wildcard %q not allowed in topic %q", topic[i], topic)
+	} else if len(topic) > MaxLength {
+		return ErrBadParameter.Withf("Topic exceeds %d bytes", MaxLength)
+	}
+
+	// Return success
+	return nil
+}
+
+// ValidateSubscribe returns an error if a subscription filter is not valid,
+// which is when a wildcard does not occupy an entire level, '#' is not the
+// last level, or the filter is too long. As with mosquitto_sub_topic_check,
+// an empty filter is not checked here
+func ValidateSubscribe(filter string) error {
+	for i := 0; i < len(filter); i++ {
+		switch filter[i] {
+		case SingleLevel:
+			if (i > 0 && filter[i-1] != '/') || (i+1 < len(filter) && filter[i+1] != '/') {
+				return ErrBadParameter.Withf("Wildcard '+' must occupy an entire level in %q", filter)
+			}
+		case MultiLevel:
+			if (i > 0 && filter[i-1] != '/') || i+1 < len(filter) {
+				return ErrBadParameter.Withf("Wildcard '#' must be the last level in %q", filter)
+			}
+		}
+	}
+	if len(filter) > MaxLength {
+		return ErrBadParameter.Withf("Filter exceeds %d bytes", MaxLength)
+	}
+
+	// Return success
+	return nil
+}
+
+// Tokenise splits a topic or filter into levels. Empty levels are returned
+// as empty strings, for example "/a/b" returns "", "a" and "b"
+func Tokenise(filter string) []string {
+	return strings.Split(filter, Separator)
+}
+
+// Match returns true if a topic name matches a subscription filter. Topics
+// which start with '$' are only matched by filters which start with '$'.
+// An error is returned if either the filter or topic is empty, if the topic
+// contains wildcards, or if the filter is not valid
+func Match(filter, topic string) (bool, error) {
+	if filter == "" || topic == "" {
+		return false, ErrBadParameter.With("Empty topic or filter")
+	}
+
+	// Topics starting with $ are only matched by filters starting with $
+	if (filter[0] == '$') != (topic[0] == '$') {
+		return false, nil
+	}
+
+	// Return the byte at a position, or zero beyond the end of the string,
+	// in the same way as a C string
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+
+	s, t := 0, 0
+	for s < len(filter) {
+		if c := at(topic, t); c == SingleLevel || c == MultiLevel {
+			return false, errWildcardInTopic(topic)
+		}
+		if filter[s] != at(topic, t) || t >= len(topic) {
+			switch filter[s] {
+			case SingleLevel:
+				if (s > 0 && filter[s-1] != '/') || (at(filter, s+1) != 0 && at(filter, s+1) != '/') {
+					return false, errInvalidFilter(filter)
+				}
+				s++
+				for t < len(topic) && topic[t] != '/' {
+					if topic[t] == SingleLevel || topic[t] == MultiLevel {
+						return false, errWildcardInTopic(topic)
+					}
+					t++
+				}
+				if t >= len(topic) && s >= len(filter) {
+					return true, nil
+				}
+			case MultiLevel:
+				if (s > 0 && filter[s-1] != '/') || at(filter, s+1) != 0 {
+					return false, errInvalidFilter(filter)
+				}
+				if strings.ContainsAny(topic[t:], "+#") {
+					return false, errWildcardInTopic(topic)
+				}
+				return true, nil
+			default:
+				// Check for foo/bar matching foo/+/#
+				if t >= len(topic) && s > 0 && filter[s-1] == SingleLevel && filter[s] == '/' && at(filter, s+1) == MultiLevel {
+					return true, nil
+				}
+				// There is no match, but check whether the filter is valid
+				for ; s < len(filter); s++ {
+					if filter[s] == MultiLevel && at(filter, s+1) != 0 {
+						return false, errInvalidFilter(filter)
+					}
+				}
+				return false, nil
+			}
+		} else {
+			// Check for foo matching foo/#
+			if t+1 >= len(topic) && at(filter, s+1) == '/' && at(filter, s+2) == MultiLevel && at(filter, s+3) == 0 {
+				return true, nil
+			}
+			s++
+			t++
+			if s >= len(filter) && t >= len(topic) {
+				return true, nil
+			} else if t >= len(topic) && at(filter, s) == SingleLevel && at(filter, s+1) == 0 {
+				if s > 0 && filter[s-1] != '/' {
+					return false, errInvalidFilter(filter)
+				}
+				return true, nil
+			}
+		}
+	}
+
+	// The filter has been consumed without a match, but check the
+	// remainder of the topic for wildcards
+	if strings.ContainsAny(topic[t:], "+#") {
+		return false, errWildcardInTopic(topic)
+	}
+
+	// Return no match
+	return false, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+func errWildcardInTopic(topic string) error {
+	return ErrBadParameter.Withf("Wildcards not allowed in topic %q", topic)
+}
+
+func errInvalidFilter(filter string) error {
+	return ErrBadParameter.Withf("Invalid filter %q", filter)
+}
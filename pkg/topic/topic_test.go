@@ -0,0 +1,127 @@
+package topic_test
+
+import (
+	"strings"
+	"testing"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-mosquitto/pkg/topic"
+)
+
+var matchTests = []struct {
+	Filter, Topic string
+	Match, Err    bool
+}{
+	{"foo/bar", "foo/bar", true, false},
+	{"foo/+", "foo/bar", true, false},
+	{"foo/+/baz", "foo/bar/baz", true, false},
+	{"foo/+/#", "foo/bar/baz", true, false},
+	{"A/B/+/#", "A/B/B/C", true, false},
+	{"#", "foo/bar/baz", true, false},
+	{"#", "/foo/bar", true, false},
+	{"/#", "/foo/bar", true, false},
+	{"$SYS/bar", "$SYS/bar", true, false},
+	{"$SYS/#", "$SYS/broker/uptime", true, false},
+	{"foo/#", "foo/$bar", true, false},
+	{"foo/+/baz", "foo/$bar/baz", true, false},
+	{"foo/#", "foo", true, false},
+	{"foo/+/#", "foo/bar", true, false},
+	{"+/+", "/foo", true, false},
+	{"+", "foo", true, false},
+	{"test/6/#", "test/3", false, false},
+	{"foo/bar", "foo", false, false},
+	{"foo/+", "foo/bar/baz", false, false},
+	{"foo/+/baz", "foo/bar/bar", false, false},
+	{"foo/+/#", "fo2/bar/baz", false, false},
+	{"/#", "foo/bar", false, false},
+	{"#", "$SYS/bar", false, false},
+	{"+/bar", "$SYS/bar", false, false},
+	{"$BOB/bar", "$SYS/bar", false, false},
+	{"foo", "foo/bar", false, false},
+	{"foo#", "foo", false, true},
+	{"fo#o/", "foo", false, true},
+	{"foo/#a", "foo", false, true},
+	{"foo+", "foo", false, true},
+	{"foo/+a", "foo/a", false, true},
+	{"foo/bar", "foo/+", false, true},
+	{"#", "foo/#", false, true},
+	{"", "foo", false, true},
+	{"foo", "", false, true},
+}
+
+func Test_Topic_001(t *testing.T) {
+	for _, test := range matchTests {
+		match, err := Match(test.Filter, test.Topic)
+		if (err != nil) != test.Err {
+			t.Errorf("Match(%q, %q): unexpected error %v", test.Filter, test.Topic, err)
+		} else if match != test.Match {
+			t.Errorf("Match(%q, %q): expected %v", test.Filter, test.Topic, test.Match)
+		}
+	}
+}
+
+func Test_Topic_002(t *testing.T) {
+	tests := []struct {
+		Topic string
+		Err   bool
+	}{
+		{"foo/bar", false},
+		{"/foo/bar/", false},
+		{"$SYS/bar", false},
+		{"", false},
+		{"foo/+", true},
+		{"foo/#", true},
+		{"foo+bar", true},
+		{strings.Repeat("a", MaxLength), false},
+		{strings.Repeat("a", MaxLength+1), true},
+	}
+	for _, test := range tests {
+		if err := ValidatePublish(test.Topic); (err != nil) != test.Err {
+			t.Errorf("ValidatePublish(%q): unexpected error %v", test.Topic, err)
+		}
+	}
+}
+
+func Test_Topic_003(t *testing.T) {
+	tests := []struct {
+		Filter string
+		Err    bool
+	}{
+		{"foo/bar", false},
+		{"+", false},
+		{"#", false},
+		{"+/+/#", false},
+		{"/+/", false},
+		{"$SYS/#", false},
+		{"", false},
+		{"foo+", true},
+		{"+foo", true},
+		{"foo/+bar/baz", true},
+		{"foo#", true},
+		{"#/foo", true},
+		{"foo/#/", true},
+		{strings.Repeat("a", MaxLength+1), true},
+	}
+	for _, test := range tests {
+		if err := ValidateSubscribe(test.Filter); (err != nil) != test.Err {
+			t.Errorf("ValidateSubscribe(%q): unexpected error %v", test.Filter, err)
+		}
+	}
+}
+
+func Test_Topic_004(t *testing.T) {
+	tests := []struct {
+		Filter string
+		Levels []string
+	}{
+		{"a/deep/topic", []string{"a", "deep", "topic"}},
+		{"/a/b/", []string{"", "a", "b", ""}},
+		{"+/#", []string{"+", "#"}},
+		{"", []string{""}},
+	}
+	for _, test := range tests {
+		if levels := Tokenise(test.Filter); strings.Join(levels, "|") != strings.Join(test.Levels, "|") || len(levels) != len(test.Levels) {
+			t.Errorf("Tokenise(%q): unexpected %q", test.Filter, levels)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	// Packages
+	mosquitto "github.com/mutablelogic/go-mosquitto/pkg/mosquitto"
 	router "github.com/mutablelogic/go-server/pkg/httprouter"
 
 	// Namespace imports
@@ -38,6 +39,8 @@ type MessageResponse struct {
 	Type      string      `json:"type"`
 	Timestamp time.Time   `json:"ts"`
 	Topic     string      `json:"topic"`
+	QoS       int         `json:"qos"`
+	Retain    bool        `json:"retain,omitempty"`
 	Payload   interface{} `json:"payload,omitempty"`
 	Value     interface{} `json:"value,omitempty"`
 }
@@ -57,6 +60,7 @@ type PingResponse struct {
 
 var (
 	reRoutePing     = regexp.MustCompile(`^/?$`)
+	reRouteMetrics  = regexp.MustCompile(`^/metrics/?$`)
 	reRouteTopics   = regexp.MustCompile(`^/t/?$`)
 	reRouteMessages = regexp.MustCompile(`^/m/?$`)
 	reRouteMessage  = regexp.MustCompile(`^/m/(\d+)/?$`)
@@ -77,6 +81,10 @@ func (p *plugin) AddHandlers(ctx context.Context, provider Provider) error {
 	if err := provider.AddHandlerFuncEx(ctx, reRoutePing, p.ServePing); err != nil {
 		return err
 	}
+	// Add handler for metrics
+	if err := provider.AddHandlerFuncEx(ctx, reRouteMetrics, p.ServeMetrics); err != nil {
+		return err
+	}
 	// Add handler for topics
 	if err := provider.AddHandlerFuncEx(ctx, reRouteTopics, p.ServeTopicList); err != nil {
 		return err
@@ -101,8 +109,8 @@ func (p *plugin) AddHandlers(ctx context.Context, provider Provider) error {
 
 func (p *plugin) ServePing(w http.ResponseWriter, req *http.Request) {
 	// Populate response
+	client := p.Client()
 	response := PingResponse{
-		Version:  p.client.Version(),
 		Broker:   p.cfg.Broker,
 		Database: p.cfg.Database,
 		Retain:   fmt.Sprint(p.cfg.Retain),
@@ -118,15 +126,32 @@ func (p *plugin) ServePing(w http.ResponseWriter, req *http.Request) {
 		response.Count = count
 	}
 
-	// Set connected status
-	if !p.connected.IsZero() {
-		response.Connected = fmt.Sprint(time.Since(p.connected).Truncate(time.Second))
+	// Set version and connected status, when the client has connected
+	if client != nil {
+		response.Version = client.Version()
+	}
+	if client != nil && client.State() == mosquitto.StateConnected {
+		response.Connected = fmt.Sprint(time.Since(client.Since()).Truncate(time.Second))
 	}
 
 	// Serve response
 	router.ServeJSON(w, response, http.StatusOK, 2)
 }
 
+// ServeMetrics serves the counters of the client and the messages dropped
+// by the plugin in the Prometheus text format
+func (p *plugin) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	var stats mosquitto.Stats
+	var connected bool
+	if client := p.Client(); client != nil {
+		stats = client.Stats()
+		connected = client.State() == mosquitto.StateConnected
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	writeMetrics(w, stats, connected, p.queue.Dropped())
+}
+
 func (p *plugin) ServeTopicList(w http.ResponseWriter, req *http.Request) {
 	// Serve response
 	router.ServeJSON(w, p.topics.Topics(), http.StatusOK, 2)
@@ -216,7 +241,7 @@ func (p *plugin) ServeMessage(w http.ResponseWriter, req *http.Request) {
 }
 
 func makeResponse(r SQResults, cap int) []MessageResponse {
-	// The results are id, ts, topic, type and payload
+	// The results are id, ts, topic, type, payload, qos and retain
 	result := make([]MessageResponse, 0, cap)
 	for {
 		row := r.Next(messageRowCast...)
@@ -228,6 +253,8 @@ func makeResponse(r SQResults, cap int) []MessageResponse {
 			Timestamp: row[1].(time.Time),
 			Topic:     row[2].(string),
 			Type:      row[3].(string),
+			QoS:       row[5].(int),
+			Retain:    row[6].(bool),
 		}
 		str := strings.TrimSpace(string(row[4].([]byte)))
 		switch message.Type {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	// Namespace imports
+	. "github.com/mutablelogic/go-sqlite"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// testPool returns a connection which counts a fixed number of messages
+type testPool struct {
+	count int64
+}
+
+type testConn struct {
+	SQConnection
+	count int64
+}
+
+type testTxn struct {
+	SQTransaction
+	count int64
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// TESTS
+
+func Test_Handlers_001(t *testing.T) {
+	// Ping before the client has connected
+	p := &plugin{pool: &testPool{count: 10}, topics: NewTopics()}
+	w := httptest.NewRecorder()
+	p.ServePing(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("Unexpected status", w.Code, w.Body.String())
+	}
+	var response PingResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Version != "" || response.Connected != "" {
+		t.Error("Unexpected response", response)
+	}
+	if response.Count != 10 {
+		t.Error("Unexpected count", response.Count)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+func (p *testPool) Get() SQConnection {
+	return &testConn{count: p.count}
+}
+
+func (p *testPool) Put(SQConnection) {}
+
+func (c *testConn) Do(ctx context.Context, flags SQFlag, fn func(SQTransaction) error) error {
+	return fn(&testTxn{count: c.count})
+}
+
+func (t *testTxn) Count(string, string) int64 {
+	return t.count
+}
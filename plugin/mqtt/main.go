@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	// Packages
@@ -20,28 +22,43 @@ import (
 // TYPES
 
 type Config struct {
-	Broker    string        `yaml:"broker"`    // Host:Port or just Host
-	ClientId  string        `yaml:"clientid"`  // Client ID (optional)
-	Timeout   time.Duration `yaml:"timeout"`   // Connection timeout (optional)
-	KeepAlive time.Duration `yaml:"keepalive"` // KeepAlive delta (optional)
-	User      string        `yaml:"user"`      // Username (optional)
-	Password  string        `yaml:"password"`  // Password (required if user set)
-	CertAuth  string        `yaml:"certauth"`  // Certificate Authority path or file (optional)
-	CertFile  string        `yaml:"cert"`      // TLS Certificate (required if CertAuth is set)
-	KeyFile   string        `yaml:"key"`       // TLS Key (required if CertAuth is set)
-	Insecure  bool          `yaml:"insecure"`  // Don't verify broker certificates (optional)
-	Topics    []string      `yaml:"topics"`    // Topics to subscribe to (optional)
-	Database  string        `yaml:"database"`  // Database name for storage of messages
-	Retain    time.Duration `yaml:"retention"` // Retain time for messages (optional)
+	Broker      string        `yaml:"broker"`      // Host:Port, just Host, or URL such as mqtts://host/?clientid=id
+	Brokers     []string      `yaml:"brokers"`     // Brokers to fail over to, when broker is not a URL (optional)
+	ClientId    string        `yaml:"clientid"`    // Client ID (optional)
+	Timeout     time.Duration `yaml:"timeout"`     // Connection timeout (optional)
+	KeepAlive   time.Duration `yaml:"keepalive"`   // KeepAlive delta (optional)
+	User        string        `yaml:"user"`        // Username (optional)
+	Password    string        `yaml:"password"`    // Password (required if user set)
+	CertAuth    string        `yaml:"certauth"`    // Certificate Authority path or file (optional)
+	CertFile    string        `yaml:"cert"`        // TLS Certificate (required if CertAuth is set)
+	KeyFile     string        `yaml:"key"`         // TLS Key (required if CertAuth is set)
+	Insecure    bool          `yaml:"insecure"`    // Don't verify broker certificates (optional)
+	KeyPassword string        `yaml:"keypassword"` // Password for encrypted TLS Key (optional)
+	KeyForm     string        `yaml:"keyform"`     // TLS Key format, pem or engine (optional)
+	Engine      string        `yaml:"engine"`      // OpenSSL engine for TLS (optional)
+	TLSVersion  string        `yaml:"tlsversion"`  // TLS version, tlsv1.1, tlsv1.2 or tlsv1.3 (optional)
+	Ciphers     string        `yaml:"ciphers"`     // TLS cipher list (optional)
+	PSK         string        `yaml:"psk"`         // Hex encoded pre-shared key, instead of CertAuth (optional)
+	PSKIdentity string        `yaml:"pskidentity"` // Pre-shared key identity (required if PSK is set)
+	ALPN        string        `yaml:"alpn"`        // TLS application layer protocol (optional)
+	OCSP        bool          `yaml:"ocsp"`        // Require OCSP stapling from broker (optional)
+	Topics      []string      `yaml:"topics"`      // Topics to subscribe to (optional)
+	Database    string        `yaml:"database"`    // Database name for storage of messages
+	Retain      time.Duration `yaml:"retention"`   // Retain time for messages (optional)
+	Events      Flags         `yaml:"events"`      // Additional events to print, such as LOG (optional)
+	Queue       int           `yaml:"queue"`       // Capacity of the queue of events (optional)
+	Overflow    string        `yaml:"overflow"`    // When the queue is full, block, drop-newest, drop-oldest or spill (optional)
+	Spill       string        `yaml:"spill"`       // Directory for events when the queue is full and overflow is spill (optional)
 }
 
 type plugin struct {
+	sync.RWMutex
 	pool
-	cfg       Config
-	client    *mosquitto.Client
-	ch        chan *mosquitto.Event
-	connected time.Time
-	topics    *topics
+	cfg     Config
+	client  mosquitto.Conn
+	connect mosquitto.ConnectFunc
+	queue   *mosquitto.Queue
+	topics  *topics
 }
 
 type pool interface {
@@ -65,6 +82,7 @@ const (
 // Create the module
 func New(ctx context.Context, provider Provider) Plugin {
 	p := new(plugin)
+	p.connect = mosquitto.Connect
 
 	// Load configuration
 	var cfg Config
@@ -74,6 +92,12 @@ func New(ctx context.Context, provider Provider) Plugin {
 	} else if cfg.Broker == "" {
 		provider.Print(ctx, "Missing required 'broker' configuration")
 		return nil
+	} else if _, err := mosquitto.NewConfigFromURL(cfg.Broker); err != nil {
+		provider.Print(ctx, err)
+		return nil
+	} else if len(cfg.Brokers) > 0 && strings.Contains(cfg.Broker, "://") {
+		provider.Print(ctx, "Use comma-separated hosts in the 'broker' URL instead of 'brokers'")
+		return nil
 	} else {
 		p.cfg = cfg
 	}
@@ -97,8 +121,13 @@ func New(ctx context.Context, provider Provider) Plugin {
 		p.cfg.Retain = defaultRetain
 	}
 
-	// Create a channel to receive events
-	p.ch = make(chan *mosquitto.Event, defaultCapacity)
+	// Create a queue to receive events
+	if queue, err := p.newQueue(ctx, provider); err != nil {
+		provider.Print(ctx, err)
+		return nil
+	} else {
+		p.queue = queue
+	}
 
 	// Create a topics object to track subscriptions
 	p.topics = NewTopics()
@@ -112,13 +141,15 @@ func New(ctx context.Context, provider Provider) Plugin {
 
 func (p *plugin) String() string {
 	str := "<mqtt"
-	if p.connected.IsZero() {
+	if client := p.Client(); client == nil {
 		str += " disconnected"
 	} else {
-		str += fmt.Sprint(" connected=", time.Since(p.connected))
-	}
-	if p.client != nil {
-		str += fmt.Sprint(" ", p.client)
+		if client.State() == mosquitto.StateConnected {
+			str += fmt.Sprint(" connected=", time.Since(client.Since()))
+		} else {
+			str += fmt.Sprint(" state=", client.State())
+		}
+		str += fmt.Sprint(" ", client)
 	}
 	if p.pool != nil {
 		str += fmt.Sprint(" ", p.pool)
@@ -160,16 +191,17 @@ FOR_LOOP:
 		case <-ctx.Done():
 			break FOR_LOOP
 		case <-timer.C:
-			// Re-connect client as necessary
-			if p.client == nil {
+			// Connect client as necessary. Once connected, the client
+			// reconnects and subscribes again by itself
+			if p.Client() == nil {
 				provider.Printf(ctx, "Connect: %q", p.cfg.Broker)
-				if client, err := p.connect(ctx, provider); err != nil {
+				if client, err := p.connectWithConfig(ctx, provider); err != nil {
 					provider.Printf(ctx, "Connection error: %v", err)
 				} else {
-					p.client = client
-					p.connected = time.Now()
+					p.setClient(client)
 				}
-			} else {
+			}
+			if p.Client() != nil {
 				if err := p.subscribeToTopics(); err != nil {
 					provider.Printf(ctx, "Subscribe error: %v", err)
 				}
@@ -184,7 +216,7 @@ FOR_LOOP:
 			}
 			// Reset the timer
 			retain.Reset(p.cfg.Retain / 4)
-		case evt := <-p.ch:
+		case evt := <-p.queue.C():
 			// Handle message, subscription and unsubscription
 			if evt.Type == MOSQ_FLAG_EVENT_MESSAGE {
 				if err := p.AddMessage(ctx, evt); err != nil {
@@ -194,21 +226,26 @@ FOR_LOOP:
 			}
 			provider.Printf(ctx, "Event: %v", evt)
 			if evt.Type == MOSQ_FLAG_EVENT_SUBSCRIBE || evt.Type == MOSQ_FLAG_EVENT_UNSUBSCRIBE {
-				p.topics.Event(evt.Type, evt.Id)
+				if err := p.topics.Event(evt); err != nil {
+					provider.Printf(ctx, "Subscribe error: %v", err)
+				}
 			}
 		}
 	}
 
+	// Close the event queue, so the client is not waiting to put events
+	if err := p.queue.Close(); err != nil {
+		result = multierror.Append(result, err)
+	}
+
 	// Disconnect client if connected
-	if p.client != nil {
-		if err := p.client.Close(); err != nil {
+	if client := p.Client(); client != nil {
+		p.setClient(nil)
+		if err := client.Close(); err != nil {
 			result = multierror.Append(result, err)
 		}
 	}
 
-	// Close the event channel
-	close(p.ch)
-
 	// Return any errors
 	return result
 }
@@ -216,15 +253,21 @@ FOR_LOOP:
 ///////////////////////////////////////////////////////////////////////////////
 // PUBLIC METHODS
 
+// Client returns the client, or nil if the client has not connected
+func (p *plugin) Client() mosquitto.Conn {
+	p.RLock()
+	defer p.RUnlock()
+	return p.client
+}
+
 // Subscribe to a topic
 func (p *plugin) Subscribe(topic string) error {
-	if p.client == nil {
+	client := p.Client()
+	if client == nil {
 		return ErrOutOfOrder.With("Client not connected")
 	}
-	if req, err := p.client.Subscribe(topic); err != nil {
+	if _, err := client.Subscribe(topic); err != nil {
 		return err
-	} else {
-		p.topics.Subscribe(topic, req)
 	}
 
 	// Return success
@@ -233,14 +276,13 @@ func (p *plugin) Subscribe(topic string) error {
 
 // Unsubscribe from a topic
 func (p *plugin) Unubscribe(topic string) error {
-	if p.client == nil {
+	client := p.Client()
+	if client == nil {
 		return ErrOutOfOrder.With("Client not connected")
 	}
-	if req, err := p.client.Unsubscribe(topic); err != nil {
+	// TODO: Remove topic from p.cfg.Topics
+	if _, err := client.Unsubscribe(topic); err != nil {
 		return err
-	} else {
-		// TODO: Remove topic from p.cfg.Topics
-		p.topics.Unsubscribe(topic, req)
 	}
 
 	// Return success
@@ -250,13 +292,19 @@ func (p *plugin) Unubscribe(topic string) error {
 ///////////////////////////////////////////////////////////////////////////////
 // PRIVATE METHODS
 
-func (p *plugin) connect(ctx context.Context, provider Provider) (*mosquitto.Client, error) {
+func (p *plugin) connectWithConfig(ctx context.Context, provider Provider) (mosquitto.Conn, error) {
 	// Create config
-	cfg := mosquitto.NewConfigWithBroker(p.cfg.Broker)
+	cfg, err := mosquitto.NewConfigFromURL(p.cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.cfg.Brokers) > 0 {
+		cfg = cfg.WithBrokers(append([]string{p.cfg.Broker}, p.cfg.Brokers...)...)
+	}
 	if p.cfg.ClientId != "" {
 		cfg = cfg.WithClientId(p.cfg.ClientId)
 	}
-	cfg = cfg.WithCallback(func(evt *mosquitto.Event) {
+	cfg = cfg.WithEvents(MOSQ_FLAG_EVENT_ALL | p.cfg.Events).WithCallback(func(evt *mosquitto.Event) {
 		p.callback(ctx, provider, evt)
 	})
 	if p.cfg.KeepAlive > 0 {
@@ -267,6 +315,27 @@ func (p *plugin) connect(ctx context.Context, provider Provider) (*mosquitto.Cli
 	if p.cfg.CertAuth != "" {
 		cfg = cfg.WithTLS(p.cfg.CertAuth, p.cfg.CertFile, p.cfg.KeyFile, !p.cfg.Insecure)
 	}
+	if p.cfg.PSK != "" {
+		cfg = cfg.WithPSK(p.cfg.PSK, p.cfg.PSKIdentity)
+	}
+	if p.cfg.KeyPassword != "" {
+		password := p.cfg.KeyPassword
+		cfg = cfg.WithKeyPassword(func() (string, error) {
+			return password, nil
+		})
+	}
+	if p.cfg.KeyForm != "" || p.cfg.Engine != "" {
+		cfg = cfg.WithKeyform(p.cfg.KeyForm, p.cfg.Engine)
+	}
+	if p.cfg.TLSVersion != "" || p.cfg.Ciphers != "" {
+		cfg = cfg.WithTLSOpts(p.cfg.TLSVersion, p.cfg.Ciphers)
+	}
+	if p.cfg.ALPN != "" {
+		cfg = cfg.WithALPN(p.cfg.ALPN)
+	}
+	if p.cfg.OCSP {
+		cfg = cfg.WithOCSP(true)
+	}
 	if p.cfg.User != "" {
 		cfg = cfg.WithCredentials(p.cfg.User, p.cfg.Password)
 	}
@@ -280,7 +349,13 @@ func (p *plugin) connect(ctx context.Context, provider Provider) (*mosquitto.Cli
 	defer cancel()
 
 	// Connect and return any errors
-	return mosquitto.NewWithConfig(ctx, cfg)
+	return p.connect(ctx, cfg)
+}
+
+func (p *plugin) setClient(client mosquitto.Conn) {
+	p.Lock()
+	defer p.Unlock()
+	p.client = client
 }
 
 func (p *plugin) callback(ctx context.Context, provider Provider, evt *mosquitto.Event) {
@@ -291,34 +366,58 @@ func (p *plugin) callback(ctx context.Context, provider Provider, evt *mosquitto
 			provider.Printf(ctx, "Connection error: %v", evt.Err)
 			return
 		}
-		// Subscribe to topics
-		if err := p.subscribeToTopics(); err != nil {
-			provider.Printf(ctx, "Subscribe error: %v", err)
-		}
 	case MOSQ_FLAG_EVENT_DISCONNECT:
 		provider.Print(ctx, evt)
-		p.client = nil
-		p.connected = time.Time{}
 		if evt.Err != nil {
 			provider.Printf(ctx, "Disconnection error: %v", evt.Err)
 			return
 		}
+	case MOSQ_FLAG_EVENT_LOG:
+		provider.Print(ctx, evt)
 	default:
-		select {
-		case p.ch <- evt:
-			break
-		default:
-			provider.Printf(ctx, "Message dropped in topic %q, too many messages", evt.Topic)
+		p.queue.Put(evt)
+	}
+}
+
+// Return a queue of events with the configured capacity and policy, which
+// drops the newest events by default
+func (p *plugin) newQueue(ctx context.Context, provider Provider) (*mosquitto.Queue, error) {
+	capacity := defaultCapacity
+	if p.cfg.Queue > 0 {
+		capacity = p.cfg.Queue
+	}
+	cfg := mosquitto.NewQueueConfig(capacity).WithPolicy(mosquitto.PolicyDropNewest)
+	if p.cfg.Overflow != "" {
+		if policy, err := mosquitto.ParsePolicy(p.cfg.Overflow); err != nil {
+			return nil, err
+		} else if policy == mosquitto.PolicySpill {
+			cfg = cfg.WithSpill(p.cfg.Spill)
+		} else {
+			cfg = cfg.WithPolicy(policy)
 		}
 	}
+	cfg = cfg.WithDrop(func(evt *mosquitto.Event) {
+		provider.Printf(ctx, "Message dropped in topic %q, too many messages", evt.Topic)
+	})
+	return mosquitto.NewQueue(cfg)
 }
 
+// Subscribe to all configured topics which are not yet subscribed, in
+// one request
 func (p *plugin) subscribeToTopics() error {
+	client := p.Client()
+	if client == nil {
+		return ErrOutOfOrder.With("Client not connected")
+	}
+	topics := make(map[string]int, len(p.cfg.Topics))
 	for _, topic := range p.cfg.Topics {
 		if !p.topics.Has(topic) {
-			if err := p.Subscribe(topic); err != nil {
-				return err
-			}
+			topics[topic] = 0
+		}
+	}
+	if len(topics) > 0 {
+		if _, err := client.SubscribeMany(topics); err != nil {
+			return err
 		}
 	}
 	// Return success
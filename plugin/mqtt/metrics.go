@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+
+	// Packages
+	mosquitto "github.com/mutablelogic/go-mosquitto/pkg/mosquitto"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	// Content type of the Prometheus text format
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+///////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Write the counters of the client, and the messages dropped by the plugin,
+// in the Prometheus text format
+func writeMetrics(w io.Writer, stats mosquitto.Stats, connected bool, dropped uint64) {
+	// Messages and bytes by QoS
+	counters := []struct {
+		name, help string
+		values     [3]mosquitto.Counter
+	}{
+		{"mqtt_sent", "published", stats.Sent},
+		{"mqtt_received", "received", stats.Received},
+	}
+	for _, c := range counters {
+		writeHeader(w, c.name+"_messages_total", "counter", "Messages "+c.help+", by QoS")
+		for qos, v := range c.values {
+			fmt.Fprintf(w, "%s_messages_total{qos=\"%d\"} %d\n", c.name, qos, v.Messages)
+		}
+		writeHeader(w, c.name+"_bytes_total", "counter", "Bytes of messages "+c.help+", by QoS")
+		for qos, v := range c.values {
+			fmt.Fprintf(w, "%s_bytes_total{qos=\"%d\"} %d\n", c.name, qos, v.Bytes)
+		}
+	}
+
+	// Latency of acknowledgements
+	writeHeader(w, "mqtt_publish_latency_seconds", "histogram", "Time from publish to acknowledgement")
+	for i, bucket := range stats.Latency.Buckets {
+		fmt.Fprintf(w, "mqtt_publish_latency_seconds_bucket{le=\"%s\"} %d\n", formatFloat(bucket.Seconds()), stats.Latency.Counts[i])
+	}
+	fmt.Fprintf(w, "mqtt_publish_latency_seconds_bucket{le=\"+Inf\"} %d\n", stats.Latency.Count)
+	fmt.Fprintf(w, "mqtt_publish_latency_seconds_sum %s\n", formatFloat(stats.Latency.Sum.Seconds()))
+	fmt.Fprintf(w, "mqtt_publish_latency_seconds_count %d\n", stats.Latency.Count)
+
+	// Connection
+	writeHeader(w, "mqtt_connected", "gauge", "Whether the client is connected to the broker")
+	if connected {
+		fmt.Fprintln(w, "mqtt_connected 1")
+	} else {
+		fmt.Fprintln(w, "mqtt_connected 0")
+	}
+	writeHeader(w, "mqtt_reconnects_total", "counter", "Connections to the broker after the first connection")
+	fmt.Fprintln(w, "mqtt_reconnects_total", stats.Reconnects)
+	writeHeader(w, "mqtt_last_connected_timestamp_seconds", "gauge", "Time of the last connection to the broker")
+	if stats.LastConnected.IsZero() {
+		fmt.Fprintln(w, "mqtt_last_connected_timestamp_seconds 0")
+	} else {
+		fmt.Fprintln(w, "mqtt_last_connected_timestamp_seconds", formatFloat(float64(stats.LastConnected.UnixNano())/1e9))
+	}
+	writeHeader(w, "mqtt_inflight_messages", "gauge", "Messages published and not yet acknowledged")
+	fmt.Fprintln(w, "mqtt_inflight_messages", stats.Inflight)
+
+	// Dropped events
+	writeHeader(w, "mqtt_dropped_events_total", "counter", "Events dropped by the client")
+	fmt.Fprintln(w, "mqtt_dropped_events_total", stats.Dropped)
+	writeHeader(w, "mqtt_plugin_dropped_messages_total", "counter", "Messages dropped by the plugin, with too many messages waiting")
+	fmt.Fprintln(w, "mqtt_plugin_dropped_messages_total", dropped)
+}
+
+// Write the help and type lines of a metric
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Return a float in the shortest form
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -45,11 +45,20 @@ const (
 )
 
 var (
-	// cast for first two elements of message
+	// cast for elements of message
 	messageRowCast = []reflect.Type{
 		reflect.TypeOf(uint(0)),     // id
 		reflect.TypeOf(time.Time{}), // ts
+		nil,                         // topic
+		nil,                         // type
+		nil,                         // payload
+		reflect.TypeOf(int(0)),      // qos
+		reflect.TypeOf(false),       // retain
 	}
+
+	// columns added to the message table after it was first created,
+	// which are added to an existing table
+	messageAddedColumns = []string{"qos", "retain"}
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -91,9 +100,26 @@ func (p *plugin) AddSchema(ctx context.Context) error {
 			C("topic").NotNull(),
 			C("type").NotNull(),
 			C("payload").WithType("BLOB"),
+			C("qos").WithType("INTEGER"),
+			C("retain").WithType("INTEGER"),
 		).IfNotExists()); err != nil {
 			return err
 		}
+		// Add columns to a table created before they existed
+		columns := make(map[string]bool)
+		for _, column := range txn.ColumnsForTable(p.cfg.Database, messageTableName) {
+			columns[column.Name()] = true
+		}
+		for _, name := range messageAddedColumns {
+			if columns[name] {
+				continue
+			}
+			if _, err := txn.Query(N(messageTableName).WithSchema(p.cfg.Database).AlterTable().AddColumn(
+				C(name).WithType("INTEGER"),
+			)); err != nil {
+				return err
+			}
+		}
 		// Create the index on topic
 		if _, err := txn.Query(N(messageIndexName).WithSchema(p.cfg.Database).CreateIndex(
 			messageTableName, "topic",
@@ -129,9 +155,13 @@ func (p *plugin) AddMessage(ctx context.Context, msg *mosquitto.Event) error {
 	// Insert the data in a transaction
 	return conn.Do(ctx, 0, func(txn SQTransaction) error {
 		t := toType(msg.Data)
+		ts := msg.ReceivedAt
+		if ts.IsZero() {
+			ts = time.Now()
+		}
 		if _, err := txn.Query(N(messageTableName).WithSchema(p.cfg.Database).Insert(
-			"ts", "topic", "type", "payload",
-		), time.Now(), msg.Topic, string(t), msg.Data); err != nil {
+			"ts", "topic", "type", "payload", "qos", "retain",
+		), ts, msg.Topic, string(t), msg.Data, msg.QoS, msg.Retain); err != nil {
 			return err
 		}
 
@@ -207,7 +237,7 @@ func (p *plugin) Query(ctx context.Context, t string, order string, limit uint)
 		var params []interface{}
 		// Create the select statement
 		s := S(N(messageTableName).WithSchema(p.cfg.Database)).
-			To(N("id"), N("ts"), N("topic"), N("type"), N("payload"))
+			To(N("id"), N("ts"), N("topic"), N("type"), N("payload"), N("qos"), N("retain"))
 		// Append parameters
 		if limit > 0 {
 			s = s.WithLimitOffset(limit, 0)
@@ -260,7 +290,7 @@ func (p *plugin) GetMessage(ctx context.Context, id int64) (SQResults, error) {
 
 		// Create the select statement
 		s := S(N(messageTableName).WithSchema(p.cfg.Database)).
-			To(N("id"), N("ts"), N("topic"), N("type"), N("payload")).
+			To(N("id"), N("ts"), N("topic"), N("type"), N("payload"), N("qos"), N("retain")).
 			Where(Q("id = ?"))
 		// Run query and return results
 		results, err = txn.Query(s, id)
@@ -1,12 +1,14 @@
 package main
 
 import (
-
-	// Namespace imports
 	"fmt"
 	"sort"
 	"time"
 
+	// Package imports
+	"github.com/mutablelogic/go-mosquitto/pkg/mosquitto"
+
+	// Namespace imports
 	. "github.com/djthorpe/go-errors"
 	. "github.com/mutablelogic/go-mosquitto"
 )
@@ -15,7 +17,6 @@ import (
 // TYPES
 
 type topics struct {
-	req    map[int]string
 	topics map[string]time.Time
 }
 
@@ -24,7 +25,6 @@ type topics struct {
 
 func NewTopics() *topics {
 	t := new(topics)
-	t.req = make(map[int]string)
 	t.topics = make(map[string]time.Time)
 	return t
 }
@@ -63,27 +63,24 @@ func (t *topics) Has(topic string) bool {
 	return false
 }
 
-// Subscribe request sent to a topic
-func (t *topics) Subscribe(topic string, req int) {
-	t.req[req] = topic
-}
-
-// Unsubscribe request sent to a topic
-func (t *topics) Unsubscribe(topic string, req int) {
-	t.req[req] = topic
-}
-
-// Unsubscribe event
-func (t *topics) Event(evt Flags, req int) error {
-	if topic, exists := t.req[req]; exists {
-		delete(t.req, req)
-		if evt == MOSQ_FLAG_EVENT_SUBSCRIBE {
-			return t.add(topic)
-		} else if evt == MOSQ_FLAG_EVENT_UNSUBSCRIBE {
-			return t.delete(topic)
+// Subscribe or unsubscribe event, which carries the topics of the request.
+// Topics which the broker rejected are not added
+func (t *topics) Event(evt *mosquitto.Event) error {
+	if len(evt.Topics) == 0 {
+		return ErrUnexpectedResponse.Withf("%v (req %v)", evt.Type, evt.Id)
+	}
+	for i, topic := range evt.Topics {
+		switch {
+		case evt.Type == MOSQ_FLAG_EVENT_UNSUBSCRIBE:
+			t.delete(topic)
+		case i < len(evt.GrantedQoS) && evt.GrantedQoS[i] >= mosquitto.MQTT_SUBACK_FAILURE:
+			t.delete(topic)
+		default:
+			t.add(topic)
 		}
 	}
-	return ErrUnexpectedResponse.Withf("%v (req %v)", evt, req)
+	// Return success
+	return nil
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -14,17 +14,29 @@ import (
 #include <mosquitto.h>
 
 extern void onConnect(struct mosquitto*, void*, int);
+extern void onConnectWithFlags(struct mosquitto*, void*, int, int);
 extern void onDisconnect(struct mosquitto*, void*, int);
 extern void onPublish(struct mosquitto*, void*, int);
 extern void onSubscribe(struct mosquitto*, void*, int,int,int*);
 extern void onUnsubscribe(struct mosquitto*, void*, int);
 extern void onMessage(struct mosquitto*, void*, struct mosquitto_message*);
 extern void onLog(struct mosquitto*,void*,int,char*);
+extern void onConnectV5(struct mosquitto*, void*, int, int, mosquitto_property*);
+extern void onDisconnectV5(struct mosquitto*, void*, int, mosquitto_property*);
+extern void onPublishV5(struct mosquitto*, void*, int, int, mosquitto_property*);
+extern void onSubscribeV5(struct mosquitto*, void*, int, int, int*, mosquitto_property*);
+extern void onUnsubscribeV5(struct mosquitto*, void*, int, mosquitto_property*);
+extern void onMessageV5(struct mosquitto*, void*, struct mosquitto_message*, mosquitto_property*);
+extern int onPassword(char*, int, int, void*);
 
 static void set_connect_callback(struct mosquitto*	client) {
 	mosquitto_connect_callback_set(client, onConnect);
 }
 
+static void set_connect_with_flags_callback(struct mosquitto* client) {
+	mosquitto_connect_with_flags_callback_set(client, onConnectWithFlags);
+}
+
 static void set_disconnect_callback(struct mosquitto* client) {
 	mosquitto_disconnect_callback_set(client,onDisconnect);
 }
@@ -48,6 +60,34 @@ static void set_message_callback(struct mosquitto* client) {
 static void set_log_callback(struct mosquitto*	client) {
 	mosquitto_log_callback_set(client,(void (*)(struct mosquitto *, void *, int, const char *))(onLog));
 }
+
+static void set_connect_v5_callback(struct mosquitto* client) {
+	mosquitto_connect_v5_callback_set(client,(void (*)(struct mosquitto *, void *, int, int, const mosquitto_property *))(onConnectV5));
+}
+
+static void set_disconnect_v5_callback(struct mosquitto* client) {
+	mosquitto_disconnect_v5_callback_set(client,(void (*)(struct mosquitto *, void *, int, const mosquitto_property *))(onDisconnectV5));
+}
+
+static void set_publish_v5_callback(struct mosquitto* client) {
+	mosquitto_publish_v5_callback_set(client,(void (*)(struct mosquitto *, void *, int, int, const mosquitto_property *))(onPublishV5));
+}
+
+static void set_subscribe_v5_callback(struct mosquitto* client) {
+	mosquitto_subscribe_v5_callback_set(client,(void (*)(struct mosquitto *, void *, int, int, const int *, const mosquitto_property *))(onSubscribeV5));
+}
+
+static void set_unsubscribe_v5_callback(struct mosquitto* client) {
+	mosquitto_unsubscribe_v5_callback_set(client,(void (*)(struct mosquitto *, void *, int, const mosquitto_property *))(onUnsubscribeV5));
+}
+
+static void set_message_v5_callback(struct mosquitto* client) {
+	mosquitto_message_v5_callback_set(client,(void (*)(struct mosquitto *, void *, const struct mosquitto_message *, const mosquitto_property *))(onMessageV5));
+}
+
+static int tls_set_with_password(struct mosquitto* client, const char* cafile, const char* capath, const char* certfile, const char* keyfile) {
+	return mosquitto_tls_set(client, cafile, capath, certfile, keyfile, onPassword);
+}
 */
 import "C"
 
@@ -55,15 +95,30 @@ import "C"
 // TYPES
 
 type (
-	ConnectCallback     func(Error)         // Connect(return_code int)
-	DisconnectCallback  func(Error)         // Disconnect(return_code int)
-	SubscribeCallback   func(int, []int)    // Subscribe(message_id int, granted_qos []int)
-	UnsubscribeCallback func(int)           // Unsubscribe(message_id int)
-	PublishCallback     func(int)           // Publish(message_id int)
-	MessageCallback     func(*Message)      // Message(message *Message)
-	LogCallback         func(Level, string) // Log(level Level, message string)
+	ConnectCallback          func(Error)         // Connect(return_code int)
+	ConnectWithFlagsCallback func(Error, int)    // ConnectWithFlags(return_code int, flags int)
+	DisconnectCallback       func(Error)         // Disconnect(return_code int)
+	SubscribeCallback        func(int, []int)    // Subscribe(message_id int, granted_qos []int)
+	UnsubscribeCallback      func(int)           // Unsubscribe(message_id int)
+	PublishCallback          func(int)           // Publish(message_id int)
+	MessageCallback          func(*Message)      // Message(message *Message)
+	LogCallback              func(Level, string) // Log(level Level, message string)
 )
 
+// Callbacks for MQTT v5, which additionally receive reason codes and
+// properties. The properties are only valid for the duration of the callback.
+type (
+	ConnectV5Callback     func(ReasonCode, int, *Properties) // ConnectV5(reason_code, flags int, properties)
+	DisconnectV5Callback  func(ReasonCode, *Properties)      // DisconnectV5(reason_code, properties)
+	SubscribeV5Callback   func(int, []int, *Properties)      // SubscribeV5(message_id int, granted_qos []int, properties)
+	UnsubscribeV5Callback func(int, *Properties)             // UnsubscribeV5(message_id int, properties)
+	PublishV5Callback     func(int, ReasonCode, *Properties) // PublishV5(message_id int, reason_code, properties)
+	MessageV5Callback     func(*Message, *Properties)        // MessageV5(message *Message, properties)
+)
+
+// PasswordCallback returns the password used to decrypt the client key
+type PasswordCallback func() (string, error)
+
 ////////////////////////////////////////////////////////////////////////////////
 // PUBLIC METHODS
 
@@ -72,6 +127,13 @@ func (c *ClientEx) SetConnectCallback(cb ConnectCallback) {
 	c.ConnectCallback = cb
 }
 
+// SetConnectWithFlagsCallback sets a callback for connection, which also
+// receives the connect flags. The session present flag is MQTT_CONNACK_SESSION_PRESENT
+func (c *ClientEx) SetConnectWithFlagsCallback(cb ConnectWithFlagsCallback) {
+	C.set_connect_with_flags_callback((*C.struct_mosquitto)(c.Client))
+	c.ConnectWithFlagsCallback = cb
+}
+
 func (c *ClientEx) SetDisconnectCallback(cb DisconnectCallback) {
 	C.set_disconnect_callback((*C.struct_mosquitto)(c.Client))
 	c.DisconnectCallback = cb
@@ -102,71 +164,178 @@ func (c *ClientEx) SetLogCallback(cb LogCallback) {
 	c.LogCallback = cb
 }
 
+func (c *ClientEx) SetConnectV5Callback(cb ConnectV5Callback) {
+	C.set_connect_v5_callback((*C.struct_mosquitto)(c.Client))
+	c.ConnectV5Callback = cb
+}
+
+func (c *ClientEx) SetDisconnectV5Callback(cb DisconnectV5Callback) {
+	C.set_disconnect_v5_callback((*C.struct_mosquitto)(c.Client))
+	c.DisconnectV5Callback = cb
+}
+
+func (c *ClientEx) SetPublishV5Callback(cb PublishV5Callback) {
+	C.set_publish_v5_callback((*C.struct_mosquitto)(c.Client))
+	c.PublishV5Callback = cb
+}
+
+func (c *ClientEx) SetSubscribeV5Callback(cb SubscribeV5Callback) {
+	C.set_subscribe_v5_callback((*C.struct_mosquitto)(c.Client))
+	c.SubscribeV5Callback = cb
+}
+
+func (c *ClientEx) SetUnsubscribeV5Callback(cb UnsubscribeV5Callback) {
+	C.set_unsubscribe_v5_callback((*C.struct_mosquitto)(c.Client))
+	c.UnsubscribeV5Callback = cb
+}
+
+func (c *ClientEx) SetMessageV5Callback(cb MessageV5Callback) {
+	C.set_message_v5_callback((*C.struct_mosquitto)(c.Client))
+	c.MessageV5Callback = cb
+}
+
+// SetTLSWithPassword sets certificate authority, cert and key for TLS
+// connections, where the key is encrypted. The callback is called to
+// return the password for the key.
+func (c *ClientEx) SetTLSWithPassword(capath, certpath, keypath string, cb PasswordCallback) error {
+	c.PasswordCallback = cb
+	return c.Client.setTLS(capath, certpath, keypath, func(cafile, capath, certfile, keyfile *C.char) C.int {
+		return C.tls_set_with_password((*C.struct_mosquitto)(c.Client), cafile, capath, certfile, keyfile)
+	})
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVATE METHODS
 
 //export onConnect
 func onConnect(handle *C.struct_mosquitto, userInfo unsafe.Pointer, rc C.int) {
-	client := (*ClientEx)(userInfo)
-	if client.ConnectCallback != nil {
+	if client := handles.get(userInfo); client != nil && client.ConnectCallback != nil {
 		client.ConnectCallback(Error(rc))
 	}
 }
 
+//export onConnectWithFlags
+func onConnectWithFlags(handle *C.struct_mosquitto, userInfo unsafe.Pointer, rc C.int, flags C.int) {
+	if client := handles.get(userInfo); client != nil && client.ConnectWithFlagsCallback != nil {
+		client.ConnectWithFlagsCallback(Error(rc), int(flags))
+	}
+}
+
 //export onDisconnect
 func onDisconnect(handle *C.struct_mosquitto, userInfo unsafe.Pointer, rc C.int) {
-	client := (*ClientEx)(userInfo)
-	if client.DisconnectCallback != nil {
+	if client := handles.get(userInfo); client != nil && client.DisconnectCallback != nil {
 		client.DisconnectCallback(Error(rc))
 	}
 }
 
 //export onPublish
 func onPublish(handle *C.struct_mosquitto, userInfo unsafe.Pointer, messageId C.int) {
-	client := (*ClientEx)(userInfo)
-	if client.PublishCallback != nil {
+	if client := handles.get(userInfo); client != nil && client.PublishCallback != nil {
 		client.PublishCallback(int(messageId))
 	}
 }
 
 //export onSubscribe
 func onSubscribe(handle *C.struct_mosquitto, userInfo unsafe.Pointer, messageId C.int, qosCount C.int, grantedQos *C.int) {
-	client := (*ClientEx)(userInfo)
-	if client.SubscribeCallback != nil {
-		var data []C.int
-		header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
-		header.Data = uintptr(unsafe.Pointer(grantedQos))
-		header.Len = int(qosCount)
-		header.Cap = int(qosCount)
-
-		qos := make([]int, len(data))
-		for i, value := range data {
-			qos[i] = int(value)
-		}
-		client.SubscribeCallback(int(messageId), qos)
+	if client := handles.get(userInfo); client != nil && client.SubscribeCallback != nil {
+		client.SubscribeCallback(int(messageId), toGrantedQos(qosCount, grantedQos))
 	}
 }
 
 //export onUnsubscribe
 func onUnsubscribe(handle *C.struct_mosquitto, userInfo unsafe.Pointer, messageId C.int) {
-	client := (*ClientEx)(userInfo)
-	if client.UnsubscribeCallback != nil {
+	if client := handles.get(userInfo); client != nil && client.UnsubscribeCallback != nil {
 		client.UnsubscribeCallback(int(messageId))
 	}
 }
 
 //export onMessage
 func onMessage(handle *C.struct_mosquitto, userInfo unsafe.Pointer, message *C.struct_mosquitto_message) {
-	client := (*ClientEx)(userInfo)
-	if client.MessageCallback != nil {
+	if client := handles.get(userInfo); client != nil && client.MessageCallback != nil {
 		client.MessageCallback((*Message)(message))
 	}
 }
 
 //export onLog
 func onLog(handle *C.struct_mosquitto, userInfo unsafe.Pointer, level C.int, str *C.char) {
-	client := (*ClientEx)(userInfo)
-	if client.LogCallback != nil {
+	if client := handles.get(userInfo); client != nil && client.LogCallback != nil {
 		client.LogCallback(Level(level), C.GoString(str))
 	}
 }
+
+//export onConnectV5
+func onConnectV5(handle *C.struct_mosquitto, userInfo unsafe.Pointer, rc C.int, flags C.int, props *C.mosquitto_property) {
+	if client := handles.get(userInfo); client != nil && client.ConnectV5Callback != nil {
+		client.ConnectV5Callback(ReasonCode(rc), int(flags), propertiesRef(props))
+	}
+}
+
+//export onDisconnectV5
+func onDisconnectV5(handle *C.struct_mosquitto, userInfo unsafe.Pointer, rc C.int, props *C.mosquitto_property) {
+	if client := handles.get(userInfo); client != nil && client.DisconnectV5Callback != nil {
+		client.DisconnectV5Callback(ReasonCode(rc), propertiesRef(props))
+	}
+}
+
+//export onPublishV5
+func onPublishV5(handle *C.struct_mosquitto, userInfo unsafe.Pointer, messageId C.int, rc C.int, props *C.mosquitto_property) {
+	if client := handles.get(userInfo); client != nil && client.PublishV5Callback != nil {
+		client.PublishV5Callback(int(messageId), ReasonCode(rc), propertiesRef(props))
+	}
+}
+
+//export onSubscribeV5
+func onSubscribeV5(handle *C.struct_mosquitto, userInfo unsafe.Pointer, messageId C.int, qosCount C.int, grantedQos *C.int, props *C.mosquitto_property) {
+	if client := handles.get(userInfo); client != nil && client.SubscribeV5Callback != nil {
+		client.SubscribeV5Callback(int(messageId), toGrantedQos(qosCount, grantedQos), propertiesRef(props))
+	}
+}
+
+//export onUnsubscribeV5
+func onUnsubscribeV5(handle *C.struct_mosquitto, userInfo unsafe.Pointer, messageId C.int, props *C.mosquitto_property) {
+	if client := handles.get(userInfo); client != nil && client.UnsubscribeV5Callback != nil {
+		client.UnsubscribeV5Callback(int(messageId), propertiesRef(props))
+	}
+}
+
+//export onMessageV5
+func onMessageV5(handle *C.struct_mosquitto, userInfo unsafe.Pointer, message *C.struct_mosquitto_message, props *C.mosquitto_property) {
+	if client := handles.get(userInfo); client != nil && client.MessageV5Callback != nil {
+		client.MessageV5Callback((*Message)(message), propertiesRef(props))
+	}
+}
+
+//export onPassword
+func onPassword(buf *C.char, size C.int, rwflag C.int, handle unsafe.Pointer) C.int {
+	// OpenSSL passes the library client as userdata, so retrieve the client
+	// from the handle it holds
+	client := handles.get(C.mosquitto_userdata((*C.struct_mosquitto)(handle)))
+	if client == nil || client.PasswordCallback == nil {
+		return 0
+	}
+	password, err := client.PasswordCallback()
+	if err != nil || len(password) > int(size) {
+		return 0
+	}
+	var data []byte
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data = uintptr(unsafe.Pointer(buf))
+	header.Len = int(size)
+	header.Cap = int(size)
+	return C.int(copy(data, password))
+}
+
+// Return granted qos values as a slice
+func toGrantedQos(qosCount C.int, grantedQos *C.int) []int {
+	var data []C.int
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data = uintptr(unsafe.Pointer(grantedQos))
+	header.Len = int(qosCount)
+	header.Cap = int(qosCount)
+
+	qos := make([]int, len(data))
+	for i, value := range data {
+		qos[i] = int(value)
+	}
+	return qos
+}
@@ -3,6 +3,8 @@ package mosquitto
 import (
 	"fmt"
 	"os"
+	"reflect"
+	"runtime"
 	"unsafe"
 )
 
@@ -26,7 +28,9 @@ type (
 ////////////////////////////////////////////////////////////////////////////////
 // LIFECYCLE
 
-// New is called to create a new empty client object
+// New is called to create a new empty client object. The userInfo value is
+// passed to the library as is, so it must not point to Go memory. Use NewEx
+// in order to receive callbacks
 func New(clientId string, clean bool, userInfo unsafe.Pointer) (*Client, error) {
 	var cClientId *C.char
 	if clientId != "" {
@@ -76,6 +80,60 @@ func (this *Client) SetCredentials(user, password string) error {
 	}
 }
 
+// Set a will message, which the broker publishes when the client disconnects
+// unexpectedly. Call this before Connect
+func (this *Client) SetWill(topic string, data []byte, qos int, retain bool) error {
+	var sz C.int
+	var payload unsafe.Pointer
+	cTopic := C.CString(topic)
+	defer C.free(unsafe.Pointer(cTopic))
+	if len(data) > 0 {
+		sz = C.int(len(data))
+		payload = unsafe.Pointer(&data[0])
+	}
+	if err := Error(C.mosquitto_will_set((*C.struct_mosquitto)(this), cTopic, sz, payload, C.int(qos), C.bool(retain))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// Set a will message with MQTT v5 will properties, which can be nil. The
+// protocol needs to be set to MQTT_PROTOCOL_V5 first. Call this before Connect
+func (this *Client) SetWillV5(topic string, data []byte, qos int, retain bool, properties *Properties) error {
+	var sz C.int
+	var payload unsafe.Pointer
+	var list *C.mosquitto_property
+	cTopic := C.CString(topic)
+	defer C.free(unsafe.Pointer(cTopic))
+	if len(data) > 0 {
+		sz = C.int(len(data))
+		payload = unsafe.Pointer(&data[0])
+	}
+	// The library takes ownership of the properties on success, so pass a copy
+	defer runtime.KeepAlive(properties)
+	if properties.ptr() != nil {
+		if err := Error(C.mosquitto_property_copy_all(&list, properties.ptr())); err != MOSQ_ERR_SUCCESS {
+			return err
+		}
+	}
+	if err := Error(C.mosquitto_will_set_v5((*C.struct_mosquitto)(this), cTopic, sz, payload, C.int(qos), C.bool(retain), list)); err != MOSQ_ERR_SUCCESS {
+		C.mosquitto_property_free_all(&list)
+		return err
+	} else {
+		return nil
+	}
+}
+
+// Remove a previously set will message. Call this before Connect
+func (this *Client) ClearWill() error {
+	if err := Error(C.mosquitto_will_clear((*C.struct_mosquitto)(this))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
 // Connect to a broker using host and port, setting the keepalive time in seconds
 // and use 'true' for the async parameter to connect asyncronously
 func (this *Client) Connect(host string, port int, keepalive int, async bool) error {
@@ -120,6 +178,26 @@ func (this *Client) ConnectBind(host, bindAddress string, port int, keepalive in
 	}
 }
 
+// Connect to a broker using host and port with MQTT v5 properties, setting the
+// keepalive time in seconds. The bindAddress can be empty to use any interface
+// and properties can be nil. There is no asyncronous version of this call.
+func (this *Client) ConnectV5(host, bindAddress string, port int, keepalive int, properties *Properties) error {
+	var cBindAddress *C.char
+	cHost := C.CString(host)
+	defer C.free(unsafe.Pointer(cHost))
+	if bindAddress != "" {
+		cBindAddress = C.CString(bindAddress)
+	}
+	defer C.free(unsafe.Pointer(cBindAddress))
+
+	defer runtime.KeepAlive(properties)
+	if err := Error(C.mosquitto_connect_bind_v5((*C.struct_mosquitto)(this), cHost, C.int(port), C.int(keepalive), cBindAddress, properties.ptr())); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
 // Reconnect to a broker when disconnect has occured.
 func (this *Client) Reconnect(async bool) error {
 	if async {
@@ -146,6 +224,17 @@ func (this *Client) Disconnect() error {
 	}
 }
 
+// Disconnect from a broker with a MQTT v5 reason code and properties, which
+// can be nil
+func (this *Client) DisconnectV5(reason ReasonCode, properties *Properties) error {
+	defer runtime.KeepAlive(properties)
+	if err := Error(C.mosquitto_disconnect_v5((*C.struct_mosquitto)(this), C.int(reason), properties.ptr())); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // LOOP
 
@@ -185,6 +274,57 @@ func (this *Client) Loop(timeout_ms int) error {
 	}
 }
 
+// Read packets from the socket, for use with an external event loop when
+// the socket is ready for reading
+func (this *Client) LoopRead(max_packets int) error {
+	if err := Error(C.mosquitto_loop_read((*C.struct_mosquitto)(this), C.int(max_packets))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// Write packets to the socket, for use with an external event loop when
+// the socket is ready for writing
+func (this *Client) LoopWrite(max_packets int) error {
+	if err := Error(C.mosquitto_loop_write((*C.struct_mosquitto)(this), C.int(max_packets))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// Perform keepalive and retry actions, for use with an external event
+// loop, which should be called about once a second
+func (this *Client) LoopMisc() error {
+	if err := Error(C.mosquitto_loop_misc((*C.struct_mosquitto)(this))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// Return the socket of the client, or -1 when not connected
+func (this *Client) Socket() int {
+	return int(C.mosquitto_socket((*C.struct_mosquitto)(this)))
+}
+
+// Return true when there are packets waiting to be written to the socket
+func (this *Client) WantWrite() bool {
+	return bool(C.mosquitto_want_write((*C.struct_mosquitto)(this)))
+}
+
+// Tell the library that the client is used from several threads, but
+// without LoopStart. Requests are then written to the socket by the loop
+// rather than by the caller
+func (this *Client) SetThreaded(threaded bool) error {
+	if err := Error(C.mosquitto_threaded_set((*C.struct_mosquitto)(this), C.bool(threaded))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // SUBSCRIBE & UNSUBSCRIBE
 
@@ -214,6 +354,75 @@ func (this *Client) Unsubscribe(topics string) (int, error) {
 	}
 }
 
+// Subscribe to one set of topics with MQTT v5 subscription options and
+// properties, and return the id of the request. The options are a combination
+// of MQTT_SUB_OPT_* values and the properties can be nil
+func (this *Client) SubscribeV5(topics string, qos int, options int, properties *Properties) (int, error) {
+	var messageId C.int
+	cTopics := C.CString(topics)
+	defer C.free(unsafe.Pointer(cTopics))
+
+	defer runtime.KeepAlive(properties)
+	if err := Error(C.mosquitto_subscribe_v5((*C.struct_mosquitto)(this), &messageId, cTopics, C.int(qos), C.int(options), properties.ptr())); err != MOSQ_ERR_SUCCESS {
+		return 0, err
+	} else {
+		return int(messageId), nil
+	}
+}
+
+// Unsubscribe from one set of topics with MQTT v5 properties, which can be nil,
+// and return the id of the request
+func (this *Client) UnsubscribeV5(topics string, properties *Properties) (int, error) {
+	var messageId C.int
+	cTopics := C.CString(topics)
+	defer C.free(unsafe.Pointer(cTopics))
+
+	defer runtime.KeepAlive(properties)
+	if err := Error(C.mosquitto_unsubscribe_v5((*C.struct_mosquitto)(this), &messageId, cTopics, properties.ptr())); err != MOSQ_ERR_SUCCESS {
+		return 0, err
+	} else {
+		return int(messageId), nil
+	}
+}
+
+// Subscribe to several topics in one request with the same qos, and return
+// the id of the request. The granted qos for each topic is returned to the
+// subscribe callback in the same order as the topics. The options and
+// properties can only be set for MQTT v5, and properties can be nil
+func (this *Client) SubscribeMultiple(topics []string, qos int, options int, properties *Properties) (int, error) {
+	var messageId C.int
+	if len(topics) == 0 {
+		return 0, Error(MOSQ_ERR_INVAL)
+	}
+	cTopics := newStringArray(topics)
+	defer freeStringArray(cTopics, len(topics))
+
+	defer runtime.KeepAlive(properties)
+	if err := Error(C.mosquitto_subscribe_multiple((*C.struct_mosquitto)(this), &messageId, C.int(len(topics)), cTopics, C.int(qos), C.int(options), properties.ptr())); err != MOSQ_ERR_SUCCESS {
+		return 0, err
+	} else {
+		return int(messageId), nil
+	}
+}
+
+// Unsubscribe from several topics in one request, and return the id of
+// the request. The properties can only be set for MQTT v5, and can be nil
+func (this *Client) UnsubscribeMultiple(topics []string, properties *Properties) (int, error) {
+	var messageId C.int
+	if len(topics) == 0 {
+		return 0, Error(MOSQ_ERR_INVAL)
+	}
+	cTopics := newStringArray(topics)
+	defer freeStringArray(cTopics, len(topics))
+
+	defer runtime.KeepAlive(properties)
+	if err := Error(C.mosquitto_unsubscribe_multiple((*C.struct_mosquitto)(this), &messageId, C.int(len(topics)), cTopics, properties.ptr())); err != MOSQ_ERR_SUCCESS {
+		return 0, err
+	} else {
+		return int(messageId), nil
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PUBLISH
 
@@ -234,6 +443,25 @@ func (this *Client) Publish(topic string, data []byte, qos int, retain bool) (in
 	}
 }
 
+// Publish a message to the broker in a topic with MQTT v5 properties, which
+// can be nil, and return the id of the request
+func (this *Client) PublishV5(topic string, data []byte, qos int, retain bool, properties *Properties) (int, error) {
+	var messageId, sz C.int
+	var payload unsafe.Pointer
+	cTopic := C.CString(topic)
+	defer C.free(unsafe.Pointer(cTopic))
+	if len(data) > 0 {
+		sz = C.int(len(data))
+		payload = unsafe.Pointer(&data[0])
+	}
+	defer runtime.KeepAlive(properties)
+	if err := Error(C.mosquitto_publish_v5((*C.struct_mosquitto)(this), &messageId, cTopic, sz, payload, C.int(qos), C.bool(retain), properties.ptr())); err != MOSQ_ERR_SUCCESS {
+		return 0, err
+	} else {
+		return int(messageId), nil
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // CLIENT OPTIONS
 
@@ -242,53 +470,95 @@ func (this *Client) Publish(topic string, data []byte, qos int, retain bool) (in
 // This version does not accept a callback for password, use ClientEx
 // for that.
 func (c *Client) SetTLS(capath, certpath, keypath string) error {
-	var cCaFile, cCaPath, cCertFile, cKeyFile *C.char
+	return c.setTLS(capath, certpath, keypath, func(cafile, capath, certfile, keyfile *C.char) C.int {
+		return C.mosquitto_tls_set((*C.struct_mosquitto)(c), cafile, capath, certfile, keyfile, nil)
+	})
+}
 
-	// If capath is a directory, use directory form or else use file form.
-	if stat, err := os.Stat(capath); err != nil {
+// SetTLSInsecure configures verification of the server hostname in the server certificate.
+// If value is set to true, it is impossible to guarantee that the host you are connecting
+// to is not impersonating your server.
+func (c *Client) SetTLSInsecure(v bool) error {
+	if err := Error(C.mosquitto_tls_insecure_set((*C.struct_mosquitto)(c), C.bool(v))); err != MOSQ_ERR_SUCCESS {
 		return err
-	} else if stat.IsDir() {
-		cCaPath = C.CString(capath)
 	} else {
-		cCaFile = C.CString(capath)
+		return nil
 	}
-	if certpath != "" {
-		cCertFile = C.CString(certpath)
+}
+
+// SetTLSOpts sets advanced TLS options. The certReqs parameter is either
+// MOSQ_TLS_VERIFY_NONE or MOSQ_TLS_VERIFY_PEER, tlsVersion is one of
+// "tlsv1.3", "tlsv1.2" or "tlsv1.1" and ciphers is an OpenSSL cipher list.
+// Empty strings use the library defaults. Must be called before connecting.
+func (c *Client) SetTLSOpts(certReqs int, tlsVersion, ciphers string) error {
+	var cVersion, cCiphers *C.char
+	if tlsVersion != "" {
+		cVersion = C.CString(tlsVersion)
 	}
-	if keypath != "" {
-		cKeyFile = C.CString(keypath)
+	if ciphers != "" {
+		cCiphers = C.CString(ciphers)
 	}
-	defer C.free(unsafe.Pointer(cCaFile))
-	defer C.free(unsafe.Pointer(cCaPath))
-	defer C.free(unsafe.Pointer(cCertFile))
-	defer C.free(unsafe.Pointer(cKeyFile))
-	if err := Error(C.mosquitto_tls_set((*C.struct_mosquitto)(c), cCaFile, cCaPath, cCertFile, cKeyFile, nil)); err != MOSQ_ERR_SUCCESS {
+	defer C.free(unsafe.Pointer(cVersion))
+	defer C.free(unsafe.Pointer(cCiphers))
+	if err := Error(C.mosquitto_tls_opts_set((*C.struct_mosquitto)(c), C.int(certReqs), cVersion, cCiphers)); err != MOSQ_ERR_SUCCESS {
 		return err
 	} else {
 		return nil
 	}
 }
 
-// SetTLSInsecure configures verification of the server hostname in the server certificate.
-// If value is set to true, it is impossible to guarantee that the host you are connecting
-// to is not impersonating your server.
-func (c *Client) SetTLSInsecure(v bool) error {
-	if err := Error(C.mosquitto_tls_insecure_set((*C.struct_mosquitto)(c), C.bool(v))); err != MOSQ_ERR_SUCCESS {
+// SetTLSPSK configures the client for pre-shared-key based TLS support. The
+// psk is a hex encoded key and identity is the identity of this client. An
+// empty ciphers string uses the library defaults. Cannot be used in
+// combination with SetTLS.
+func (c *Client) SetTLSPSK(psk, identity, ciphers string) error {
+	var cCiphers *C.char
+	cPsk, cIdentity := C.CString(psk), C.CString(identity)
+	if ciphers != "" {
+		cCiphers = C.CString(ciphers)
+	}
+	defer C.free(unsafe.Pointer(cPsk))
+	defer C.free(unsafe.Pointer(cIdentity))
+	defer C.free(unsafe.Pointer(cCiphers))
+	if err := Error(C.mosquitto_tls_psk_set((*C.struct_mosquitto)(c), cPsk, cIdentity, cCiphers)); err != MOSQ_ERR_SUCCESS {
 		return err
 	} else {
 		return nil
 	}
 }
 
-// Value must be set to either MQTT_PROTOCOL_V31, MQTT_PROTOCOL_V311, or MQTT_PROTOCOL_V5.  Must be set before the client connects.  Defaults to MQTT_PROTOCOL_V311.
-func (this *Client) SetProtocol(protocol int) error {
-	if err := Error(C.mosquitto_opts_set((*C.struct_mosquitto)(this), C.enum_mosq_opt_t(MOSQ_OPT_PROTOCOL_VERSION), unsafe.Pointer(uintptr(protocol)))); err != MOSQ_ERR_SUCCESS {
-		return err
+// SetTLSALPN sets the application layer protocol negotiation value, which
+// some brokers require when sharing a port with other protocols
+func (c *Client) SetTLSALPN(value string) error {
+	return c.StringOption(MOSQ_OPT_TLS_ALPN, value)
+}
+
+// SetTLSOCSPRequired enables checking of the server certificate
+// revocation status using OCSP stapling
+func (c *Client) SetTLSOCSPRequired(value bool) error {
+	if value {
+		return c.IntOption(MOSQ_OPT_TLS_OCSP_REQUIRED, 1)
 	} else {
-		return nil
+		return c.IntOption(MOSQ_OPT_TLS_OCSP_REQUIRED, 0)
 	}
 }
 
+// SetTLSKeyform sets the format of the client key, which is either "pem" or
+// "engine". Must be called before SetTLS.
+func (c *Client) SetTLSKeyform(value string) error {
+	return c.StringOption(MOSQ_OPT_TLS_KEYFORM, value)
+}
+
+// SetTLSEngine sets the OpenSSL engine to use for TLS operations
+func (c *Client) SetTLSEngine(value string) error {
+	return c.StringOption(MOSQ_OPT_TLS_ENGINE, value)
+}
+
+// Value must be set to either MQTT_PROTOCOL_V31, MQTT_PROTOCOL_V311, or MQTT_PROTOCOL_V5.  Must be set before the client connects.  Defaults to MQTT_PROTOCOL_V311.
+func (this *Client) SetProtocol(protocol int) error {
+	return this.IntOption(MOSQ_OPT_PROTOCOL_VERSION, protocol)
+}
+
 // Control the behaviour of the client when it has unexpectedly disconnected
 // The default behaviour if this function is not used is to repeatedly attempt to reconnect
 // with a delay of 1 second until the connection succeeds.
@@ -300,7 +570,114 @@ func (this *Client) SetReconnectDelay(delay, max uint, exponential bool) error {
 	}
 }
 
+// IntOption sets an option which accepts an integer value. Boolean options
+// such as MOSQ_OPT_TCP_NODELAY and MOSQ_OPT_TLS_USE_OS_CERTS are set with
+// zero or one. Returns MOSQ_ERR_INVAL if the option does not accept an integer
+func (this *Client) IntOption(option Option, value int) error {
+	if option.Type() != MOSQ_OPT_TYPE_INT {
+		return Error(MOSQ_ERR_INVAL)
+	}
+	if err := Error(C.mosquitto_int_option((*C.struct_mosquitto)(this), C.enum_mosq_opt_t(option), C.int(value))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// StringOption sets an option which accepts a string value, such as
+// MOSQ_OPT_BIND_ADDRESS. Returns MOSQ_ERR_INVAL if the option does not
+// accept a string
+func (this *Client) StringOption(option Option, value string) error {
+	if option.Type() != MOSQ_OPT_TYPE_STRING {
+		return Error(MOSQ_ERR_INVAL)
+	}
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	if err := Error(C.mosquitto_string_option((*C.struct_mosquitto)(this), C.enum_mosq_opt_t(option), cValue)); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// VoidOption sets an option which accepts a pointer, which is only
+// MOSQ_OPT_SSL_CTX. The value needs to be allocated in C, and is not
+// freed by the library. Returns MOSQ_ERR_INVAL if the option does not
+// accept a pointer
+func (this *Client) VoidOption(option Option, value unsafe.Pointer) error {
+	if option.Type() != MOSQ_OPT_TYPE_VOID {
+		return Error(MOSQ_ERR_INVAL)
+	}
+	if err := Error(C.mosquitto_void_option((*C.struct_mosquitto)(this), C.enum_mosq_opt_t(option), value)); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// SetUserInfo replaces the userInfo value passed to New, which must not
+// point to Go memory. It should not be called on a client created with NewEx
 func (this *Client) SetUserInfo(userInfo unsafe.Pointer) error {
 	C.mosquitto_user_data_set((*C.struct_mosquitto)(this), userInfo)
 	return nil
 }
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// setTLS resolves the certificate paths and calls fn to set them on the client
+func (c *Client) setTLS(capath, certpath, keypath string, fn func(cafile, capath, certfile, keyfile *C.char) C.int) error {
+	var cCaFile, cCaPath, cCertFile, cKeyFile *C.char
+
+	// If capath is a directory, use directory form or else use file form.
+	if stat, err := os.Stat(capath); err != nil {
+		return err
+	} else if stat.IsDir() {
+		cCaPath = C.CString(capath)
+	} else {
+		cCaFile = C.CString(capath)
+	}
+	if certpath != "" {
+		cCertFile = C.CString(certpath)
+	}
+	if keypath != "" {
+		cKeyFile = C.CString(keypath)
+	}
+	defer C.free(unsafe.Pointer(cCaFile))
+	defer C.free(unsafe.Pointer(cCaPath))
+	defer C.free(unsafe.Pointer(cCertFile))
+	defer C.free(unsafe.Pointer(cKeyFile))
+	if err := Error(fn(cCaFile, cCaPath, cCertFile, cKeyFile)); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// newStringArray returns a C array of C strings, which needs to be freed
+// with freeStringArray
+func newStringArray(values []string) **C.char {
+	array := (**C.char)(C.malloc(C.size_t(len(values)) * C.size_t(unsafe.Sizeof(uintptr(0)))))
+	var data []*C.char
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data = uintptr(unsafe.Pointer(array))
+	header.Len = len(values)
+	header.Cap = len(values)
+	for i, value := range values {
+		data[i] = C.CString(value)
+	}
+	return array
+}
+
+// freeStringArray frees a C array of C strings
+func freeStringArray(array **C.char, n int) {
+	var data []*C.char
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data = uintptr(unsafe.Pointer(array))
+	header.Len = n
+	header.Cap = n
+	for _, value := range data {
+		C.free(unsafe.Pointer(value))
+	}
+	C.free(unsafe.Pointer(array))
+}
@@ -6,10 +6,20 @@ package mosquitto
 /*
 #cgo pkg-config: libmosquitto
 #include <stdlib.h>
+#include <stdint.h>
 #include <mosquitto.h>
+
+static struct mosquitto* new_with_handle(const char* id, bool clean, uintptr_t handle) {
+	return mosquitto_new(id, clean, (void*)handle);
+}
+
+static int reinitialise_with_handle(struct mosquitto* client, const char* id, bool clean, uintptr_t handle) {
+	return mosquitto_reinitialise(client, id, clean, (void*)handle);
+}
 */
 import "C"
 import (
+	"fmt"
 	"unsafe"
 )
 
@@ -19,12 +29,24 @@ import (
 type ClientEx struct {
 	*Client
 	ConnectCallback
+	ConnectWithFlagsCallback
 	DisconnectCallback
 	SubscribeCallback
 	UnsubscribeCallback
 	PublishCallback
 	MessageCallback
 	LogCallback
+	ConnectV5Callback
+	DisconnectV5Callback
+	SubscribeV5Callback
+	UnsubscribeV5Callback
+	PublishV5Callback
+	MessageV5Callback
+	PasswordCallback
+
+	// The handle is passed to the library as userdata, so that
+	// callbacks can find this client without holding a Go pointer
+	handle handle
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -35,32 +57,58 @@ type ClientEx struct {
 // instructs the broker to clean all messages and subscriptions on disconnect
 // https://mosquitto.org/api/files/mosquitto-h.html#mosquitto_new
 func NewEx(clientId string, clean bool) (*ClientEx, error) {
+	var cClientId *C.char
+	if clientId != "" {
+		cClientId = C.CString(clientId)
+	}
+	defer C.free(unsafe.Pointer(cClientId))
+
 	c := new(ClientEx)
-	userInfo := unsafe.Pointer(c)
-	if client, err := New(clientId, clean, userInfo); err != nil {
-		return nil, err
+	c.handle = handles.register(c)
+	if handle := C.new_with_handle(cClientId, C.bool(clean), C.uintptr_t(c.handle)); handle == nil {
+		handles.deregister(c.handle)
+		return nil, fmt.Errorf("mosquitto_new failed")
 	} else {
-		c.Client = client
+		c.Client = (*Client)(handle)
 	}
 
 	// Return success
 	return c, nil
 }
 
-// Destroy is called when you have finished using a client
+// Destroy is called when you have finished using a client. Any callbacks
+// which occur after Destroy is called are ignored
 func (c *ClientEx) Destroy() error {
-	c.Client.SetUserInfo(nil)
+	handles.deregister(c.handle)
 	return c.Client.Destroy()
 }
 
 // Reinitalize a client object
 func (c *ClientEx) Reinitialise(clientId string, clean bool) error {
 	c.ConnectCallback = nil
+	c.ConnectWithFlagsCallback = nil
 	c.DisconnectCallback = nil
 	c.SubscribeCallback = nil
 	c.UnsubscribeCallback = nil
 	c.PublishCallback = nil
 	c.MessageCallback = nil
 	c.LogCallback = nil
-	return c.Client.Reinitialise(clientId, clean, unsafe.Pointer(c))
+	c.ConnectV5Callback = nil
+	c.DisconnectV5Callback = nil
+	c.SubscribeV5Callback = nil
+	c.UnsubscribeV5Callback = nil
+	c.PublishV5Callback = nil
+	c.MessageV5Callback = nil
+	c.PasswordCallback = nil
+
+	var cClientId *C.char
+	if clientId != "" {
+		cClientId = C.CString(clientId)
+	}
+	defer C.free(unsafe.Pointer(cClientId))
+	if err := Error(C.reinitialise_with_handle((*C.struct_mosquitto)(c.Client), cClientId, C.bool(clean), C.uintptr_t(c.handle))); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
 }
@@ -0,0 +1,58 @@
+//go:build cgo
+// +build cgo
+
+package mosquitto
+
+import (
+	"sync"
+	"unsafe"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+// handle is an integer token which is passed to the library as userdata
+// in place of a Go pointer, and is resolved back to the client in callbacks
+type handle uintptr
+
+type registry struct {
+	sync.RWMutex
+	next    handle
+	clients map[handle]*ClientEx
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// GLOBALS
+
+var (
+	handles = &registry{clients: make(map[handle]*ClientEx)}
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// register returns a new handle for a client. Handles start at one, so that
+// a handle is never confused with a NULL userdata pointer
+func (r *registry) register(c *ClientEx) handle {
+	r.Lock()
+	defer r.Unlock()
+	r.next++
+	r.clients[r.next] = c
+	return r.next
+}
+
+// deregister removes a handle, after which callbacks for the client
+// are ignored
+func (r *registry) deregister(h handle) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.clients, h)
+}
+
+// get returns the client for userdata passed to a callback, or nil if the
+// handle is not registered
+func (r *registry) get(userInfo unsafe.Pointer) *ClientEx {
+	r.RLock()
+	defer r.RUnlock()
+	return r.clients[handle(uintptr(userInfo))]
+}
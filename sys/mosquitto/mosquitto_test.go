@@ -1,19 +1,59 @@
+//go:build cgo
+// +build cgo
+
 package mosquitto_test
 
 import (
+	"net"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	// Namespace imports
+	// Packages
+	mqtttest "github.com/mutablelogic/go-mosquitto/pkg/mqtttest"
+	topic "github.com/mutablelogic/go-mosquitto/pkg/topic"
 
+	// Namespace imports
 	. "github.com/mutablelogic/go-mosquitto/sys/mosquitto"
 )
 
-const (
-	TEST_SERVER         = "test.mosquitto.org"
-	TEST_PORT_PLAINTEXT = MOSQ_DEFAULT_PORT
-)
+// Return a broker for a test, which needs to be closed, and the host and
+// port of the broker
+func newBroker(t *testing.T) (*mqtttest.Broker, string, int) {
+	t.Helper()
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port := splitAddr(t, broker.Addr())
+	return broker, host, port
+}
+
+// Return a mosquitto broker process for a test, which needs to be closed.
+// The test is skipped when mosquitto is not installed
+func newMosquitto(t *testing.T, cfg mqtttest.MosquittoConfig) *mqtttest.Mosquitto {
+	t.Helper()
+	broker := mqtttest.NewMosquitto(t, cfg)
+	t.Log(broker)
+	return broker
+}
+
+// Return the host and port of an address
+func splitAddr(t *testing.T, addr string) (string, int) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, value
+}
 
 func Test_Mosquitto_000(t *testing.T) {
 	major, minor, revision := Version()
@@ -42,13 +82,16 @@ func Test_Mosquitto_002(t *testing.T) {
 }
 
 func Test_Mosquitto_003(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
 	if err := Init(); err != nil {
 		t.Fatal(err)
 	}
 	defer Cleanup()
 	if client, err := NewEx("id", true); err != nil {
 		t.Error(err)
-	} else if err := client.Connect(TEST_SERVER, TEST_PORT_PLAINTEXT, 5, false); err != nil {
+	} else if err := client.Connect(host, port, 5, false); err != nil {
 		t.Error(err)
 	} else if err := client.Disconnect(); err != nil {
 		t.Error(err)
@@ -58,6 +101,9 @@ func Test_Mosquitto_003(t *testing.T) {
 }
 
 func Test_Mosquitto_004(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
 	if err := Init(); err != nil {
 		t.Fatal(err)
 	}
@@ -90,7 +136,7 @@ func Test_Mosquitto_004(t *testing.T) {
 	}()
 
 	// Connect then disconnect
-	err = client.Connect(TEST_SERVER, TEST_PORT_PLAINTEXT, 5, false)
+	err = client.Connect(host, port, 5, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -117,6 +163,9 @@ func Test_Mosquitto_005(t *testing.T) {
 }
 
 func Test_Mosquitto_006(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
 	if err := Init(); err != nil {
 		t.Fatal(err)
 	}
@@ -146,7 +195,7 @@ func Test_Mosquitto_006(t *testing.T) {
 		t.Log("onMessage", message.Topic(), string(message.Data()))
 	})
 
-	if err := client.Connect(TEST_SERVER, TEST_PORT_PLAINTEXT, 60, false); err != nil {
+	if err := client.Connect(host, port, 60, false); err != nil {
 		t.Error(err)
 	}
 	if err := client.LoopStart(); err != nil {
@@ -170,6 +219,9 @@ func Test_Mosquitto_006(t *testing.T) {
 }
 
 func Test_Mosquitto_007(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
 	if err := Init(); err != nil {
 		t.Fatal(err)
 	}
@@ -204,7 +256,7 @@ func Test_Mosquitto_007(t *testing.T) {
 		t.Log("onPublish", messageId)
 	})
 
-	if err := client.Connect(TEST_SERVER, TEST_PORT_PLAINTEXT, 60, false); err != nil {
+	if err := client.Connect(host, port, 60, false); err != nil {
 		t.Error(err)
 	} else if err := client.LoopStart(); err != nil {
 		t.Error(err)
@@ -215,3 +267,638 @@ func Test_Mosquitto_007(t *testing.T) {
 	}
 	time.Sleep(time.Second * 5)
 }
+
+func Test_Mosquitto_008(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	client, err := NewEx("id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	if err := client.SetProtocol(MQTT_PROTOCOL_V5); err != nil {
+		t.Fatal(err)
+	}
+	client.SetConnectV5Callback(func(rc ReasonCode, flags int, props *Properties) {
+		if rc != MQTT_RC_SUCCESS {
+			t.Error("onConnectV5", rc)
+		} else {
+			t.Log("onConnectV5", flags, props)
+		}
+	})
+	client.SetSubscribeV5Callback(func(messageId int, GrantedQOS []int, props *Properties) {
+		t.Log("onSubscribeV5", messageId, GrantedQOS, props)
+	})
+	client.SetPublishV5Callback(func(messageId int, rc ReasonCode, props *Properties) {
+		t.Log("onPublishV5", messageId, rc, props)
+	})
+	client.SetMessageV5Callback(func(message *Message, props *Properties) {
+		t.Log("onMessageV5", message.Topic(), string(message.Data()), props)
+	})
+
+	if err := client.ConnectV5(host, "", port, 60, nil); err != nil {
+		t.Fatal(err)
+	} else if err := client.LoopStart(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.SubscribeV5("mosquitto/test/v5", 1, MQTT_SUB_OPT_NO_LOCAL, nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.PublishV5("mosquitto/test/v5", []byte("hello, world"), 1, false, nil); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Second * 5)
+	if err := client.DisconnectV5(MQTT_RC_NORMAL_DISCONNECTION, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Mosquitto_009(t *testing.T) {
+	props := NewProperties()
+	if err := props.AddByte(MQTT_PROP_PAYLOAD_FORMAT_INDICATOR, 1); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddInt16(MQTT_PROP_TOPIC_ALIAS, 100); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddInt32(MQTT_PROP_MESSAGE_EXPIRY_INTERVAL, 3600); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddVarint(MQTT_PROP_SUBSCRIPTION_IDENTIFIER, 42); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddBinary(MQTT_PROP_CORRELATION_DATA, []byte{1, 2, 3}); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddString(MQTT_PROP_CONTENT_TYPE, "text/plain"); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddStringPair(MQTT_PROP_USER_PROPERTY, "a", "1"); err != nil {
+		t.Error(err)
+	}
+	if err := props.AddStringPair(MQTT_PROP_USER_PROPERTY, "b", "2"); err != nil {
+		t.Error(err)
+	}
+	if n := props.Len(); n != 8 {
+		t.Error("Unexpected length", n)
+	}
+
+	// Read values from a copy of the list
+	other, err := props.Copy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	props.Free()
+	if v, ok := other.GetByte(MQTT_PROP_PAYLOAD_FORMAT_INDICATOR); !ok || v != 1 {
+		t.Error("Unexpected byte", v)
+	}
+	if v, ok := other.GetInt16(MQTT_PROP_TOPIC_ALIAS); !ok || v != 100 {
+		t.Error("Unexpected int16", v)
+	}
+	if v, ok := other.GetInt32(MQTT_PROP_MESSAGE_EXPIRY_INTERVAL); !ok || v != 3600 {
+		t.Error("Unexpected int32", v)
+	}
+	if v, ok := other.GetVarint(MQTT_PROP_SUBSCRIPTION_IDENTIFIER); !ok || v != 42 {
+		t.Error("Unexpected varint", v)
+	}
+	if v, ok := other.GetBinary(MQTT_PROP_CORRELATION_DATA); !ok || string(v) != "\x01\x02\x03" {
+		t.Error("Unexpected binary", v)
+	}
+	if v, ok := other.GetString(MQTT_PROP_CONTENT_TYPE); !ok || v != "text/plain" {
+		t.Error("Unexpected string", v)
+	}
+	if v := other.GetStringPairs(MQTT_PROP_USER_PROPERTY); len(v) != 2 || v[1][0] != "b" || v[1][1] != "2" {
+		t.Error("Unexpected string pairs", v)
+	}
+	if _, ok := other.GetString(MQTT_PROP_RESPONSE_TOPIC); ok {
+		t.Error("Unexpected response topic")
+	}
+	t.Log(other)
+}
+
+func Test_Mosquitto_010(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	client, err := NewEx("id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	if err := client.SetWill("mosquitto/test/will", []byte("offline"), 1, true); err != nil {
+		t.Error(err)
+	}
+	if err := client.ClearWill(); err != nil {
+		t.Error(err)
+	}
+
+	props := NewProperties()
+	if err := props.AddInt32(MQTT_PROP_WILL_DELAY_INTERVAL, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetProtocol(MQTT_PROTOCOL_V5); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetWillV5("mosquitto/test/will", []byte("offline"), 1, true, props); err != nil {
+		t.Error(err)
+	}
+	if n := props.Len(); n != 1 {
+		t.Error("Unexpected properties length", n)
+	}
+}
+
+func Test_Mosquitto_011(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	client, err := NewEx("id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	if err := client.SetTLSOpts(MOSQ_TLS_VERIFY_PEER, "tlsv1.2", ""); err != nil {
+		t.Error(err)
+	}
+	if err := client.SetTLSPSK("deadbeef", "gateway", ""); err != nil {
+		t.Error(err)
+	}
+	if err := client.SetTLSALPN("mqtt"); err != nil {
+		t.Error(err)
+	}
+	if err := client.SetTLSOCSPRequired(true); err != nil {
+		t.Error(err)
+	}
+	if err := client.SetTLSKeyform("pem"); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Mosquitto_012(t *testing.T) {
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	client, err := NewEx("id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	if err := client.IntOption(MOSQ_OPT_RECEIVE_MAXIMUM, 100); err != nil {
+		t.Error(err)
+	}
+	if err := client.IntOption(MOSQ_OPT_SEND_MAXIMUM, 100); err != nil {
+		t.Error(err)
+	}
+	if err := client.IntOption(MOSQ_OPT_TCP_NODELAY, 1); err != nil {
+		t.Error(err)
+	}
+	if err := client.StringOption(MOSQ_OPT_BIND_ADDRESS, "127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	// Options with the wrong type of value are rejected
+	if err := client.StringOption(MOSQ_OPT_TCP_NODELAY, "1"); err != Error(MOSQ_ERR_INVAL) {
+		t.Error("Expected MOSQ_ERR_INVAL, got", err)
+	}
+	if err := client.IntOption(MOSQ_OPT_BIND_ADDRESS, 1); err != Error(MOSQ_ERR_INVAL) {
+		t.Error("Expected MOSQ_ERR_INVAL, got", err)
+	}
+	if err := client.VoidOption(MOSQ_OPT_PROTOCOL_VERSION, nil); err != Error(MOSQ_ERR_INVAL) {
+		t.Error("Expected MOSQ_ERR_INVAL, got", err)
+	}
+}
+
+// Test_Mosquitto_013 destroys connected clients while messages are
+// delivered and callbacks are running. Run it with the race detector and
+// pointer checks to find callbacks which use a destroyed client:
+//
+//	GODEBUG=cgocheck=2 go test -race -run Test_Mosquitto_013 ./sys/mosquitto
+func Test_Mosquitto_013(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	// Connect many clients, each with a loop and callbacks set. A callback
+	// which is called after the client is destroyed is an error
+	type stress struct {
+		*ClientEx
+		messages  int32
+		destroyed int32
+	}
+	var late int32
+	clients := make([]*stress, 50)
+	for i := range clients {
+		client, err := NewEx("", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &stress{ClientEx: client}
+		clients[i] = s
+		called := func() {
+			if atomic.LoadInt32(&s.destroyed) != 0 {
+				atomic.AddInt32(&late, 1)
+			}
+		}
+		client.SetConnectCallback(func(rc Error) {
+			called()
+			if rc == MOSQ_ERR_SUCCESS {
+				client.Subscribe("mosquitto/test/stress/#", 1)
+			}
+		})
+		client.SetDisconnectCallback(func(rc Error) { called() })
+		client.SetSubscribeCallback(func(messageId int, GrantedQOS []int) { called() })
+		client.SetPublishCallback(func(messageId int) { called() })
+		client.SetLogCallback(func(level Level, message string) { called() })
+		client.SetMessageCallback(func(message *Message) {
+			called()
+			if len(message.Data()) >= 100 {
+				t.Error("Unexpected message", message.Topic())
+			}
+			atomic.AddInt32(&s.messages, 1)
+		})
+		if err := client.Connect(host, port, 60, false); err != nil {
+			t.Fatal(err)
+		} else if err := client.LoopStart(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Publish messages to the clients until they are destroyed
+	stop := make(chan struct{})
+	var publisher sync.WaitGroup
+	publisher.Add(1)
+	go func() {
+		defer publisher.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				broker.Publish("mosquitto/test/stress/"+strconv.Itoa(i%10), []byte(strings.Repeat("x", i%100)), i%2, false)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		publisher.Wait()
+	}()
+
+	// Wait until every client is receiving messages
+	deadline := time.Now().Add(10 * time.Second)
+	for _, client := range clients {
+		for atomic.LoadInt32(&client.messages) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Timeout waiting for messages")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Destroy the clients concurrently while messages are being delivered:
+	// some with the loop running, some after disconnecting, and some after
+	// stopping the loop and reinitialising
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(client *stress, mode int) {
+			defer wg.Done()
+			switch mode {
+			case 1:
+				if err := client.Disconnect(); err != nil {
+					t.Error(err)
+				}
+			case 2:
+				if err := client.LoopStop(true); err != nil {
+					t.Error(err)
+				} else if err := client.Reinitialise("", true); err != nil {
+					t.Error(err)
+				}
+			}
+			if err := client.Destroy(); err != nil {
+				t.Error(err)
+			}
+			atomic.StoreInt32(&client.destroyed, 1)
+		}(client, i%3)
+	}
+	wg.Wait()
+
+	// There should be no callbacks after the clients are destroyed
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&late); n != 0 {
+		t.Error("Callbacks after destroy:", n)
+	}
+}
+
+func Test_Mosquitto_014(t *testing.T) {
+	// The pure Go topic package should agree with the library
+	filters := []string{
+		"foo/bar", "foo/+", "foo/+/baz", "foo/+/#", "foo/#", "#", "+", "/#", "+/+", "/+/",
+		"$SYS/#", "$SYS/+/uptime", "A/B/+/#", "foo#", "fo#o/", "foo/#a", "foo+", "+foo",
+		"foo/+a", "#/foo", "foo//bar", "", "/", "//",
+	}
+	topics := []string{
+		"foo/bar", "foo", "foo/", "foo/bar/baz", "foo/$bar", "/foo/bar", "$SYS/bar",
+		"$SYS/broker/uptime", "A/B/B/C", "fo2/bar/baz", "foo//bar", "/", "", "foo/+", "foo/#", "+", "#",
+		strings.Repeat("a", 65536),
+	}
+	for _, filter := range filters {
+		for _, value := range topics {
+			expected, experr := TopicMatchesSub(filter, value)
+			match, err := topic.Match(filter, value)
+			if (experr != nil) != (err != nil) || expected != match {
+				t.Errorf("Match(%q, %q): expected %v (err=%v), got %v (err=%v)", filter, value, expected, experr, match, err)
+			}
+		}
+		if expected, err := SubTopicCheck(filter), topic.ValidateSubscribe(filter); (expected != nil) != (err != nil) {
+			t.Errorf("SubTopicCheck(%q): expected err=%v, got err=%v", filter, expected, err)
+		}
+		if expected, err := SubTopicTokenise(filter); err != nil {
+			t.Error(err)
+		} else if levels := topic.Tokenise(filter); strings.Join(expected, "|") != strings.Join(levels, "|") || len(expected) != len(levels) {
+			t.Errorf("SubTopicTokenise(%q): expected %q, got %q", filter, expected, levels)
+		}
+	}
+	for _, value := range topics {
+		if expected, err := PubTopicCheck(value), topic.ValidatePublish(value); (expected != nil) != (err != nil) {
+			t.Errorf("PubTopicCheck(%q): expected err=%v, got err=%v", value, expected, err)
+		}
+	}
+}
+
+func Test_Mosquitto_015(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	client, err := NewEx("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	topics := []string{"mosquitto/test/a", "mosquitto/test/b", "mosquitto/test/+/c"}
+	granted := make(chan []int)
+	client.SetSubscribeCallback(func(messageId int, GrantedQOS []int) {
+		granted <- GrantedQOS
+	})
+
+	if err := client.Connect(host, port, 60, false); err != nil {
+		t.Fatal(err)
+	} else if err := client.LoopStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.LoopStop(true)
+	if _, err := client.SubscribeMultiple(topics, 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case qos := <-granted:
+		if len(qos) != len(topics) {
+			t.Error("Unexpected granted qos", qos)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for subscribe callback")
+	}
+	if _, err := client.UnsubscribeMultiple(topics, nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := client.SubscribeMultiple(nil, 1, 0, nil); err == nil {
+		t.Error("Expected error for no topics")
+	}
+	if err := client.Disconnect(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Mosquitto_016(t *testing.T) {
+	broker, host, port := newBroker(t)
+	defer broker.Close()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	client, err := NewEx("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	if socket := client.Socket(); socket >= 0 {
+		t.Error("Unexpected socket before connect", socket)
+	}
+	if err := client.SetThreaded(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(host, port, 60, false); err != nil {
+		t.Fatal(err)
+	}
+	if socket := client.Socket(); socket < 0 {
+		t.Error("Unexpected socket after connect", socket)
+	}
+
+	// Drive the loop without the library, until the connection is acknowledged
+	connected := make(chan Error, 1)
+	client.SetConnectCallback(func(err Error) {
+		connected <- err
+	})
+	timeout := time.After(5 * time.Second)
+FOR_LOOP:
+	for {
+		if client.WantWrite() {
+			if err := client.LoopWrite(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := client.LoopRead(1); err != nil && err != Error(MOSQ_ERR_CONN_PENDING) {
+			t.Fatal(err)
+		}
+		if err := client.LoopMisc(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-connected:
+			if err != MOSQ_ERR_SUCCESS {
+				t.Error(err)
+			}
+			break FOR_LOOP
+		case <-timeout:
+			t.Fatal("Timeout waiting for connect callback")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err := client.Disconnect(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Mosquitto_017(t *testing.T) {
+	broker := newMosquitto(t, mqtttest.NewMosquittoConfig().
+		WithTLS(true).
+		WithUser("user", "password").
+		WithACL("user user", "topic readwrite test/#"))
+	defer broker.Close()
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	// Connecting with the wrong password is refused
+	host, port := splitAddr(t, broker.Addr())
+	client, err := NewEx("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+	connected := make(chan ReasonCode, 1)
+	client.SetConnectV5Callback(func(rc ReasonCode, flags int, props *Properties) {
+		connected <- rc
+	})
+	if err := client.SetProtocol(MQTT_PROTOCOL_V5); err != nil {
+		t.Fatal(err)
+	} else if err := client.SetCredentials("user", "wrong"); err != nil {
+		t.Fatal(err)
+	} else if err := client.ConnectV5(host, "", port, 60, nil); err != nil {
+		t.Fatal(err)
+	} else if err := client.LoopStart(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rc := <-connected:
+		if rc != MQTT_RC_BAD_USERNAME_OR_PASSWORD && rc != MQTT_RC_NOT_AUTHORIZED {
+			t.Error("Unexpected reason code", rc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for connect callback")
+	}
+	client.LoopStop(true)
+
+	// Connect over TLS with the client certificate, then receive a message
+	host, port = splitAddr(t, broker.TLSAddr())
+	messages := make(chan *Message, 1)
+	client.SetMessageV5Callback(func(message *Message, props *Properties) {
+		messages <- message.Copy()
+	})
+	if err := client.SetCredentials("user", "password"); err != nil {
+		t.Fatal(err)
+	} else if err := client.SetTLS(broker.CAFile(), broker.CertFile(), broker.KeyFile()); err != nil {
+		t.Fatal(err)
+	} else if err := client.ConnectV5(host, "", port, 60, nil); err != nil {
+		t.Fatal(err)
+	} else if err := client.LoopStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.LoopStop(true)
+	select {
+	case rc := <-connected:
+		if rc != MQTT_RC_SUCCESS {
+			t.Fatal("Unexpected reason code", rc, broker.Log())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for connect callback")
+	}
+	if _, err := client.SubscribeV5("test/#", 1, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.PublishV5("test/tls", []byte("hello"), 1, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-messages:
+		defer message.Free()
+		if message.Topic() != "test/tls" || string(message.Data()) != "hello" {
+			t.Error("Unexpected message", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+	if err := client.DisconnectV5(MQTT_RC_NORMAL_DISCONNECTION, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Mosquitto_018(t *testing.T) {
+	broker := newMosquitto(t, mqtttest.NewMosquittoConfig())
+	defer broker.Close()
+	host, port := splitAddr(t, broker.Addr())
+
+	if err := Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer Cleanup()
+
+	// Subscribe to the will topic
+	a, err := NewEx("a", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Destroy()
+	messages := make(chan string, 1)
+	a.SetMessageCallback(func(message *Message) {
+		messages <- string(message.Data())
+	})
+	if err := a.Connect(host, port, 60, false); err != nil {
+		t.Fatal(err)
+	} else if err := a.LoopStart(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.LoopStop(true)
+	if _, err := a.Subscribe("will", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The will message is published when the connection of a client is
+	// taken over by a new connection with the same client id
+	b, err := NewEx("b", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Destroy()
+	if err := b.SetWill("will", []byte("gone"), 1, false); err != nil {
+		t.Fatal(err)
+	} else if err := b.Connect(host, port, 60, false); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewEx("b", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	if err := c.Connect(host, port, 60, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-messages:
+		if data != "gone" {
+			t.Error("Unexpected will message", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for will message", broker.Log())
+	}
+}
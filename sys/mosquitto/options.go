@@ -6,6 +6,7 @@ package mosquitto
 /*
 #cgo pkg-config: libmosquitto
 #include <mosquitto.h>
+#include <mqtt_protocol.h>
 */
 import "C"
 
@@ -13,7 +14,8 @@ import "C"
 // TYPES
 
 type (
-	Option C.enum_mosq_opt_t
+	Option     C.enum_mosq_opt_t
+	OptionType int
 )
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -30,13 +32,63 @@ const (
 	MOSQ_OPT_TLS_ENGINE_KPASS_SHA1 Option = 8
 	MOSQ_OPT_TLS_OCSP_REQUIRED     Option = 9
 	MOSQ_OPT_TLS_ALPN              Option = 10
+	MOSQ_OPT_TCP_NODELAY           Option = 11
+	MOSQ_OPT_BIND_ADDRESS          Option = 12
+	MOSQ_OPT_TLS_USE_OS_CERTS      Option = 13
+)
+
+// The type of value an option accepts, which determines whether it is set
+// with IntOption, StringOption or VoidOption
+const (
+	MOSQ_OPT_TYPE_NONE OptionType = iota
+	MOSQ_OPT_TYPE_INT
+	MOSQ_OPT_TYPE_STRING
+	MOSQ_OPT_TYPE_VOID
+)
+
+// Certificate requirements for SetTLSOpts
+const (
+	MOSQ_TLS_VERIFY_NONE = 0
+	MOSQ_TLS_VERIFY_PEER = 1
 )
 
 const (
 	MQTT_PROTOCOL_V31  = int(C.MQTT_PROTOCOL_V31)
 	MQTT_PROTOCOL_V311 = int(C.MQTT_PROTOCOL_V311)
+	MQTT_PROTOCOL_V5   = int(C.MQTT_PROTOCOL_V5)
+)
+
+const (
+	MQTT_SUB_OPT_NO_LOCAL            = int(C.MQTT_SUB_OPT_NO_LOCAL)
+	MQTT_SUB_OPT_RETAIN_AS_PUBLISHED = int(C.MQTT_SUB_OPT_RETAIN_AS_PUBLISHED)
+	MQTT_SUB_OPT_SEND_RETAIN_ALWAYS  = int(C.MQTT_SUB_OPT_SEND_RETAIN_ALWAYS)
+	MQTT_SUB_OPT_SEND_RETAIN_NEW     = int(C.MQTT_SUB_OPT_SEND_RETAIN_NEW)
+	MQTT_SUB_OPT_SEND_RETAIN_NEVER   = int(C.MQTT_SUB_OPT_SEND_RETAIN_NEVER)
+)
+
+const (
+	// Connect flag set when the broker has resumed a persistent session
+	MQTT_CONNACK_SESSION_PRESENT = 0x01
 )
 
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Type returns the type of value accepted by an option, or
+// MOSQ_OPT_TYPE_NONE if the option is not known
+func (v Option) Type() OptionType {
+	switch v {
+	case MOSQ_OPT_PROTOCOL_VERSION, MOSQ_OPT_SSL_CTX_WITH_DEFAULTS, MOSQ_OPT_RECEIVE_MAXIMUM, MOSQ_OPT_SEND_MAXIMUM, MOSQ_OPT_TLS_OCSP_REQUIRED, MOSQ_OPT_TCP_NODELAY, MOSQ_OPT_TLS_USE_OS_CERTS:
+		return MOSQ_OPT_TYPE_INT
+	case MOSQ_OPT_TLS_KEYFORM, MOSQ_OPT_TLS_ENGINE, MOSQ_OPT_TLS_ENGINE_KPASS_SHA1, MOSQ_OPT_TLS_ALPN, MOSQ_OPT_BIND_ADDRESS:
+		return MOSQ_OPT_TYPE_STRING
+	case MOSQ_OPT_SSL_CTX:
+		return MOSQ_OPT_TYPE_VOID
+	default:
+		return MOSQ_OPT_TYPE_NONE
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // STRINGIFY
 
@@ -62,7 +114,28 @@ func (v Option) String() string {
 		return "MOSQ_OPT_TLS_OCSP_REQUIRED"
 	case MOSQ_OPT_TLS_ALPN:
 		return "MOSQ_OPT_TLS_ALPN"
+	case MOSQ_OPT_TCP_NODELAY:
+		return "MOSQ_OPT_TCP_NODELAY"
+	case MOSQ_OPT_BIND_ADDRESS:
+		return "MOSQ_OPT_BIND_ADDRESS"
+	case MOSQ_OPT_TLS_USE_OS_CERTS:
+		return "MOSQ_OPT_TLS_USE_OS_CERTS"
 	default:
 		return "[?? Invalid Option value]"
 	}
 }
+
+func (v OptionType) String() string {
+	switch v {
+	case MOSQ_OPT_TYPE_NONE:
+		return "MOSQ_OPT_TYPE_NONE"
+	case MOSQ_OPT_TYPE_INT:
+		return "MOSQ_OPT_TYPE_INT"
+	case MOSQ_OPT_TYPE_STRING:
+		return "MOSQ_OPT_TYPE_STRING"
+	case MOSQ_OPT_TYPE_VOID:
+		return "MOSQ_OPT_TYPE_VOID"
+	default:
+		return "[?? Invalid OptionType value]"
+	}
+}
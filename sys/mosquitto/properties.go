@@ -0,0 +1,365 @@
+package mosquitto
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CGO
+
+/*
+#cgo pkg-config: libmosquitto
+#include <stdlib.h>
+#include <mosquitto.h>
+#include <mqtt_protocol.h>
+*/
+import "C"
+
+////////////////////////////////////////////////////////////////////////////////
+// TYPES
+
+type (
+	Property     int
+	PropertyType int
+)
+
+// Properties wraps a list of MQTT v5 properties. A list which is passed to
+// a callback is only valid for the duration of the callback, use Copy to
+// retain it.
+type Properties struct {
+	list  *C.mosquitto_property
+	owned bool
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// CONSTANTS
+
+const (
+	MQTT_PROP_PAYLOAD_FORMAT_INDICATOR     Property = C.MQTT_PROP_PAYLOAD_FORMAT_INDICATOR
+	MQTT_PROP_MESSAGE_EXPIRY_INTERVAL      Property = C.MQTT_PROP_MESSAGE_EXPIRY_INTERVAL
+	MQTT_PROP_CONTENT_TYPE                 Property = C.MQTT_PROP_CONTENT_TYPE
+	MQTT_PROP_RESPONSE_TOPIC               Property = C.MQTT_PROP_RESPONSE_TOPIC
+	MQTT_PROP_CORRELATION_DATA             Property = C.MQTT_PROP_CORRELATION_DATA
+	MQTT_PROP_SUBSCRIPTION_IDENTIFIER      Property = C.MQTT_PROP_SUBSCRIPTION_IDENTIFIER
+	MQTT_PROP_SESSION_EXPIRY_INTERVAL      Property = C.MQTT_PROP_SESSION_EXPIRY_INTERVAL
+	MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER   Property = C.MQTT_PROP_ASSIGNED_CLIENT_IDENTIFIER
+	MQTT_PROP_SERVER_KEEP_ALIVE            Property = C.MQTT_PROP_SERVER_KEEP_ALIVE
+	MQTT_PROP_AUTHENTICATION_METHOD        Property = C.MQTT_PROP_AUTHENTICATION_METHOD
+	MQTT_PROP_AUTHENTICATION_DATA          Property = C.MQTT_PROP_AUTHENTICATION_DATA
+	MQTT_PROP_REQUEST_PROBLEM_INFORMATION  Property = C.MQTT_PROP_REQUEST_PROBLEM_INFORMATION
+	MQTT_PROP_WILL_DELAY_INTERVAL          Property = C.MQTT_PROP_WILL_DELAY_INTERVAL
+	MQTT_PROP_REQUEST_RESPONSE_INFORMATION Property = C.MQTT_PROP_REQUEST_RESPONSE_INFORMATION
+	MQTT_PROP_RESPONSE_INFORMATION         Property = C.MQTT_PROP_RESPONSE_INFORMATION
+	MQTT_PROP_SERVER_REFERENCE             Property = C.MQTT_PROP_SERVER_REFERENCE
+	MQTT_PROP_REASON_STRING                Property = C.MQTT_PROP_REASON_STRING
+	MQTT_PROP_RECEIVE_MAXIMUM              Property = C.MQTT_PROP_RECEIVE_MAXIMUM
+	MQTT_PROP_TOPIC_ALIAS_MAXIMUM          Property = C.MQTT_PROP_TOPIC_ALIAS_MAXIMUM
+	MQTT_PROP_TOPIC_ALIAS                  Property = C.MQTT_PROP_TOPIC_ALIAS
+	MQTT_PROP_MAXIMUM_QOS                  Property = C.MQTT_PROP_MAXIMUM_QOS
+	MQTT_PROP_RETAIN_AVAILABLE             Property = C.MQTT_PROP_RETAIN_AVAILABLE
+	MQTT_PROP_USER_PROPERTY                Property = C.MQTT_PROP_USER_PROPERTY
+	MQTT_PROP_MAXIMUM_PACKET_SIZE          Property = C.MQTT_PROP_MAXIMUM_PACKET_SIZE
+	MQTT_PROP_WILDCARD_SUB_AVAILABLE       Property = C.MQTT_PROP_WILDCARD_SUB_AVAILABLE
+	MQTT_PROP_SUBSCRIPTION_ID_AVAILABLE    Property = C.MQTT_PROP_SUBSCRIPTION_ID_AVAILABLE
+	MQTT_PROP_SHARED_SUB_AVAILABLE         Property = C.MQTT_PROP_SHARED_SUB_AVAILABLE
+)
+
+const (
+	MQTT_PROP_TYPE_BYTE        PropertyType = C.MQTT_PROP_TYPE_BYTE
+	MQTT_PROP_TYPE_INT16       PropertyType = C.MQTT_PROP_TYPE_INT16
+	MQTT_PROP_TYPE_INT32       PropertyType = C.MQTT_PROP_TYPE_INT32
+	MQTT_PROP_TYPE_VARINT      PropertyType = C.MQTT_PROP_TYPE_VARINT
+	MQTT_PROP_TYPE_BINARY      PropertyType = C.MQTT_PROP_TYPE_BINARY
+	MQTT_PROP_TYPE_STRING      PropertyType = C.MQTT_PROP_TYPE_STRING
+	MQTT_PROP_TYPE_STRING_PAIR PropertyType = C.MQTT_PROP_TYPE_STRING_PAIR
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// LIFECYCLE
+
+// NewProperties returns an empty property list, which is freed when it is
+// no longer referenced
+func NewProperties() *Properties {
+	p := &Properties{owned: true}
+	runtime.SetFinalizer(p, (*Properties).Free)
+	return p
+}
+
+// Return a property list which references properties owned by the library
+func propertiesRef(list *C.mosquitto_property) *Properties {
+	if list == nil {
+		return nil
+	}
+	return &Properties{list: list}
+}
+
+// Copy returns a copy of the property list, which is freed when it is no
+// longer referenced
+func (p *Properties) Copy() (*Properties, error) {
+	other := NewProperties()
+	if p == nil || p.list == nil {
+		return other, nil
+	}
+	var list *C.mosquitto_property
+	defer runtime.KeepAlive(p)
+	if err := Error(C.mosquitto_property_copy_all(&list, p.list)); err != MOSQ_ERR_SUCCESS {
+		return nil, err
+	}
+	other.list = list
+	return other, nil
+}
+
+// Free releases the properties, if they are owned by this list. It is not
+// necessary to call Free, as this is done when the list is no longer referenced
+func (p *Properties) Free() {
+	if p == nil || !p.owned || p.list == nil {
+		return
+	}
+	list := p.list
+	C.mosquitto_property_free_all(&list)
+	p.list = nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// ADD PROPERTIES
+
+// AddByte appends a byte property to the list
+func (p *Properties) AddByte(id Property, value uint8) error {
+	return p.add(func(list **C.mosquitto_property) C.int {
+		return C.mosquitto_property_add_byte(list, C.int(id), C.uint8_t(value))
+	})
+}
+
+// AddInt16 appends a two-byte integer property to the list
+func (p *Properties) AddInt16(id Property, value uint16) error {
+	return p.add(func(list **C.mosquitto_property) C.int {
+		return C.mosquitto_property_add_int16(list, C.int(id), C.uint16_t(value))
+	})
+}
+
+// AddInt32 appends a four-byte integer property to the list
+func (p *Properties) AddInt32(id Property, value uint32) error {
+	return p.add(func(list **C.mosquitto_property) C.int {
+		return C.mosquitto_property_add_int32(list, C.int(id), C.uint32_t(value))
+	})
+}
+
+// AddVarint appends a variable byte integer property to the list
+func (p *Properties) AddVarint(id Property, value uint32) error {
+	return p.add(func(list **C.mosquitto_property) C.int {
+		return C.mosquitto_property_add_varint(list, C.int(id), C.uint32_t(value))
+	})
+}
+
+// AddBinary appends a binary data property to the list
+func (p *Properties) AddBinary(id Property, value []byte) error {
+	var data unsafe.Pointer
+	if len(value) > 0xFFFF {
+		return Error(MOSQ_ERR_INVAL)
+	} else if len(value) > 0 {
+		data = C.CBytes(value)
+	}
+	defer C.free(data)
+	return p.add(func(list **C.mosquitto_property) C.int {
+		return C.mosquitto_property_add_binary(list, C.int(id), data, C.uint16_t(len(value)))
+	})
+}
+
+// AddString appends a UTF-8 string property to the list
+func (p *Properties) AddString(id Property, value string) error {
+	cValue := C.CString(value)
+	defer C.free(unsafe.Pointer(cValue))
+	return p.add(func(list **C.mosquitto_property) C.int {
+		return C.mosquitto_property_add_string(list, C.int(id), cValue)
+	})
+}
+
+// AddStringPair appends a UTF-8 string pair property to the list, which
+// is used for user properties
+func (p *Properties) AddStringPair(id Property, name, value string) error {
+	cName, cValue := C.CString(name), C.CString(value)
+	defer C.free(unsafe.Pointer(cName))
+	defer C.free(unsafe.Pointer(cValue))
+	return p.add(func(list **C.mosquitto_property) C.int {
+		return C.mosquitto_property_add_string_pair(list, C.int(id), cName, cValue)
+	})
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// GET PROPERTIES
+
+// GetByte returns the first byte property with an identifier, and false
+// if it is not in the list
+func (p *Properties) GetByte(id Property) (uint8, bool) {
+	defer runtime.KeepAlive(p)
+	var value C.uint8_t
+	if C.mosquitto_property_read_byte(p.ptr(), C.int(id), &value, false) == nil {
+		return 0, false
+	}
+	return uint8(value), true
+}
+
+// GetInt16 returns the first two-byte integer property with an identifier,
+// and false if it is not in the list
+func (p *Properties) GetInt16(id Property) (uint16, bool) {
+	defer runtime.KeepAlive(p)
+	var value C.uint16_t
+	if C.mosquitto_property_read_int16(p.ptr(), C.int(id), &value, false) == nil {
+		return 0, false
+	}
+	return uint16(value), true
+}
+
+// GetInt32 returns the first four-byte integer property with an identifier,
+// and false if it is not in the list
+func (p *Properties) GetInt32(id Property) (uint32, bool) {
+	defer runtime.KeepAlive(p)
+	var value C.uint32_t
+	if C.mosquitto_property_read_int32(p.ptr(), C.int(id), &value, false) == nil {
+		return 0, false
+	}
+	return uint32(value), true
+}
+
+// GetVarint returns the first variable byte integer property with an
+// identifier, and false if it is not in the list
+func (p *Properties) GetVarint(id Property) (uint32, bool) {
+	if values := p.GetVarints(id); len(values) == 0 {
+		return 0, false
+	} else {
+		return values[0], true
+	}
+}
+
+// GetVarints returns all variable byte integer properties with an identifier,
+// which is used for subscription identifiers
+func (p *Properties) GetVarints(id Property) []uint32 {
+	defer runtime.KeepAlive(p)
+	var result []uint32
+	var value C.uint32_t
+	prop := C.mosquitto_property_read_varint(p.ptr(), C.int(id), &value, false)
+	for prop != nil {
+		result = append(result, uint32(value))
+		prop = C.mosquitto_property_read_varint(prop, C.int(id), &value, true)
+	}
+	return result
+}
+
+// GetBinary returns the first binary data property with an identifier,
+// and false if it is not in the list
+func (p *Properties) GetBinary(id Property) ([]byte, bool) {
+	defer runtime.KeepAlive(p)
+	var value unsafe.Pointer
+	var sz C.uint16_t
+	if C.mosquitto_property_read_binary(p.ptr(), C.int(id), &value, &sz, false) == nil {
+		return nil, false
+	}
+	defer C.free(value)
+	return C.GoBytes(value, C.int(sz)), true
+}
+
+// GetString returns the first string property with an identifier, and false
+// if it is not in the list
+func (p *Properties) GetString(id Property) (string, bool) {
+	defer runtime.KeepAlive(p)
+	var value *C.char
+	if C.mosquitto_property_read_string(p.ptr(), C.int(id), &value, false) == nil {
+		return "", false
+	}
+	defer C.free(unsafe.Pointer(value))
+	return C.GoString(value), true
+}
+
+// GetStringPair returns the first string pair property with an identifier,
+// and false if it is not in the list
+func (p *Properties) GetStringPair(id Property) (string, string, bool) {
+	if pairs := p.GetStringPairs(id); len(pairs) == 0 {
+		return "", "", false
+	} else {
+		return pairs[0][0], pairs[0][1], true
+	}
+}
+
+// GetStringPairs returns all the string pair properties with an identifier
+// in order, which is used for user properties
+func (p *Properties) GetStringPairs(id Property) [][2]string {
+	defer runtime.KeepAlive(p)
+	var result [][2]string
+	var name, value *C.char
+	prop := C.mosquitto_property_read_string_pair(p.ptr(), C.int(id), &name, &value, false)
+	for prop != nil {
+		result = append(result, [2]string{C.GoString(name), C.GoString(value)})
+		C.free(unsafe.Pointer(name))
+		C.free(unsafe.Pointer(value))
+		prop = C.mosquitto_property_read_string_pair(prop, C.int(id), &name, &value, true)
+	}
+	return result
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// Len returns the number of properties in the list
+func (p *Properties) Len() int {
+	defer runtime.KeepAlive(p)
+	n := 0
+	for prop := p.ptr(); prop != nil; prop = C.mosquitto_property_next(prop) {
+		n++
+	}
+	return n
+}
+
+// Identifiers returns the identifiers of the properties in the list, in order
+func (p *Properties) Identifiers() []Property {
+	defer runtime.KeepAlive(p)
+	var result []Property
+	for prop := p.ptr(); prop != nil; prop = C.mosquitto_property_next(prop) {
+		result = append(result, Property(C.mosquitto_property_identifier(prop)))
+	}
+	return result
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVATE METHODS
+
+// Return the list, or nil if the list is empty. The list is freed by a
+// finalizer, so callers keep the properties alive until C has used the list
+func (p *Properties) ptr() *C.mosquitto_property {
+	if p == nil {
+		return nil
+	}
+	return p.list
+}
+
+// Append a property to an owned list
+func (p *Properties) add(fn func(**C.mosquitto_property) C.int) error {
+	if p == nil || !p.owned {
+		return Error(MOSQ_ERR_INVAL)
+	}
+	list := p.list
+	if err := Error(fn(&list)); err != MOSQ_ERR_SUCCESS {
+		return err
+	}
+	p.list = list
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// STRINGIFY
+
+func (v Property) String() string {
+	if str := C.mosquitto_property_identifier_to_string(C.int(v)); str != nil {
+		return C.GoString(str)
+	} else {
+		return "[?? Invalid Property value]"
+	}
+}
+
+func (p *Properties) String() string {
+	str := "<properties"
+	for _, prop := range p.Identifiers() {
+		str += " " + prop.String()
+	}
+	return str + ">"
+}
@@ -0,0 +1,87 @@
+package mosquitto
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// CGO
+
+/*
+#cgo pkg-config: libmosquitto
+#include <stdlib.h>
+#include <mosquitto.h>
+*/
+import "C"
+
+////////////////////////////////////////////////////////////////////////////////
+// PUBLIC METHODS
+
+// TopicMatchesSub returns true if a topic matches a subscription, which can
+// contain the '+' and '#' wildcards. Returns MOSQ_ERR_INVAL if the
+// subscription or topic are not valid
+// https://mosquitto.org/api/files/mosquitto-h.html#mosquitto_topic_matches_sub
+func TopicMatchesSub(sub, topic string) (bool, error) {
+	var result C.bool
+	cSub, cTopic := C.CString(sub), C.CString(topic)
+	defer C.free(unsafe.Pointer(cSub))
+	defer C.free(unsafe.Pointer(cTopic))
+	if err := Error(C.mosquitto_topic_matches_sub(cSub, cTopic, &result)); err != MOSQ_ERR_SUCCESS {
+		return false, err
+	} else {
+		return bool(result), nil
+	}
+}
+
+// PubTopicCheck returns MOSQ_ERR_INVAL if a topic is not valid for
+// publishing, which is when it contains wildcards or is too long
+func PubTopicCheck(topic string) error {
+	cTopic := C.CString(topic)
+	defer C.free(unsafe.Pointer(cTopic))
+	if err := Error(C.mosquitto_pub_topic_check(cTopic)); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// SubTopicCheck returns MOSQ_ERR_INVAL if a topic is not valid for
+// subscribing, which is when wildcards do not occupy an entire level,
+// '#' is not the last level, or it is too long
+func SubTopicCheck(sub string) error {
+	cSub := C.CString(sub)
+	defer C.free(unsafe.Pointer(cSub))
+	if err := Error(C.mosquitto_sub_topic_check(cSub)); err != MOSQ_ERR_SUCCESS {
+		return err
+	} else {
+		return nil
+	}
+}
+
+// SubTopicTokenise splits a topic or subscription into levels. Empty levels
+// are returned as empty strings
+func SubTopicTokenise(sub string) ([]string, error) {
+	var topics **C.char
+	var count C.int
+	cSub := C.CString(sub)
+	defer C.free(unsafe.Pointer(cSub))
+	if err := Error(C.mosquitto_sub_topic_tokenise(cSub, &topics, &count)); err != MOSQ_ERR_SUCCESS {
+		return nil, err
+	}
+	defer C.mosquitto_sub_topic_tokens_free(&topics, count)
+
+	var data []*C.char
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	header.Data = uintptr(unsafe.Pointer(topics))
+	header.Len = int(count)
+	header.Cap = int(count)
+
+	result := make([]string, len(data))
+	for i, level := range data {
+		if level != nil {
+			result[i] = C.GoString(level)
+		}
+	}
+	return result, nil
+}